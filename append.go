@@ -0,0 +1,199 @@
+package memdump
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// OpenAppend creates an Encoder that adds objects to the end of a file written
+// by an Encoder, so that a stream can be continued by a later process. obj
+// must be a pointer to an object of the type in the file, such as new(T). The
+// file must be open for reading and writing.
+//
+// If the file is empty then a new stream is begun, as with NewEncoder. An
+// incomplete object at the end of the file, as left by a process that exited
+// while writing it, is truncated away. If an object before the end of the file
+// is malformed or does not match its checksum then an error wrapping
+// ErrCorrupt is returned and the file is left as it was. Files written by NewIndexedEncoder keep
+// their index, which is rewritten by Close, and checksums and compression are
+// used if the file was written with them.
+func OpenAppend(f *os.File, obj interface{}) (*Encoder, error) {
+	t, err := checkPointer(obj)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := describe(t.Elem())
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return NewEncoder(f), nil
+	}
+
+	// read the protocol and header
+	br := bufio.NewReader(io.NewSectionReader(f, 0, size))
+	protocol, err := readPreamble(br)
+	if err != nil {
+		return nil, fmt.Errorf("error reading protocol: %v", err)
+	}
+	base, checksums, compressed := splitProtocol(protocol)
+	if base != framedHomogeneousProtocol && base != indexedProtocol {
+		return nil, fmt.Errorf("cannot append to a stream written with protocol %d", protocol)
+	}
+	fr := newFramedReader(br, preambleSize)
+	fr.checksums = checksums
+	seg, err := fr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("error reading header segment: %w", truncated(err))
+	}
+	var h header
+	err = gob.NewDecoder(bytes.NewBuffer(seg)).Decode(&h)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding header: %v", err)
+	}
+
+	// compare architectures and descriptors
+	err = checkArch(h.Arch)
+	if err != nil {
+		return nil, err
+	}
+	if !descriptorsEqual(desc, h.Descriptor) {
+		return nil, ErrIncompatibleLayout
+	}
+	err = checkCompression(compressed, &h)
+	if err != nil {
+		return nil, err
+	}
+
+	// find the end of the last complete object, using the index if the
+	// stream was closed properly
+	var offsets []int64
+	var end int64
+	if base == indexedProtocol {
+		offsets, end, err = readIndex(f, size, checksums)
+	}
+	if base != indexedProtocol || err != nil {
+		offsets, end, err = scanObjects(f, fr.offset, size, checksums)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = f.Truncate(end)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Seek(end, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Encoder{
+		w:       newFramedWriter(f, end),
+		t:       t,
+		types:   tableSnapshot(h.Types),
+		indexed: base == indexedProtocol,
+	}
+	e.w.checksums = checksums
+	if compressed {
+		e.zip, err = newCompressor(flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if e.indexed {
+		e.offsets = offsets
+	}
+	return e, nil
+}
+
+// scanObjects reads the segments of a homogeneous stream, beginning at
+// offset, and returns the offset of each object and the offset at which the
+// last complete object ends. It stops at the end of the file, at an end marker,
+// or at an object that is cut short by the end of the file. Every complete
+// segment is checked against its checksum if the stream has them, and every
+// footer must hold as many pointers as its length implies, so that a corrupt
+// length prefix is reported as an error wrapping ErrCorrupt rather than being
+// mistaken for an object that was cut short. The exception is a data segment
+// length that runs past the end of the file, which looks just the same.
+func scanObjects(r io.ReaderAt, offset, size int64, checksums bool) ([]int64, int64, error) {
+	var sumSize int64
+	if checksums {
+		sumSize = 4
+	}
+	var offsets []int64
+	var buf []byte
+	prefix := make([]byte, 8)
+	head := make([]byte, 16)
+	for i := 0; ; i++ {
+		// each object is a data segment followed by a footer segment
+		begin, off := offset, offset
+		for seg := 0; seg < 2; seg++ {
+			what := "data segment"
+			if seg == 1 {
+				what = "footer segment"
+			}
+			pos := lengthOffset(off, segmentAlign)
+			if pos+8 > size {
+				return offsets, begin, nil
+			}
+			_, err := r.ReadAt(prefix, pos)
+			if err != nil {
+				return nil, 0, fmt.Errorf("error reading segment length: %v", err)
+			}
+			n := binary.LittleEndian.Uint64(prefix)
+			if n == endOfSegments {
+				// an end marker may only come between objects
+				if seg == 0 {
+					return offsets, begin, nil
+				}
+				return nil, 0, segmentError(what, i, ErrCorrupt)
+			}
+
+			// a footer begins with the number of pointers that follow it and
+			// the offset of the main object, each as an int64
+			if seg == 1 && pos+8+16 <= size {
+				_, err := r.ReadAt(head, pos+8)
+				if err != nil {
+					return nil, 0, fmt.Errorf("error reading footer: %v", err)
+				}
+				count := binary.LittleEndian.Uint64(head)
+				if count > (endOfSegments-16)/8 || n != 16+8*count {
+					return nil, 0, fmt.Errorf("footer of record %d has length %d but holds %d pointers: %w", i, n, count, ErrCorrupt)
+				}
+			}
+			if pos+8+sumSize > size || n > uint64(size-pos-8-sumSize) {
+				return offsets, begin, nil
+			}
+
+			if checksums {
+				if uint64(cap(buf)) < n+4 {
+					buf = make([]byte, n+4)
+				}
+				buf = buf[:n+4]
+				_, err := r.ReadAt(buf, pos+8)
+				if err != nil {
+					return nil, 0, fmt.Errorf("error reading segment: %v", err)
+				}
+				if binary.LittleEndian.Uint32(buf[n:]) != crc32.Checksum(buf[:n], crcTable) {
+					return nil, 0, segmentError(what, i, ErrCorrupt)
+				}
+			}
+			off = pos + 8 + int64(n) + sumSize
+		}
+		offsets = append(offsets, begin)
+		offset = off
+	}
+}
@@ -0,0 +1,222 @@
+package memdump
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTemp(t *testing.T) *os.File {
+	f, err := os.OpenFile(filepath.Join(t.TempDir(), "stream.memdump"), os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func readAll(t *testing.T, f *os.File) []int {
+	_, err := f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	var ids []int
+	dec := NewDecoder(f)
+	for {
+		var dest recordV1
+		err := dec.Decode(&dest)
+		if err == io.EOF {
+			return ids
+		}
+		require.NoError(t, err)
+		ids = append(ids, dest.ID)
+	}
+}
+
+func TestOpenAppend(t *testing.T) {
+	f := openTemp(t)
+	enc := NewEncoder(f)
+	require.NoError(t, enc.Encode(&recordV1{ID: 1, Name: "a"}))
+	require.NoError(t, enc.Encode(&recordV1{ID: 2, Name: "b"}))
+
+	enc, err := OpenAppend(f, new(recordV1))
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(&recordV1{ID: 3, Name: "c"}))
+	assert.Equal(t, []int{1, 2, 3}, readAll(t, f))
+}
+
+func TestOpenAppend_Empty(t *testing.T) {
+	f := openTemp(t)
+	enc, err := OpenAppend(f, new(recordV1))
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(&recordV1{ID: 1}))
+
+	enc, err = OpenAppend(f, new(recordV1))
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(&recordV1{ID: 2}))
+	assert.Equal(t, []int{1, 2}, readAll(t, f))
+}
+
+func TestOpenAppend_Indexed(t *testing.T) {
+	f := openTemp(t)
+	enc := NewIndexedEncoder(f)
+	require.NoError(t, enc.Encode(&recordV1{ID: 1}))
+	require.NoError(t, enc.Close())
+
+	enc, err := OpenAppend(f, new(recordV1))
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(&recordV1{ID: 2, Name: "b"}))
+	require.NoError(t, enc.Close())
+	assert.Equal(t, []int{1, 2}, readAll(t, f))
+
+	r, err := openIndexedFile(t, f)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.Len())
+	var dest recordV1
+	require.NoError(t, r.Get(1, &dest))
+	assert.Equal(t, recordV1{ID: 2, Name: "b"}, dest)
+}
+
+func TestOpenAppend_IndexedNotClosed(t *testing.T) {
+	// the index is rebuilt from the objects in the file
+	f := openTemp(t)
+	enc := NewIndexedEncoder(f)
+	require.NoError(t, enc.Encode(&recordV1{ID: 1}))
+	require.NoError(t, enc.Encode(&recordV1{ID: 2}))
+
+	enc, err := OpenAppend(f, new(recordV1))
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(&recordV1{ID: 3}))
+	require.NoError(t, enc.Close())
+
+	r, err := openIndexedFile(t, f)
+	require.NoError(t, err)
+	require.Equal(t, 3, r.Len())
+	var dest recordV1
+	require.NoError(t, r.Get(2, &dest))
+	assert.Equal(t, 3, dest.ID)
+}
+
+func TestOpenAppend_Truncated(t *testing.T) {
+	f := openTemp(t)
+	enc := NewEncoder(f)
+	require.NoError(t, enc.Encode(&recordV1{ID: 1}))
+	info, err := f.Stat()
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(&recordV1{ID: 2, Name: "cut short"}))
+	require.NoError(t, f.Truncate(info.Size()+20))
+
+	enc, err = OpenAppend(f, new(recordV1))
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(&recordV1{ID: 3}))
+	assert.Equal(t, []int{1, 3}, readAll(t, f))
+}
+
+func TestOpenAppend_IncompatibleLayout(t *testing.T) {
+	f := openTemp(t)
+	require.NoError(t, NewEncoder(f).Encode(&recordV1{ID: 1}))
+
+	_, err := OpenAppend(f, new(recordV2))
+	assert.Equal(t, ErrIncompatibleLayout, err)
+	_, err = OpenAppend(f, recordV1{})
+	assert.IsType(t, &InvalidArgumentError{}, err)
+}
+
+func TestOpenAppend_Heterogeneous(t *testing.T) {
+	f := openTemp(t)
+	x := 1
+	require.NoError(t, NewHeterogeneousEncoder(f).Encode(&x))
+	_, err := OpenAppend(f, new(int))
+	assert.Error(t, err)
+}
+
+func TestOpenAppend_Checksum(t *testing.T) {
+	f := openTemp(t)
+	enc := NewEncoder(f)
+	require.NoError(t, enc.EnableChecksums())
+	require.NoError(t, enc.Encode(&recordV1{ID: 1}))
+	info, err := f.Stat()
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(&recordV1{ID: 2}))
+	require.NoError(t, f.Truncate(info.Size()+17))
+
+	enc, err = OpenAppend(f, new(recordV1))
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(&recordV1{ID: 3}))
+	assert.Equal(t, []int{1, 3}, readAll(t, f))
+}
+
+func TestOpenAppend_Compressed(t *testing.T) {
+	f := openTemp(t)
+	enc := NewEncoder(f)
+	require.NoError(t, enc.EnableCompression(flate.BestSpeed))
+	require.NoError(t, enc.Encode(&recordV1{ID: 1}))
+
+	enc, err := OpenAppend(f, new(recordV1))
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(&recordV1{ID: 2}))
+	assert.Equal(t, []int{1, 2}, readAll(t, f))
+
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	info, err := Inspect(f)
+	require.NoError(t, err)
+	assert.Equal(t, "flate", info.Compress)
+}
+
+// writeCorrupt writes a stream of three records to f, with the first byte of
+// the data segment of the second record, or of its length prefix if prefix
+// is set, increased by delta
+func writeCorrupt(t *testing.T, f *os.File, checksums, prefix bool, delta byte) []byte {
+	enc := NewEncoder(f)
+	if checksums {
+		require.NoError(t, enc.EnableChecksums())
+	}
+	require.NoError(t, enc.Encode(&recordV1{ID: 1, Name: "abc"}))
+	info, err := f.Stat()
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(&recordV1{ID: 2, Name: "def"}))
+	require.NoError(t, enc.Encode(&recordV1{ID: 3, Name: "ghi"}))
+
+	pos := lengthOffset(info.Size(), segmentAlign)
+	if !prefix {
+		pos += 8
+	}
+	var b [1]byte
+	_, err = f.ReadAt(b[:], pos)
+	require.NoError(t, err)
+	b[0] += delta
+	_, err = f.WriteAt(b[:], pos)
+	require.NoError(t, err)
+
+	buf, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	return buf
+}
+
+func TestOpenAppend_CorruptLength(t *testing.T) {
+	for _, checksums := range []bool{false, true} {
+		f := openTemp(t)
+		// shorten the data segment by 8 bytes
+		before := writeCorrupt(t, f, checksums, true, 0xf8)
+
+		_, err := OpenAppend(f, new(recordV1))
+		assert.True(t, errors.Is(err, ErrCorrupt), "%v", err)
+		after, err := os.ReadFile(f.Name())
+		require.NoError(t, err)
+		assert.Equal(t, before, after)
+	}
+}
+
+func TestOpenAppend_CorruptData(t *testing.T) {
+	f := openTemp(t)
+	before := writeCorrupt(t, f, true, false, 1)
+
+	_, err := OpenAppend(f, new(recordV1))
+	assert.True(t, errors.Is(err, ErrCorrupt), "%v", err)
+	after, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
@@ -0,0 +1,77 @@
+package memdump
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+)
+
+// arch describes the properties of a machine architecture that determine the
+// in-memory layout of Go values. It is recorded in the header of each stream.
+// The zero value means that the stream predates the field, in which case the
+// data is assumed to have been written on the current machine.
+type arch struct {
+	WordSize  uintptr // WordSize is the size of int, uintptr, and pointers
+	BigEndian bool    // BigEndian is true if the most significant byte comes first
+}
+
+// nativeArch is the architecture of the current machine
+var nativeArch = arch{
+	WordSize:  uintptrSize,
+	BigEndian: isBigEndian(),
+}
+
+// archs contains the layout of each GOARCH that Go supports
+var archs = map[string]arch{
+	"386":      {WordSize: 4},
+	"amd64":    {WordSize: 8},
+	"arm":      {WordSize: 4},
+	"arm64":    {WordSize: 8},
+	"loong64":  {WordSize: 8},
+	"mips":     {WordSize: 4, BigEndian: true},
+	"mipsle":   {WordSize: 4},
+	"mips64":   {WordSize: 8, BigEndian: true},
+	"mips64le": {WordSize: 8},
+	"ppc64":    {WordSize: 8, BigEndian: true},
+	"ppc64le":  {WordSize: 8},
+	"riscv64":  {WordSize: 8},
+	"s390x":    {WordSize: 8, BigEndian: true},
+	"wasm":     {WordSize: 8},
+}
+
+func isBigEndian() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 0
+}
+
+// resolve gets the architecture that a stream was written on
+func (a arch) resolve() arch {
+	if a.WordSize == 0 {
+		return nativeArch
+	}
+	return a
+}
+
+// byteOrder gets the byte order of the architecture
+func (a arch) byteOrder() binary.ByteOrder {
+	if a.BigEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+func (a arch) String() string {
+	if a.BigEndian {
+		return fmt.Sprintf("%d-bit big-endian", a.WordSize*8)
+	}
+	return fmt.Sprintf("%d-bit little-endian", a.WordSize*8)
+}
+
+// checkArch checks that a stream was written on a machine with the same
+// layout as the current machine
+func checkArch(a arch) error {
+	if a.resolve() != nativeArch {
+		return ErrIncompatibleArch
+	}
+	return nil
+}
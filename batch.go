@@ -0,0 +1,117 @@
+package memdump
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+)
+
+// batchWindow is the number of objects per worker that EncodeBatch may hold
+// in memory, encoded but not yet written
+const batchWindow = 4
+
+// batchResult is an object encoded by a worker in EncodeBatch
+type batchResult struct {
+	data []byte
+	loc  *locations
+	err  error
+	done chan struct{}
+}
+
+// EncodeBatch writes memdumps of the provided objects to output, in order, as
+// if Encode were called for each of them. The objects are encoded on several
+// goroutines at once, so the objects must not be modified until EncodeBatch
+// returns. Each object must be a pointer of the same type as for Encode. If an
+// object cannot be encoded then the objects before it are still written, and
+// the error is returned.
+func (e *Encoder) EncodeBatch(objs ...interface{}) error {
+	for _, obj := range objs {
+		err := e.begin(obj)
+		if err != nil {
+			return err
+		}
+	}
+	if len(objs) == 0 {
+		return nil
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(objs) {
+		workers = len(objs)
+	}
+
+	results := make([]batchResult, len(objs))
+	for i := range results {
+		results[i].done = make(chan struct{})
+	}
+
+	// the window limits how far the workers can get ahead of the writer
+	window := make(chan struct{}, workers*batchWindow)
+	jobs := make(chan int)
+	stop := make(chan struct{})
+	go func() {
+		defer close(jobs)
+		for i := range objs {
+			select {
+			case window <- struct{}{}:
+			case <-stop:
+				return
+			}
+			jobs <- i
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.encodeJobs(objs, results, jobs)
+		}()
+	}
+
+	// write the objects in order as they become available
+	var err error
+	for i := range results {
+		r := &results[i]
+		<-r.done
+		err = r.err
+		if err == nil {
+			err = e.writeRecord(r.data, r.loc)
+		}
+		r.data, r.loc = nil, nil
+		<-window
+		if err != nil {
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+	return err
+}
+
+// encodeJobs encodes the objects whose indices are received from jobs, until
+// jobs is closed
+func (e *Encoder) encodeJobs(objs []interface{}, results []batchResult, jobs <-chan int) {
+	var zip *compressor
+	var zipErr error
+	if e.zip != nil {
+		zip, zipErr = newCompressor(e.zip.level)
+	}
+	for i := range jobs {
+		r := &results[i]
+		if zipErr != nil {
+			r.err = zipErr
+			close(r.done)
+			continue
+		}
+
+		// each object gets its own buffer since it is written later
+		var buf bytes.Buffer
+		r.data, r.loc, r.err = e.encodeData(objs[i], &buf, zip)
+		if r.err == nil && zip != nil {
+			r.data = append([]byte(nil), r.data...)
+		}
+		close(r.done)
+	}
+}
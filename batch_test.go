@@ -0,0 +1,105 @@
+package memdump
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func batchRecords(n int) []interface{} {
+	var objs []interface{}
+	for i := 0; i < n; i++ {
+		objs = append(objs, &recordV1{ID: i, Name: strings.Repeat("x", i%13)})
+	}
+	return objs
+}
+
+func TestEncodeBatch(t *testing.T) {
+	objs := batchRecords(500)
+
+	var seq bytes.Buffer
+	enc := NewEncoder(&seq)
+	for _, obj := range objs {
+		require.NoError(t, enc.Encode(obj))
+	}
+
+	var batch bytes.Buffer
+	enc = NewEncoder(&batch)
+	require.NoError(t, enc.EncodeBatch(objs[:200]...))
+	require.NoError(t, enc.EncodeBatch())
+	require.NoError(t, enc.EncodeBatch(objs[200:]...))
+	assert.Equal(t, seq.Bytes(), batch.Bytes())
+
+	dec := NewDecoder(&batch)
+	for i := range objs {
+		var dest recordV1
+		require.NoError(t, dec.Decode(&dest))
+		assert.Equal(t, objs[i], &dest)
+	}
+	var dest recordV1
+	assert.Equal(t, io.EOF, dec.Decode(&dest))
+}
+
+func TestEncodeBatch_IndexedCompressed(t *testing.T) {
+	objs := batchRecords(100)
+
+	var b bytes.Buffer
+	enc := NewIndexedEncoder(&b)
+	require.NoError(t, enc.EnableChecksums())
+	require.NoError(t, enc.EnableCompression(flate.BestSpeed))
+	require.NoError(t, enc.EncodeBatch(objs...))
+	require.NoError(t, enc.Close())
+
+	r, err := OpenIndexed(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	require.NoError(t, err)
+	require.Equal(t, len(objs), r.Len())
+	for _, i := range []int{99, 0, 42} {
+		var dest recordV1
+		require.NoError(t, r.Get(i, &dest))
+		assert.Equal(t, objs[i], &dest)
+	}
+}
+
+func TestEncodeBatch_TypeMismatch(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	err := enc.EncodeBatch(&recordV1{ID: 1}, &recordV2{ID: 2})
+	assert.IsType(t, &InvalidArgumentError{}, err)
+
+	// nothing but the header is written when the types do not match
+	dec := NewDecoder(&b)
+	var dest recordV1
+	assert.Equal(t, io.EOF, dec.Decode(&dest))
+}
+
+func TestEncodeBatch_Error(t *testing.T) {
+	type unregistered struct{ X int }
+	objs := make([]interface{}, 50)
+	for i := range objs {
+		var x interface{} = i
+		if i == 30 {
+			x = unregistered{i}
+		}
+		objs[i] = &x
+	}
+	Register(0)
+
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	assert.Error(t, enc.EncodeBatch(objs...))
+
+	// the objects before the one that failed are written
+	dec := NewDecoder(&b)
+	for i := 0; i < 30; i++ {
+		var dest interface{}
+		require.NoError(t, dec.Decode(&dest))
+		assert.Equal(t, i, dest)
+	}
+	var dest interface{}
+	assert.Equal(t, io.EOF, dec.Decode(&dest))
+}
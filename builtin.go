@@ -0,0 +1,348 @@
+package memdump
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// builtin handles a standard library type that refers to a canonical runtime
+// object, such as the *time.Location in a time.Time or the interned zone of a
+// netip.Addr. The object itself is not stored, since its contents are private
+// to the standard library. Instead the pointer at offset refers to a record
+// holding a canonical form of the object, such as the name of a time zone,
+// and decoders replace it with a pointer to the runtime's own object.
+type builtin struct {
+	offset uintptr
+
+	// layout is stored in place of the type, and has the same layout except
+	// that the pointer refers to a record of the type that record points to
+	layout reflect.Type
+	record reflect.Type
+
+	encode  func(v unsafe.Pointer) (reflect.Value, error)    // encode gets a pointer to the record for the value at v
+	restore func(rec unsafe.Pointer) (unsafe.Pointer, error) // restore gets the runtime's object for the record at rec
+}
+
+var (
+	locationType = reflect.TypeOf((*time.Location)(nil))
+	addrType     = reflect.TypeOf(netip.Addr{})
+)
+
+// builtins contains the handler for each type that has one
+var builtins = func() map[reflect.Type]*builtin {
+	m := map[reflect.Type]*builtin{
+		locationType: {
+			layout:  reflect.TypeOf((*locationRecord)(nil)),
+			record:  reflect.TypeOf((*locationRecord)(nil)),
+			encode:  encodeLocation,
+			restore: restoreLocation,
+		},
+	}
+	if addrZoneFound {
+		m[addrType] = &builtin{
+			offset:  addrZone,
+			layout:  reflect.TypeOf(addrLayout{}),
+			record:  reflect.TypeOf((*addrRecord)(nil)),
+			encode:  encodeAddr,
+			restore: restoreAddr,
+		}
+	}
+	return m
+}()
+
+// canonicalizer restores the runtime objects that records refer to,
+// remembering the object for each record so that values that share a record
+// are resolved once
+type canonicalizer map[unsafe.Pointer]unsafe.Pointer
+
+// apply replaces the pointer to a record at slot, which belongs to a value
+// with the handler b, with a pointer to the runtime's object
+func (c canonicalizer) apply(slot *unsafe.Pointer, b *builtin) error {
+	if *slot == nil {
+		return nil
+	}
+	p, found := c[*slot]
+	if !found {
+		var err error
+		p, err = b.restore(*slot)
+		if err != nil {
+			return err
+		}
+		c[*slot] = p
+		// overlapping objects may reach the same slot again
+		c[p] = p
+	}
+	*slot = p
+	return nil
+}
+
+// canonicalize applies the builtin handlers to every value that has one and
+// is reachable from the object of type t at ptr, which must be in a relocated
+// decode buffer that has been checked by validate
+func canonicalize(ptr unsafe.Pointer, t reflect.Type, types typeTable) error {
+	c := make(canonicalizer)
+	m := materializer{types: types}
+	var err error
+	m.find(object{ptr: ptr, typ: t, n: 1}, func(o object) {
+		pointers := lookupType(o.typ).pointers
+		size := o.typ.Size()
+		for i := 0; i < o.n && err == nil; i++ {
+			for _, ptr := range pointers {
+				if ptr.b != nil && err == nil {
+					err = c.apply((*unsafe.Pointer)(unsafe.Add(o.ptr, uintptr(i)*size+ptr.offset)), ptr.b)
+				}
+			}
+		}
+	})
+	return err
+}
+
+// locationRecord is stored in place of a *time.Location. Locations in the
+// time zone database, time.UTC, and time.Local are stored by name, and fixed
+// zones are stored with their offset.
+type locationRecord struct {
+	Name   string
+	Fixed  bool
+	Offset int // Offset is the offset of a fixed zone in seconds east of UTC
+}
+
+// encodeLocation gets the record for the *time.Location at v
+func encodeLocation(v unsafe.Pointer) (reflect.Value, error) {
+	loc := *(**time.Location)(v)
+	// String forces the local time zone to be loaded
+	rec := locationRecord{Name: loc.String()}
+	if loc == time.UTC || loc == time.Local {
+		return reflect.ValueOf(&rec), nil
+	}
+	c, err := lookupLocation(rec.Name)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	if c != nil && sameRules(loc, c) {
+		return reflect.ValueOf(&rec), nil
+	}
+	_, offset := time.Date(2000, 1, 1, 0, 0, 0, 0, loc).Zone()
+	if !sameRules(loc, time.FixedZone(rec.Name, offset)) {
+		return reflect.Value{}, fmt.Errorf("cannot store location %q, which is neither in the time zone database nor a fixed zone", rec.Name)
+	}
+	rec.Fixed, rec.Offset = true, offset
+	return reflect.ValueOf(&rec), nil
+}
+
+// restoreLocation gets the *time.Location for the record at rec
+func restoreLocation(rec unsafe.Pointer) (unsafe.Pointer, error) {
+	r := (*locationRecord)(rec)
+	if r.Fixed {
+		loc, err := fixedZone(r.Name, r.Offset)
+		return unsafe.Pointer(loc), err
+	}
+	loc, err := lookupLocation(r.Name)
+	if err != nil {
+		return nil, err
+	}
+	if loc == nil {
+		return nil, fmt.Errorf("unknown time zone %q", r.Name)
+	}
+	return unsafe.Pointer(loc), nil
+}
+
+// maxCached is the number of entries that each zoneCache may hold
+const maxCached = 4096
+
+// errCacheFull is returned when a zone is decoded that is not in a zoneCache
+// that is already full
+var errCacheFull = errors.New("memdump: too many distinct time zones or IPv6 zones have been decoded")
+
+// zoneCache keeps the canonical objects that decoded values refer to, so
+// that decoded values compare equal to one another, and so that the objects
+// stay alive, since the garbage collector does not look inside decode
+// buffers for pointers. Nothing is ever removed, so the keys come from the
+// data and the cache holds at most max entries.
+type zoneCache struct {
+	m   sync.Map
+	n   int32 // n is the number of entries in m
+	max int32
+}
+
+// load gets the value stored for key
+func (c *zoneCache) load(key interface{}) (interface{}, bool) {
+	return c.m.Load(key)
+}
+
+// store stores value for key unless a value is already stored, and returns
+// the stored value. Since the key is kept, it must not refer to a decode
+// buffer.
+func (c *zoneCache) store(key, value interface{}) (interface{}, error) {
+	if atomic.AddInt32(&c.n, 1) > c.max {
+		atomic.AddInt32(&c.n, -1)
+		if v, found := c.m.Load(key); found {
+			return v, nil
+		}
+		return nil, errCacheFull
+	}
+	v, loaded := c.m.LoadOrStore(key, value)
+	if loaded {
+		atomic.AddInt32(&c.n, -1)
+	}
+	return v, nil
+}
+
+// loadedLocations caches the result of time.LoadLocation for each name that
+// it can load. Names that cannot be loaded are not cached, so that the
+// cache only holds zones in the time zone database.
+var loadedLocations = zoneCache{max: maxCached}
+
+// lookupLocation gets the location with the given name, or nil if there is
+// none
+func lookupLocation(name string) (*time.Location, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "UTC":
+		return time.UTC, nil
+	case "Local":
+		// String forces the local time zone to be loaded
+		_ = time.Local.String()
+		return time.Local, nil
+	}
+	if loc, found := loadedLocations.load(name); found {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, nil
+	}
+	// the name may refer to a decode buffer
+	actual, err := loadedLocations.store(string([]byte(name)), loc)
+	if err != nil {
+		return nil, err
+	}
+	return actual.(*time.Location), nil
+}
+
+// fixedZoneKey identifies a location made by time.FixedZone
+type fixedZoneKey struct {
+	name   string
+	offset int
+}
+
+// fixedZones caches the location made by time.FixedZone for each name and
+// offset
+var fixedZones = zoneCache{max: maxCached}
+
+// fixedZone gets the location made by time.FixedZone with the given name and
+// offset
+func fixedZone(name string, offset int) (*time.Location, error) {
+	key := fixedZoneKey{name: name, offset: offset}
+	if loc, found := fixedZones.load(key); found {
+		return loc.(*time.Location), nil
+	}
+	key.name = string([]byte(name))
+	loc, err := fixedZones.store(key, time.FixedZone(key.name, offset))
+	if err != nil {
+		return nil, err
+	}
+	return loc.(*time.Location), nil
+}
+
+// locationRules contains the fields of time.Location that determine the
+// offset and zone name at each instant, or nil if they cannot be found
+var locationRules = func() []reflect.StructField {
+	var fields []reflect.StructField
+	for _, name := range []string{"zone", "tx", "extend"} {
+		f, ok := reflect.TypeOf(time.Location{}).FieldByName(name)
+		if !ok {
+			return nil
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}()
+
+// sameRules determines whether two locations agree about the offset and zone
+// name at every instant. If the rules cannot be compared then it assumes
+// that they do.
+func sameRules(a, b *time.Location) bool {
+	for _, f := range locationRules {
+		x := reflect.NewAt(f.Type, unsafe.Add(unsafe.Pointer(a), f.Offset)).Elem().Interface()
+		y := reflect.NewAt(f.Type, unsafe.Add(unsafe.Pointer(b), f.Offset)).Elem().Interface()
+		if !reflect.DeepEqual(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// addrRecord is stored in place of the zone of a netip.Addr
+type addrRecord struct {
+	Is6  bool
+	Zone string
+}
+
+// addrLayout is stored in place of a netip.Addr, which holds a 128-bit
+// address followed by a pointer to its zone
+type addrLayout struct {
+	Hi, Lo uint64
+	Zone   *addrRecord
+}
+
+// addrZone is the offset within netip.Addr of the pointer to its zone. The
+// handler for netip.Addr is only installed if it has the same layout as
+// addrLayout.
+var addrZone, addrZoneFound = func() (uintptr, bool) {
+	f, ok := addrType.FieldByName("z")
+	if !ok {
+		return 0, false
+	}
+	t := f.Type
+	if t.Kind() == reflect.Struct && t.NumField() == 1 {
+		// unique.Handle wraps the pointer in a struct
+		t = t.Field(0).Type
+	}
+	layout := reflect.TypeOf(addrLayout{})
+	zone, _ := layout.FieldByName("Zone")
+	if t.Kind() != reflect.Ptr || f.Offset != zone.Offset || addrType.Size() != layout.Size() {
+		return 0, false
+	}
+	return f.Offset, true
+}()
+
+// encodeAddr gets the record for the zone of the netip.Addr at v
+func encodeAddr(v unsafe.Pointer) (reflect.Value, error) {
+	addr := (*netip.Addr)(v)
+	return reflect.ValueOf(&addrRecord{Is6: addr.Is6(), Zone: addr.Zone()}), nil
+}
+
+// zones caches an address with each IPv6 zone, which keeps its interned zone
+// alive while decoded addresses refer to it
+var zones = zoneCache{max: maxCached}
+
+// restoreAddr gets the interned zone for the record at rec
+func restoreAddr(rec unsafe.Pointer) (unsafe.Pointer, error) {
+	r := (*addrRecord)(rec)
+	addr := netip.AddrFrom4([4]byte{})
+	switch {
+	case r.Is6 && r.Zone == "":
+		addr = netip.AddrFrom16([16]byte{})
+	case r.Is6:
+		cached, found := zones.load(r.Zone)
+		if !found {
+			zone := string([]byte(r.Zone))
+			var err error
+			cached, err = zones.store(zone, netip.AddrFrom16([16]byte{}).WithZone(zone))
+			if err != nil {
+				return nil, err
+			}
+		}
+		addr = cached.(netip.Addr)
+	case r.Zone != "":
+		return nil, fmt.Errorf("IPv4 address has zone %q", r.Zone)
+	}
+	return *(*unsafe.Pointer)(unsafe.Add(unsafe.Pointer(&addr), addrZone)), nil
+}
@@ -0,0 +1,214 @@
+package memdump
+
+import (
+	"bytes"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+	_ "time/tzdata"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type timesRecord struct {
+	ID    int
+	Times []time.Time
+	Loc   *time.Location
+}
+
+func testTimes(t *testing.T) []time.Time {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	base := time.Date(2024, 3, 10, 12, 30, 0, 0, time.UTC)
+	return []time.Time{
+		base,
+		base.In(time.Local),
+		base.In(newYork),
+		base.In(newYork).Add(time.Hour),
+	}
+}
+
+// assertTimes checks that the times decoded from testTimes are equal to the
+// originals, and refer to time.Local or to the location loaded by name
+func assertTimes(t *testing.T, expected, actual []time.Time) {
+	require.Len(t, actual, len(expected))
+	for i := range expected {
+		assert.True(t, expected[i].Equal(actual[i]), "time %d: %v", i, actual[i])
+		assert.Equal(t, expected[i].String(), actual[i].String())
+	}
+	// == compares the locations as pointers
+	assert.True(t, expected[0] == actual[0])
+	assert.True(t, expected[1] == actual[1])
+	newYork, err := lookupLocation("America/New_York")
+	require.NoError(t, err)
+	assert.True(t, actual[2].Location() == newYork)
+	assert.True(t, actual[3].Location() == actual[2].Location())
+}
+
+func TestBuiltin_Time(t *testing.T) {
+	src := timesRecord{ID: 1, Times: testTimes(t), Loc: time.Local}
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &src))
+	buf := b.Bytes()
+
+	var dest *timesRecord
+	require.NoError(t, DecodeBytes(buf, &dest))
+	assertTimes(t, src.Times, dest.Times)
+	assert.True(t, dest.Loc == time.Local)
+
+	// the rest of the object is still decoded in place
+	assert.True(t, within(unsafe.Pointer(dest), buf))
+	assert.True(t, within(unsafe.Pointer(&dest.Times[0]), buf))
+}
+
+func TestBuiltin_TimeFixedZone(t *testing.T) {
+	// a fixed zone with the name of a zone in the database keeps its own rules
+	for _, loc := range []*time.Location{
+		time.FixedZone("UTC+3", 3*60*60),
+		time.FixedZone("Europe/Paris", 5*60*60),
+	} {
+		src := timesRecord{Times: []time.Time{time.Date(2024, 7, 1, 0, 0, 0, 0, loc)}, Loc: loc}
+		var b bytes.Buffer
+		require.NoError(t, Encode(&b, &src))
+
+		var dest *timesRecord
+		require.NoError(t, Decode(&b, &dest))
+		assert.True(t, src.Times[0].Equal(dest.Times[0]))
+		assert.Equal(t, src.Times[0].String(), dest.Times[0].String())
+		assert.Equal(t, loc.String(), dest.Loc.String())
+		assert.False(t, dest.Loc == loc)
+	}
+}
+
+func TestBuiltin_LocationIsNotStored(t *testing.T) {
+	// only the name of the zone is stored, not its transitions
+	utc := time.Date(2024, 3, 10, 12, 30, 0, 0, time.UTC)
+	loc, err := lookupLocation("America/New_York")
+	require.NoError(t, err)
+	newYork := utc.In(loc)
+	var a, b bytes.Buffer
+	require.NoError(t, Encode(&a, &utc))
+	require.NoError(t, Encode(&b, &newYork))
+	assert.Less(t, b.Len()-a.Len(), 128)
+
+	// nor is it part of the descriptor
+	type storedTime struct {
+		wall uint64
+		ext  int64
+		loc  *locationRecord
+	}
+	expected, err := describe(reflect.TypeOf(storedTime{}))
+	require.NoError(t, err)
+	actual, err := describe(reflect.TypeOf(time.Time{}))
+	require.NoError(t, err)
+	assert.True(t, descriptorsEqual(expected, actual))
+}
+
+func TestBuiltin_UnknownLocation(t *testing.T) {
+	_, err := restoreLocation(unsafe.Pointer(&locationRecord{Name: "Nowhere/Nothing"}))
+	assert.EqualError(t, err, `unknown time zone "Nowhere/Nothing"`)
+
+	// names that are not in the time zone database are not cached
+	_, found := loadedLocations.load("Nowhere/Nothing")
+	assert.False(t, found)
+}
+
+func TestBuiltin_ZoneCacheIsBounded(t *testing.T) {
+	c := zoneCache{max: 2}
+	for _, key := range []string{"a", "b", "a"} {
+		v, err := c.store(key, key+"!")
+		require.NoError(t, err)
+		assert.Equal(t, key+"!", v)
+	}
+	_, err := c.store("c", "c!")
+	assert.Equal(t, errCacheFull, err)
+
+	// entries that are already cached can still be found once it is full
+	v, err := c.store("b", "b?")
+	require.NoError(t, err)
+	assert.Equal(t, "b!", v)
+	assert.EqualValues(t, 2, c.n)
+}
+
+func TestBuiltin_TimeInMap(t *testing.T) {
+	times := testTimes(t)
+	src := map[string]time.Time{"a": times[1], "b": times[2]}
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &src))
+
+	var dest *map[string]time.Time
+	require.NoError(t, Decode(&b, &dest))
+	assert.True(t, src["a"] == (*dest)["a"])
+	newYork, err := lookupLocation("America/New_York")
+	require.NoError(t, err)
+	assert.True(t, (*dest)["b"].Location() == newYork)
+	assert.True(t, src["b"].Equal((*dest)["b"]))
+}
+
+func TestBuiltin_TimeMatchFieldsByName(t *testing.T) {
+	type timesV1 struct {
+		ID    int
+		Times []time.Time
+		ByKey map[string]time.Time
+	}
+	type timesV2 struct {
+		ByKey map[string]time.Time
+		Times []time.Time
+	}
+	times := testTimes(t)
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &timesV1{ID: 1, Times: times, ByKey: map[string]time.Time{"a": times[2]}}))
+
+	var dest *timesV2
+	require.NoError(t, DecodeWithPolicy(&b, &dest, MatchFieldsByName))
+	assertTimes(t, times, dest.Times)
+	assert.True(t, dest.ByKey["a"].Location() == dest.Times[2].Location())
+}
+
+func TestBuiltin_Addr(t *testing.T) {
+	if builtins[addrType] == nil {
+		t.Skip("netip.Addr is not handled by this version of Go")
+	}
+	type addrs struct {
+		Addrs  []netip.Addr
+		Prefix netip.Prefix
+	}
+	src := addrs{
+		Addrs: []netip.Addr{
+			{},
+			netip.MustParseAddr("192.168.0.1"),
+			netip.MustParseAddr("::ffff:192.168.0.1"),
+			netip.MustParseAddr("2001:db8::1"),
+			netip.MustParseAddr("fe80::1%eth0"),
+		},
+		Prefix: netip.MustParsePrefix("10.0.0.0/8"),
+	}
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &src))
+	buf := b.Bytes()
+
+	var dest *addrs
+	require.NoError(t, DecodeBytes(buf, &dest))
+	require.Len(t, dest.Addrs, len(src.Addrs))
+	for i, addr := range src.Addrs {
+		assert.True(t, addr == dest.Addrs[i], "address %d: %v", i, dest.Addrs[i])
+		assert.Equal(t, addr.Is4(), dest.Addrs[i].Is4())
+		assert.Equal(t, addr.String(), dest.Addrs[i].String())
+	}
+	assert.True(t, src.Prefix == dest.Prefix)
+	assert.True(t, within(unsafe.Pointer(&dest.Addrs[0]), buf))
+}
+
+func TestBuiltin_AddrDescriptor(t *testing.T) {
+	if builtins[addrType] == nil {
+		t.Skip("netip.Addr is not handled by this version of Go")
+	}
+	expected, err := describe(reflect.TypeOf(addrLayout{}))
+	require.NoError(t, err)
+	actual, err := describe(addrType)
+	require.NoError(t, err)
+	assert.True(t, descriptorsEqual(expected, actual))
+}
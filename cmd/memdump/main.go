@@ -0,0 +1,136 @@
+// Command memdump examines files written by the memdump package without
+// needing the Go types that they were written from.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	arg "github.com/alexflint/go-arg"
+	memdump "github.com/alexflint/go-memdump"
+)
+
+type inspectCmd struct {
+	Path string `arg:"positional,required" help:"path to a memdump file"`
+}
+
+type toJSONCmd struct {
+	Path string `arg:"positional,required" help:"path to a memdump file"`
+}
+
+type args struct {
+	Inspect *inspectCmd `arg:"subcommand:inspect" help:"print the layout and records in a memdump file"`
+	ToJSON  *toJSONCmd  `arg:"subcommand:tojson" help:"print each record in a memdump file as a line of JSON"`
+}
+
+func main() {
+	var args args
+	p := arg.MustParse(&args)
+
+	var err error
+	switch {
+	case args.Inspect != nil:
+		err = inspect(os.Stdout, args.Inspect.Path)
+	case args.ToJSON != nil:
+		err = toJSON(os.Stdout, args.ToJSON.Path)
+	default:
+		p.Fail("missing subcommand")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// inspect prints a summary of the memdump file at path
+func inspect(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := memdump.Inspect(f)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", path, err)
+	}
+
+	fmt.Fprintf(w, "protocol: %d (%s)\n", info.Protocol, info.Format)
+	if info.Arch != "" {
+		fmt.Fprintf(w, "arch:     %s\n", info.Arch)
+	}
+	if info.Checksum {
+		fmt.Fprintf(w, "checksum: crc32c\n")
+	}
+	if info.Compress != "" {
+		fmt.Fprintf(w, "compress: %s\n", info.Compress)
+	}
+	fmt.Fprintf(w, "records:  %d\n", len(info.Records))
+	if len(info.Types) > 0 {
+		fmt.Fprintf(w, "registered types:\n")
+		for _, name := range info.Types {
+			fmt.Fprintf(w, "    %s\n", name)
+		}
+	}
+	if info.Layout != "" {
+		fmt.Fprintf(w, "\nlayout:\n%s", indent(info.Layout))
+	}
+
+	// heterogeneous streams with a type table have a layout for each type,
+	// which the records refer to by type ID
+	for i, typ := range info.Table {
+		if typ.Name != "" {
+			fmt.Fprintf(w, "\nlayout of type %d (%s):\n%s", i, typ.Name, indent(typ.Layout))
+		} else {
+			fmt.Fprintf(w, "\nlayout of type %d:\n%s", i, indent(typ.Layout))
+		}
+	}
+
+	fmt.Fprintf(w, "\n")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	if len(info.Table) > 0 {
+		fmt.Fprintf(tw, "record\ttype\tdata bytes\tpointers\tmain offset\t\n")
+		for i, rec := range info.Records {
+			fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%d\t\n", i, rec.TypeID, rec.DataSize, rec.Pointers, rec.Main)
+		}
+	} else {
+		fmt.Fprintf(tw, "record\tdata bytes\tpointers\tmain offset\t\n")
+		for i, rec := range info.Records {
+			fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t\n", i, rec.DataSize, rec.Pointers, rec.Main)
+		}
+	}
+	tw.Flush()
+
+	// other heterogeneous streams have a layout for each record
+	for i, rec := range info.Records {
+		if rec.Layout != "" && rec.Type != "" {
+			fmt.Fprintf(w, "\nlayout of record %d (%s):\n%s", i, rec.Type, indent(rec.Layout))
+		} else if rec.Layout != "" {
+			fmt.Fprintf(w, "\nlayout of record %d:\n%s", i, indent(rec.Layout))
+		}
+	}
+	return nil
+}
+
+// toJSON prints the records in the memdump file at path as JSON
+func toJSON(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = memdump.ToJSON(f, w)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return nil
+}
+
+// indent indents each line of s
+func indent(s string) string {
+	return "    " + strings.ReplaceAll(strings.TrimSuffix(s, "\n"), "\n", "\n    ") + "\n"
+}
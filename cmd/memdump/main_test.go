@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unsafe"
+
+	memdump "github.com/alexflint/go-memdump"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspect(t *testing.T) {
+	type T struct {
+		X int
+		Y string
+	}
+	path := filepath.Join(t.TempDir(), "data.memdump")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	enc := memdump.NewEncoder(f)
+	require.NoError(t, enc.Encode(&T{1, "abc"}))
+	require.NoError(t, enc.Encode(&T{2, "def"}))
+	require.NoError(t, f.Close())
+
+	var out bytes.Buffer
+	require.NoError(t, inspect(&out, path))
+	assert.Contains(t, out.String(), "protocol: 3 (homogeneous)")
+	assert.Contains(t, out.String(), "records:  2")
+	assert.Contains(t, out.String(), fmt.Sprintf("type T0 struct { // %d bytes", unsafe.Sizeof(T{})))
+}
+
+func TestInspect_Heterogeneous(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.memdump")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	enc := memdump.NewHeterogeneousEncoder(f)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, enc.Encode(&i))
+	}
+	require.NoError(t, f.Close())
+
+	var out bytes.Buffer
+	require.NoError(t, inspect(&out, path))
+	assert.Contains(t, out.String(), "records:  3")
+	assert.Equal(t, 1, strings.Count(out.String(), "layout of type"))
+}
+
+func TestInspect_Missing(t *testing.T) {
+	var out bytes.Buffer
+	assert.Error(t, inspect(&out, filepath.Join(t.TempDir(), "missing")))
+}
+
+func TestToJSON(t *testing.T) {
+	type T struct {
+		X int
+		Y string
+	}
+	path := filepath.Join(t.TempDir(), "data.memdump")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	enc := memdump.NewEncoder(f)
+	require.NoError(t, enc.Encode(&T{1, "abc"}))
+	require.NoError(t, enc.Encode(&T{2, "def"}))
+	require.NoError(t, f.Close())
+
+	var out bytes.Buffer
+	require.NoError(t, toJSON(&out, path))
+	assert.Equal(t, "{\"X\":1,\"Y\":\"abc\"}\n{\"X\":2,\"Y\":\"def\"}\n", out.String())
+}
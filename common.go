@@ -1,18 +1,132 @@
 package memdump
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
 
 // Protocols numbers used: (do not re-use)
 //  1: homogeneous protocol, April 20, 2016
 //  2: heterogeneous protocol, April 20, 2016
+//  3: homogeneous protocol with length-prefixed segments
+//  4: heterogeneous protocol with length-prefixed segments
+//  5: single-object protocol with a header and a page-aligned data segment
+//  6: homogeneous protocol with length-prefixed segments and a trailing index
+//  7: single-object protocol with the locations after the data segment
+//  8: heterogeneous protocol with length-prefixed segments and a type table,
+//     so that each descriptor is written once rather than with every object
+//
+// Protocols 3, 4, 6, and 8 may be combined with checksumFlag, in which case each
+// segment is followed by its CRC-32C checksum, and with compressionFlag, in
+// which case each data segment is compressed with the codec named in the
+// header.
 
 const (
-	homogeneousProtocol   int32 = 1
-	heterogeneousProtocol int32 = 2
+	homogeneousProtocol         int32 = 1
+	heterogeneousProtocol       int32 = 2
+	framedHomogeneousProtocol   int32 = 3
+	framedHeterogeneousProtocol int32 = 4
+	singleProtocol              int32 = 5
+	indexedProtocol             int32 = 6
+	streamedSingleProtocol      int32 = 7
+	tabledHeterogeneousProtocol int32 = 8
+
+	checksumFlag    int32 = 0x100
+	compressionFlag int32 = 0x200
 )
 
+// dataAlign is the alignment of the data segment in files written by Encode,
+// so that the data begins on a fresh page when the file is mapped into memory.
+const dataAlign = 4096
+
 var (
 	// ErrIncompatibleLayout is returned by decoders when the object on the wire has
 	// an in-memory layout that is not compatible with the requested Go type.
 	ErrIncompatibleLayout = errors.New("attempted to load data with incompatible layout")
+
+	// ErrIncompatibleArch is returned by decoders when the data was written on a
+	// machine with a different word size or byte order. Use Transcode to convert it.
+	ErrIncompatibleArch = errors.New("attempted to load data written on an incompatible architecture")
+
+	// ErrCorrupt is returned by decoders when a segment of a stream written
+	// with checksums does not match its checksum, and by OpenAppend when a
+	// record before the end of the file is malformed. It is wrapped in an
+	// error that names the record, so use errors.Is to test for it.
+	ErrCorrupt = errors.New("data is corrupt")
+)
+
+// UnsupportedTypeError is returned by encoders and decoders when an object
+// contains a type that cannot be stored, such as a channel or a function.
+type UnsupportedTypeError struct {
+	Type reflect.Type // Type is the type that cannot be stored
+	Path string       // Path locates the type within the object, such as "Items[].Callback"
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("memdump: unsupported type %v", e.Type)
+	}
+	return fmt.Sprintf("memdump: unsupported type %v at %s", e.Type, e.Path)
+}
+
+// UnregisteredTypeError is returned by encoders when an interface holds a
+// value whose type has not been registered with Register or RegisterType.
+type UnregisteredTypeError struct {
+	Type reflect.Type // Type is the concrete type held by the interface
+	Path string       // Path locates the interface within the object that holds it, such as "Shapes[]"
+}
+
+func (e *UnregisteredTypeError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("memdump: type %v was stored in an interface but has not been registered", e.Type)
+	}
+	return fmt.Sprintf("memdump: type %v was stored in an interface at %s but has not been registered", e.Type, e.Path)
+}
+
+// InvalidArgumentError is returned by encoders and decoders when they are
+// passed an argument of the wrong type, such as a value rather than a pointer.
+type InvalidArgumentError struct {
+	Type     reflect.Type // Type is the type of the argument, or nil if it was nil
+	Expected string       // Expected describes what was expected instead
+}
+
+func (e *InvalidArgumentError) Error() string {
+	return fmt.Sprintf("memdump: expected %s but got %v", e.Expected, e.Type)
+}
+
+// checkPointer checks that obj is a non-nil pointer
+func checkPointer(obj interface{}) (reflect.Type, error) {
+	v := reflect.ValueOf(obj)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil, &InvalidArgumentError{Type: reflect.TypeOf(obj), Expected: "a non-nil pointer"}
+	}
+	return v.Type(), nil
+}
+
+// checkPointerToPointer checks that ptrptr is a non-nil pointer to a pointer
+func checkPointerToPointer(ptrptr interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(ptrptr)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Ptr {
+		return reflect.Value{}, &InvalidArgumentError{Type: reflect.TypeOf(ptrptr), Expected: "a non-nil pointer to a pointer"}
+	}
+	return v, nil
+}
+
+// LayoutPolicy determines what decoders do when the stored layout of an
+// object differs from the layout of the requested Go type
+type LayoutPolicy int
+
+const (
+	// StrictLayout rejects data with a different layout by returning
+	// ErrIncompatibleLayout. This is the default.
+	StrictLayout LayoutPolicy = iota
+
+	// MatchFieldsByName copies each struct field from the stored object to
+	// the field of the requested type with the same name, or the same
+	// memdump tag. Fields that are missing from the stored object are left
+	// zero, and stored fields that no longer exist are dropped. Data that is
+	// converted in this way is copied to the heap, so it is slower to decode.
+	// ErrIncompatibleLayout is still returned if a field changes kind or size.
+	MatchFieldsByName
 )
@@ -0,0 +1,99 @@
+package memdump
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// flateCompression is the name recorded in the header of streams whose data
+// segments are compressed with compress/flate
+const flateCompression = "flate"
+
+// compressor compresses data segments. Each compressed segment begins with
+// the uncompressed length as a uint64, followed by the flate stream.
+type compressor struct {
+	level int
+	buf   bytes.Buffer
+	w     *flate.Writer
+}
+
+func newCompressor(level int) (*compressor, error) {
+	c := compressor{level: level}
+	w, err := flate.NewWriter(&c.buf, level)
+	if err != nil {
+		return nil, err
+	}
+	c.w = w
+	return &c, nil
+}
+
+// compress returns the compressed form of seg, which is valid until the next
+// call to compress
+func (c *compressor) compress(seg []byte) ([]byte, error) {
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(seg)))
+	c.buf.Reset()
+	c.buf.Write(size[:])
+	c.w.Reset(&c.buf)
+	_, err := c.w.Write(seg)
+	if err != nil {
+		return nil, err
+	}
+	err = c.w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return c.buf.Bytes(), nil
+}
+
+// checkCompression checks that the data segments in a stream are compressed
+// with a codec that this package knows how to decompress
+func checkCompression(compressed bool, h *header) error {
+	switch {
+	case !compressed && h.Compression != "":
+		return fmt.Errorf("header names compression %q but the protocol does not", h.Compression)
+	case compressed && h.Compression != flateCompression:
+		return fmt.Errorf("unknown compression %q", h.Compression)
+	}
+	return nil
+}
+
+// decompress returns the uncompressed form of a segment written by compressor
+func decompress(seg []byte) ([]byte, error) {
+	if len(seg) < 8 {
+		return nil, fmt.Errorf("compressed segment is too short")
+	}
+	size := binary.LittleEndian.Uint64(seg)
+	if size > uint64(maxInt) {
+		return nil, fmt.Errorf("uncompressed length %d is too large", size)
+	}
+	r := flate.NewReader(bytes.NewReader(seg[8:]))
+	defer r.Close()
+
+	// a corrupt length should not force a huge allocation
+	var out []byte
+	var err error
+	if size <= maxEagerSegment {
+		out = make([]byte, size)
+		_, err = io.ReadFull(r, out)
+	} else {
+		out, err = io.ReadAll(io.LimitReader(r, int64(size)))
+		if err == nil && uint64(len(out)) < size {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing segment: %v", err)
+	}
+
+	// the flate stream must end exactly at the recorded length
+	var extra [1]byte
+	n, _ := r.Read(extra[:])
+	if n > 0 {
+		return nil, fmt.Errorf("compressed segment is longer than its recorded length")
+	}
+	return out, nil
+}
@@ -0,0 +1,150 @@
+package memdump
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompress_RoundTrip(t *testing.T) {
+	zip, err := newCompressor(flate.BestSpeed)
+	require.NoError(t, err)
+
+	for _, seg := range [][]byte{nil, []byte("abc"), make([]byte, 100000)} {
+		compressed, err := zip.compress(seg)
+		require.NoError(t, err)
+		out, err := decompress(compressed)
+		require.NoError(t, err)
+		assert.Equal(t, len(seg), len(out))
+		assert.True(t, bytes.Equal(seg, out))
+	}
+}
+
+func TestCompress_InvalidLevel(t *testing.T) {
+	assert.Error(t, NewEncoder(io.Discard).EnableCompression(42))
+}
+
+func TestCompress_AfterEncode(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	require.NoError(t, enc.Encode(&recordV1{ID: 1}))
+	assert.Error(t, enc.EnableCompression(flate.BestSpeed))
+
+	henc := NewHeterogeneousEncoder(&b)
+	require.NoError(t, henc.Encode(&recordV1{ID: 1}))
+	assert.Error(t, henc.EnableCompression(flate.BestSpeed))
+}
+
+func TestDecompress_Invalid(t *testing.T) {
+	zip, err := newCompressor(flate.DefaultCompression)
+	require.NoError(t, err)
+	compressed, err := zip.compress([]byte("abcdef"))
+	require.NoError(t, err)
+
+	_, err = decompress(compressed[:4])
+	assert.Error(t, err)
+
+	// the recorded length is too long, then too short
+	wrong := append([]byte(nil), compressed...)
+	wrong[0]++
+	_, err = decompress(wrong)
+	assert.Error(t, err)
+	wrong[0] -= 2
+	_, err = decompress(wrong)
+	assert.Error(t, err)
+
+	// the length is huge
+	wrong[7] = 0x7f
+	_, err = decompress(wrong)
+	assert.Error(t, err)
+}
+
+func TestCompress_Homogeneous(t *testing.T) {
+	type T struct {
+		X   int
+		Pad [1000]int64
+		S   string
+	}
+	src := []T{{X: 1, S: "a"}, {X: 2, S: "b"}}
+
+	var plain, compressed bytes.Buffer
+	enc := NewEncoder(&plain)
+	zenc := NewEncoder(&compressed)
+	require.NoError(t, zenc.EnableCompression(flate.BestSpeed))
+	for i := range src {
+		require.NoError(t, enc.Encode(&src[i]))
+		require.NoError(t, zenc.Encode(&src[i]))
+	}
+	assert.Less(t, compressed.Len(), plain.Len()/10)
+
+	dec := NewDecoder(&compressed)
+	for i := range src {
+		var dest T
+		require.NoError(t, dec.Decode(&dest))
+		assert.Equal(t, src[i], dest)
+	}
+	var dest T
+	assert.Equal(t, io.EOF, dec.Decode(&dest))
+}
+
+func TestCompress_Heterogeneous(t *testing.T) {
+	x, s := 3, "abc"
+	var b bytes.Buffer
+	enc := NewHeterogeneousEncoder(&b)
+	require.NoError(t, enc.EnableCompression(flate.DefaultCompression))
+	require.NoError(t, enc.EnableChecksums())
+	require.NoError(t, enc.Encode(&x))
+	require.NoError(t, enc.Encode(&s))
+
+	dec := NewHeterogeneousDecoder(&b)
+	var x2 int
+	var s2 string
+	require.NoError(t, dec.Decode(&x2))
+	require.NoError(t, dec.Decode(&s2))
+	assert.Equal(t, x, x2)
+	assert.Equal(t, s, s2)
+	assert.Equal(t, io.EOF, dec.Decode(&x2))
+}
+
+func TestCompress_Indexed(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewIndexedEncoder(&b)
+	require.NoError(t, enc.EnableCompression(flate.BestSpeed))
+	for i := 0; i < 5; i++ {
+		require.NoError(t, enc.Encode(&recordV1{ID: i, Name: "abc"}))
+	}
+	require.NoError(t, enc.Close())
+
+	r, err := OpenIndexed(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	require.NoError(t, err)
+	var dest recordV1
+	require.NoError(t, r.Get(3, &dest))
+	assert.Equal(t, recordV1{ID: 3, Name: "abc"}, dest)
+}
+
+func TestCompress_Transcoded(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	require.NoError(t, enc.EnableCompression(flate.BestSpeed))
+	require.NoError(t, enc.Encode(&recordV1{ID: 1, Name: "abc"}))
+
+	native := transcodeVia(t, &b, "386")
+	info, err := Inspect(bytes.NewReader(native.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, "flate", info.Compress)
+
+	var dest recordV1
+	require.NoError(t, NewDecoder(native).Decode(&dest))
+	assert.Equal(t, recordV1{ID: 1, Name: "abc"}, dest)
+}
+
+func TestCompress_UnknownCodec(t *testing.T) {
+	assert.Error(t, checkCompression(true, &header{Compression: "zstd"}))
+	assert.Error(t, checkCompression(false, &header{Compression: "flate"}))
+	assert.NoError(t, checkCompression(true, &header{Compression: "flate"}))
+	assert.NoError(t, checkCompression(false, &header{}))
+}
@@ -0,0 +1,665 @@
+package memdump
+
+import (
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// layout describes how to decode objects that were stored with the
+// descriptor desc and the table of registered types stored
+type layout struct {
+	desc    descriptor
+	stored  []registeredType
+	types   typeTable
+	convert bool
+}
+
+// newLayout compares a stored descriptor with the layout of t. If they differ
+// then under StrictLayout the result is ErrIncompatibleLayout, and under
+// MatchFieldsByName the objects are converted to t as they are decoded.
+func newLayout(policy LayoutPolicy, t reflect.Type, desc descriptor, stored []registeredType) (*layout, error) {
+	l := layout{
+		desc:   desc,
+		stored: stored,
+		types:  resolveTypes(stored),
+	}
+
+	current, err := describe(t)
+	if err != nil {
+		return nil, err
+	}
+	same := descriptorsEqual(current, desc)
+	switch {
+	case same && l.types.sameLayout():
+		return &l, nil
+	case policy == StrictLayout && !same:
+		return nil, ErrIncompatibleLayout
+	case policy == StrictLayout:
+		// registered types with a different layout are reported by
+		// validate if they are actually used
+		return &l, nil
+	case policy == MatchFieldsByName:
+		// the converter divides regions by the sizes in the descriptors, so
+		// they must be consistent as well as in range
+		err := desc.check()
+		if err == nil {
+			err = desc.checkSizes(uintptrSize)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid descriptor: %v", err)
+		}
+		for _, entry := range stored {
+			err = entry.Descriptor.check()
+			if err == nil {
+				err = entry.Descriptor.checkSizes(uintptrSize)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid descriptor for %q: %v", entry.Name, err)
+			}
+		}
+		l.convert = true
+		return &l, nil
+	default:
+		return nil, fmt.Errorf("invalid layout policy %d", policy)
+	}
+}
+
+// decode gets an object of type t from a buffer produced by memEncoder
+func (l *layout) decode(buf []byte, ptrs []int64, main int64, t reflect.Type) (interface{}, error) {
+	if l.convert {
+		return convert(buf, ptrs, main, t, l)
+	}
+	return relocate(buf, ptrs, main, t, l.types)
+}
+
+// typeRef identifies a type in one of the descriptors in a stream. Index zero
+// is the descriptor of the main object, and index i is the descriptor of the
+// registered type with ID i.
+type typeRef struct {
+	desc int
+	id   int
+}
+
+// convertKey identifies n objects stored at off that are converted to type t
+type convertKey struct {
+	off int64
+	ref typeRef
+	t   reflect.Type
+	n   int64
+}
+
+// pendingConvert is a pointer or slice whose contents are yet to be converted
+type pendingConvert struct {
+	dst reflect.Value
+	off int64
+	ref typeRef
+	n   int64
+}
+
+// reference is a pointer or slice in dst that is set to refer to n objects
+// stored at off
+type reference struct {
+	dst reflect.Value
+	off int64
+	ref typeRef
+	n   int64
+}
+
+// converter copies objects out of a buffer produced by memEncoder into freshly
+// allocated objects of different types, matching struct fields by name. It
+// works on offsets and checks each one, so the buffer need not be validated.
+// The objects are grouped as they are by the transcoder, and the objects in
+// each group are converted together so that they still overlap.
+type converter struct {
+	rawData
+	descs    []descriptor
+	types    typeTable
+	regions  *transcodeState
+	bases    map[*transcodeGroup][]reflect.Value // bases contains the slices that the cover of each group is converted to
+	strings  map[*transcodeGroup]string
+	objects  map[convertKey]reflect.Value
+	maps     map[convertKey]reflect.Value
+	queue    []pendingConvert
+	deferred []reference // deferred contains the references to parts of objects
+
+	// builtins contains the pointers to records in converted values that have a
+	// builtin handler, and assign contains the map entries and interface values that are set after
+	// the handlers have been applied, since they hold copies
+	builtins []builtinValue
+	assign   []func()
+}
+
+// builtinValue is the pointer to a record at slot in a converted value that
+// has the handler b
+type builtinValue struct {
+	slot *unsafe.Pointer
+	b    *builtin
+}
+
+// convert reads the object at offset main, which was stored with the layout
+// l, into a new object of type t and returns a pointer to it
+func convert(buf []byte, ptrs []int64, main int64, t reflect.Type, l *layout) (interface{}, error) {
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("cannot convert an empty buffer")
+	}
+	buf = alignBuffer(buf)
+
+	data, err := newRawData(buf, ptrs, nativeArch)
+	if err != nil {
+		return nil, err
+	}
+
+	c := converter{
+		rawData: data,
+		descs:   []descriptor{l.desc},
+		types:   l.types,
+		bases:   make(map[*transcodeGroup][]reflect.Value),
+		strings: make(map[*transcodeGroup]string),
+		objects: make(map[convertKey]reflect.Value),
+		maps:    make(map[convertKey]reflect.Value),
+	}
+	for _, entry := range l.stored {
+		c.descs = append(c.descs, entry.Descriptor)
+	}
+
+	// find the groups of overlapping objects
+	tc := transcoder{from: nativeArch, to: nativeArch, src: c.descs, dst: c.descs}
+	for _, d := range c.descs {
+		tc.pointers = append(tc.pointers, containsPointers(d))
+	}
+	c.regions = &transcodeState{
+		transcoder: &tc,
+		rawData:    data,
+		seen:       make(map[transcodeRegion]bool),
+	}
+	err = c.regions.findGroups(main)
+	if err != nil {
+		return nil, err
+	}
+
+	out := reflect.New(reflect.PtrTo(t)).Elem()
+	c.refer(reference{dst: out, off: main, n: 1})
+	for {
+		for len(c.queue) > 0 {
+			cur := c.queue[len(c.queue)-1]
+			c.queue = c.queue[:len(c.queue)-1]
+			if cur.dst.Kind() == reflect.Ptr {
+				err = c.convert(cur.dst.Elem(), cur.off, cur.ref)
+			} else {
+				err = c.convertRange(cur.dst, cur.off, cur.ref, cur.n)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(c.deferred) == 0 {
+			break
+		}
+		c.resolve()
+	}
+
+	canon := make(canonicalizer)
+	for _, v := range c.builtins {
+		err = canon.apply(v.slot, v.b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, assign := range c.assign {
+		assign()
+	}
+	return out.Interface(), nil
+}
+
+// refer sets the pointer or slice in r to refer to the objects that it was
+// stored with. Objects that are part of a group, such as a sub-slice of an
+// array, are taken from the slice that the cover of the group is converted
+// to. References to a part of an object are deferred until the object has
+// been converted.
+func (c *converter) refer(r reference) {
+	g := c.regions.groupAt(r.off)
+	if g == nil || g.cover.kind != valueRegion || r.n == 0 {
+		c.copyOf(r)
+		return
+	}
+	coverRef, coverN := c.regions.flatten(g.cover.ref, g.cover.n)
+	size := int64(c.descs[coverRef.desc][coverRef.id].Size)
+	ref, t, n := c.flatten(r.ref, r.dst.Type().Elem(), r.n)
+	rel := r.off - g.start
+	switch {
+	case size == 0:
+		c.copyOf(r)
+	case ref == coverRef && rel%size == 0 && rel/size+n <= coverN:
+		b := c.base(g, t)
+		c.set(r, unsafe.Pointer(b.Index(int(rel/size)).UnsafeAddr()))
+	default:
+		c.deferred = append(c.deferred, r)
+	}
+}
+
+// resolve sets each deferred reference that refers to part of an object that
+// has been converted. If none of them do then the rest get separate copies.
+func (c *converter) resolve() {
+	var rest []reference
+	for _, r := range c.deferred {
+		if !c.referWithin(r) {
+			rest = append(rest, r)
+		}
+	}
+	if len(rest) == len(c.deferred) {
+		for _, r := range rest {
+			c.copyOf(r)
+		}
+		rest = nil
+	}
+	c.deferred = rest
+}
+
+// referWithin sets the reference r to the part of a converted object that the
+// objects it refers to were converted to, if there is one
+func (c *converter) referWithin(r reference) bool {
+	g := c.regions.groupAt(r.off)
+	coverRef, _ := c.regions.flatten(g.cover.ref, g.cover.n)
+	size := int64(c.descs[coverRef.desc][coverRef.id].Size)
+	rel := r.off - g.start
+	for _, b := range c.bases[g] {
+		inner, ok := c.part(coverRef, b.Type().Elem(), rel%size, r.ref, r.dst.Type().Elem(), r.n)
+		if ok {
+			c.set(r, unsafe.Add(unsafe.Pointer(b.Index(int(rel/size)).UnsafeAddr()), inner))
+			return true
+		}
+	}
+	return false
+}
+
+// part gets the offset within an object of type t, which was stored with the
+// type ref, of what the n objects of type want at offset rel in the stored
+// object were converted to, as long as they were converted to the type wantT
+func (c *converter) part(ref typeRef, t reflect.Type, rel int64, want typeRef, wantT reflect.Type, n int64) (uintptr, bool) {
+	if rel == 0 && ref == want && t == wantT && n == 1 {
+		return 0, true
+	}
+	d := c.descs[ref.desc]
+	s := d[ref.id]
+	switch {
+	case s.Kind == reflect.Struct && t.Kind() == reflect.Struct:
+		for _, sf := range s.Fields {
+			if rel < int64(sf.Offset) || rel >= int64(sf.Offset+d[sf.Type].Size) {
+				continue
+			}
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				if fieldName(f) == sf.Name {
+					inner, ok := c.part(typeRef{desc: ref.desc, id: sf.Type}, f.Type, rel-int64(sf.Offset), want, wantT, n)
+					return f.Offset + inner, ok
+				}
+			}
+			return 0, false
+		}
+	case s.Kind == reflect.Array && t.Kind() == reflect.Array && d[s.Elem].Size > 0:
+		elem := typeRef{desc: ref.desc, id: s.Elem}
+		size := int64(d[s.Elem].Size)
+		i := rel / size
+		if i >= int64(t.Len()) {
+			return 0, false
+		}
+		offset := uintptr(i) * t.Elem().Size()
+		if rel%size == 0 && elem == want && t.Elem() == wantT && i+n <= int64(t.Len()) {
+			return offset, true
+		}
+		inner, ok := c.part(elem, t.Elem(), rel%size, want, wantT, n)
+		return offset + inner, ok
+	}
+	return 0, false
+}
+
+// flatten gets the element type and count of n objects that were stored with
+// the type ref and are converted to the type t, looking inside arrays for as
+// long as the stored and converted arrays have the same length
+func (c *converter) flatten(ref typeRef, t reflect.Type, n int64) (typeRef, reflect.Type, int64) {
+	d := c.descs[ref.desc]
+	for {
+		s := d[ref.id]
+		if s.Kind != reflect.Array || d[s.Elem].Size == 0 || t.Kind() != reflect.Array {
+			return ref, t, n
+		}
+		count := int64(s.Size / d[s.Elem].Size)
+		if count != int64(t.Len()) {
+			return ref, t, n
+		}
+		ref.id, t, n = s.Elem, t.Elem(), n*count
+	}
+}
+
+// base gets the slice of type []t that the cover of the group g is converted to
+func (c *converter) base(g *transcodeGroup, t reflect.Type) reflect.Value {
+	for _, b := range c.bases[g] {
+		if b.Type().Elem() == t {
+			return b
+		}
+	}
+	ref, n := c.regions.flatten(g.cover.ref, g.cover.n)
+	b := reflect.MakeSlice(reflect.SliceOf(t), int(n), int(n))
+	c.bases[g] = append(c.bases[g], b)
+	c.queue = append(c.queue, pendingConvert{dst: b, off: g.start, ref: ref, n: n})
+	return b
+}
+
+// set sets the pointer or slice in r to refer to the objects at p
+func (c *converter) set(r reference, p unsafe.Pointer) {
+	t := r.dst.Type()
+	if t.Kind() == reflect.Ptr {
+		r.dst.Set(reflect.NewAt(t.Elem(), p))
+		return
+	}
+	v := reflect.New(t)
+	hdr := unsafe.Pointer(v.Pointer())
+	*(*unsafe.Pointer)(hdr) = p
+	*(*int)(unsafe.Add(hdr, uintptrSize)) = int(r.n)
+	*(*int)(unsafe.Add(hdr, 2*uintptrSize)) = int(r.n)
+	r.dst.Set(v.Elem())
+}
+
+// copyOf sets the pointer or slice in r to refer to a separate copy of the
+// objects that it was stored with
+func (c *converter) copyOf(r reference) {
+	t := r.dst.Type()
+	if t.Kind() == reflect.Ptr {
+		r.dst.Set(c.object(r.off, r.ref, t.Elem()))
+	} else {
+		r.dst.Set(c.slice(r.off, r.ref, t.Elem(), r.n))
+	}
+}
+
+// str gets the string of n bytes at off. Strings in the same group share the
+// same data.
+func (c *converter) str(off, n int64) string {
+	g := c.regions.groupAt(off)
+	if n == 0 || g == nil || g.cover.kind != bytesRegion || off+n > g.end {
+		return string(c.buf[off : off+n])
+	}
+	s, found := c.strings[g]
+	if !found {
+		s = string(c.buf[g.start:g.end])
+		c.strings[g] = s
+	}
+	return s[off-g.start : off-g.start+n]
+}
+
+// object gets a pointer to a new object of type t that the object at off is
+// converted to
+func (c *converter) object(off int64, ref typeRef, t reflect.Type) reflect.Value {
+	key := convertKey{off: off, ref: ref, t: t, n: 1}
+	if v, found := c.objects[key]; found {
+		return v
+	}
+	v := reflect.New(t)
+	c.objects[key] = v
+	c.queue = append(c.queue, pendingConvert{dst: v, off: off, ref: ref, n: 1})
+	return v
+}
+
+// slice gets a new slice of type []t that the n objects at off are converted to
+func (c *converter) slice(off int64, ref typeRef, t reflect.Type, n int64) reflect.Value {
+	// the key holds the slice type so that it differs from that of a pointer
+	// to the first element
+	key := convertKey{off: off, ref: ref, t: reflect.SliceOf(t), n: n}
+	if v, found := c.objects[key]; found {
+		return v
+	}
+	v := reflect.MakeSlice(reflect.SliceOf(t), int(n), int(n))
+	c.objects[key] = v
+	if n > 0 {
+		c.queue = append(c.queue, pendingConvert{dst: v, off: off, ref: ref, n: n})
+	}
+	return v
+}
+
+// convert converts the object at off, which was stored with the type ref, to
+// the type of dst and stores the result in dst
+func (c *converter) convert(dst reflect.Value, off int64, ref typeRef) error {
+	if b := builtins[dst.Type()]; b != nil {
+		// the value is stored as b.layout, and its record is replaced once
+		// it has been converted
+		addr := unsafe.Pointer(dst.UnsafeAddr())
+		c.builtins = append(c.builtins, builtinValue{slot: (*unsafe.Pointer)(unsafe.Add(addr, b.offset)), b: b})
+		dst = reflect.NewAt(b.layout, addr).Elem()
+	}
+
+	desc := c.descs[ref.desc]
+	s := desc[ref.id]
+	t := dst.Type()
+	if s.Kind != t.Kind() {
+		return ErrIncompatibleLayout
+	}
+	if s.Kind != reflect.Struct && s.Kind != reflect.Array && s.Size != t.Size() {
+		return ErrIncompatibleLayout
+	}
+	if !c.inRange(off, 1, s.Size) {
+		return fmt.Errorf("%v at offset %d is outside buffer of length %d", t, off, len(c.buf))
+	}
+	switch s.Kind {
+	case reflect.Struct:
+		return c.convertStruct(dst, off, ref)
+	case reflect.Array:
+		elem := typeRef{desc: ref.desc, id: s.Elem}
+		if desc[s.Elem].Size == 0 {
+			return nil
+		}
+		n := int64(s.Size / desc[s.Elem].Size)
+		if n != int64(t.Len()) {
+			return ErrIncompatibleLayout
+		}
+		return c.convertRange(dst, off, elem, n)
+	case reflect.Ptr, reflect.Slice, reflect.String, reflect.Map, reflect.Interface:
+		if off%int64(uintptrSize) != 0 {
+			return fmt.Errorf("%v at offset %d is misaligned", t, off)
+		}
+	default:
+		// dst contains no pointers, so it can be copied directly
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(dst.UnsafeAddr())), s.Size), c.buf[off:])
+		return nil
+	}
+
+	if s.Kind == reflect.Interface {
+		return c.convertInterface(dst, off)
+	}
+
+	p, ok, err := c.pointer(off)
+	if err != nil {
+		return err
+	}
+	elem := typeRef{desc: ref.desc, id: s.Elem}
+
+	switch s.Kind {
+	case reflect.Ptr:
+		if ok {
+			c.refer(reference{dst: dst, off: p, ref: elem, n: 1})
+		}
+	case reflect.Slice:
+		n, capacity := int64(c.word(off+int64(uintptrSize))), int64(c.word(off+2*int64(uintptrSize)))
+		if n < 0 || capacity < n {
+			return fmt.Errorf("%v at offset %d has invalid length %d and capacity %d", t, off, n, capacity)
+		}
+		if !ok {
+			if n != 0 {
+				return fmt.Errorf("%v at offset %d is nil but has length %d", t, off, n)
+			}
+			return nil
+		}
+		size := desc[s.Elem].Size
+		if !c.inRange(p, n, size) || (size == 0 && t.Elem().Size() > 0 && n > int64(len(c.buf))) {
+			return fmt.Errorf("%v at offset %d refers to %d elements at offset %d, outside buffer of length %d",
+				t, off, n, p, len(c.buf))
+		}
+		c.refer(reference{dst: dst, off: p, ref: elem, n: n})
+	case reflect.String:
+		n := int64(c.word(off + int64(uintptrSize)))
+		if !ok {
+			if n != 0 {
+				return fmt.Errorf("%v at offset %d is nil but has length %d", t, off, n)
+			}
+			return nil
+		}
+		if !c.inRange(p, n, 1) {
+			return fmt.Errorf("%v at offset %d refers to %d bytes at offset %d, outside buffer of length %d",
+				t, off, n, p, len(c.buf))
+		}
+		dst.SetString(c.str(p, n))
+	case reflect.Map:
+		if ok {
+			m, err := c.mapValue(p, ref, t)
+			if err != nil {
+				return err
+			}
+			dst.Set(m)
+		}
+	}
+	return nil
+}
+
+// convertStruct copies each field of the struct at off to the field of dst
+// with the same name
+func (c *converter) convertStruct(dst reflect.Value, off int64, ref typeRef) error {
+	s := c.descs[ref.desc][ref.id]
+	t := dst.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Type.Size() == 0 {
+			continue
+		}
+
+		name := fieldName(f)
+		for _, sf := range s.Fields {
+			if sf.Name != name {
+				continue
+			}
+			// unexported fields are not settable via reflect, so access them directly
+			fv := reflect.NewAt(f.Type, unsafe.Pointer(dst.Field(i).UnsafeAddr())).Elem()
+			err := c.convert(fv, off+int64(sf.Offset), typeRef{desc: ref.desc, id: sf.Type})
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// convertRange converts the n objects at off into the elements of dst, which
+// must be an array or slice
+func (c *converter) convertRange(dst reflect.Value, off int64, ref typeRef, n int64) error {
+	s := c.descs[ref.desc][ref.id]
+	t := dst.Type().Elem()
+	if n > 0 && isScalar(t.Kind()) && s.Kind == t.Kind() && s.Size == t.Size() {
+		// the elements contain no pointers, so copy them all at once
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(dst.Index(0).UnsafeAddr())), uintptr(n)*s.Size), c.buf[off:])
+		return nil
+	}
+	for i := int64(0); i < n; i++ {
+		err := c.convert(dst.Index(int(i)), off+i*int64(s.Size), ref)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapValue builds a map of type t from the entries referred to by the map at
+// off, which was stored with the type ref
+func (c *converter) mapValue(off int64, ref typeRef, t reflect.Type) (reflect.Value, error) {
+	key := convertKey{off: off, ref: ref, t: t}
+	if v, found := c.maps[key]; found {
+		return v, nil
+	}
+
+	// maps are encoded as a pointer to a slice of entries
+	desc := c.descs[ref.desc]
+	s := desc[ref.id]
+	if !c.inRange(off, 3, uintptrSize) || off%int64(uintptrSize) != 0 {
+		return reflect.Value{}, fmt.Errorf("entries of %v at offset %d are outside buffer of length %d", t, off, len(c.buf))
+	}
+	p, ok, err := c.pointer(off)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	n := int64(c.word(off + int64(uintptrSize)))
+	if !ok && n != 0 {
+		return reflect.Value{}, fmt.Errorf("entries of %v at offset %d are nil but have length %d", t, off, n)
+	}
+
+	valueOffset, size := desc.entryLayout(s.Key, s.Elem, uintptrSize)
+	if !c.inRange(p, n, size) || (size == 0 && n > 1) {
+		return reflect.Value{}, fmt.Errorf("%v at offset %d has %d entries at offset %d, outside buffer of length %d",
+			t, off, n, p, len(c.buf))
+	}
+
+	v := reflect.MakeMapWithSize(t, int(n))
+	c.maps[key] = v
+
+	keyRef := typeRef{desc: ref.desc, id: s.Key}
+	elemRef := typeRef{desc: ref.desc, id: s.Elem}
+	for i := int64(0); i < n; i++ {
+		entry := p + i*int64(size)
+		k := reflect.New(t.Key()).Elem()
+		err = c.convert(k, entry, keyRef)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		e := reflect.New(t.Elem()).Elem()
+		err = c.convert(e, entry+int64(valueOffset), elemRef)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		c.assign = append(c.assign, func() { v.SetMapIndex(k, e) })
+	}
+	return v, nil
+}
+
+// convertInterface converts the concrete value held by the interface at off
+func (c *converter) convertInterface(dst reflect.Value, off int64) error {
+	t := dst.Type()
+	data := off + int64(uintptrSize)
+
+	id := c.word(off)
+	if id == 0 {
+		if c.word(data) != 0 || c.isPtr.contains(data) {
+			return fmt.Errorf("%v at offset %d is nil but has a data pointer", t, off)
+		}
+		return nil
+	}
+	if id > uint64(len(c.types)) {
+		return fmt.Errorf("%v at offset %d has invalid type ID %d", t, off, id)
+	}
+
+	concrete := c.types[id-1]
+	if concrete.typ == nil {
+		return concrete.err
+	}
+	if !concrete.typ.Implements(t) {
+		return fmt.Errorf("%v at offset %d holds %v, which does not implement it", t, off, concrete.typ)
+	}
+
+	p, ok, err := c.pointer(data)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%v at offset %d has a data pointer that is missing from the pointer table", t, off)
+	}
+
+	v := reflect.New(concrete.typ).Elem()
+	err = c.convert(v, p, typeRef{desc: int(id), id: 0})
+	if err != nil {
+		return err
+	}
+	c.assign = append(c.assign, func() { dst.Set(v) })
+	return nil
+}
+
+// isScalar determines whether values of the given kind are stored inline
+// and contain no pointers
+func isScalar(k reflect.Kind) bool {
+	return k >= reflect.Bool && k <= reflect.Complex128
+}
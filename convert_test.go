@@ -0,0 +1,308 @@
+package memdump
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordV1 struct {
+	ID    int
+	Name  string
+	Score float32
+}
+
+type recordV2 struct {
+	Tags  []string
+	Name  string
+	ID    int
+	Extra *int
+}
+
+func TestConvert_Single(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &recordV1{ID: 3, Name: "abc", Score: 1.5}))
+
+	var dest *recordV2
+	err := DecodeWithPolicy(bytes.NewReader(b.Bytes()), &dest, MatchFieldsByName)
+	require.NoError(t, err)
+	assert.Equal(t, recordV2{ID: 3, Name: "abc"}, *dest)
+
+	// the default is strict
+	err = Decode(bytes.NewReader(b.Bytes()), &dest)
+	assert.Equal(t, ErrIncompatibleLayout, err)
+}
+
+func TestConvert_Homogeneous(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	require.NoError(t, enc.Encode(&recordV1{ID: 1, Name: "x"}))
+	require.NoError(t, enc.Encode(&recordV1{ID: 2, Name: "y"}))
+
+	dec := NewDecoder(&b)
+	dec.SetLayoutPolicy(MatchFieldsByName)
+	var dest recordV2
+	require.NoError(t, dec.Decode(&dest))
+	assert.Equal(t, recordV2{ID: 1, Name: "x"}, dest)
+	require.NoError(t, dec.Decode(&dest))
+	assert.Equal(t, recordV2{ID: 2, Name: "y"}, dest)
+	assert.Equal(t, io.EOF, dec.Decode(&dest))
+}
+
+func TestConvert_Heterogeneous(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewHeterogeneousEncoder(&b)
+	require.NoError(t, enc.Encode(&recordV1{ID: 1, Name: "x"}))
+
+	dec := NewHeterogeneousDecoder(bytes.NewReader(b.Bytes()))
+	var dest recordV2
+	assert.Equal(t, ErrIncompatibleLayout, dec.Decode(&dest))
+
+	dec = NewHeterogeneousDecoder(bytes.NewReader(b.Bytes()))
+	dec.SetLayoutPolicy(MatchFieldsByName)
+	require.NoError(t, dec.Decode(&dest))
+	assert.Equal(t, recordV2{ID: 1, Name: "x"}, dest)
+}
+
+func TestConvert_Tags(t *testing.T) {
+	type U struct {
+		Name string
+	}
+	type V struct {
+		Title string `memdump:"Name"`
+	}
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &U{"abc"}))
+
+	var dest *V
+	require.NoError(t, DecodeWithPolicy(&b, &dest, MatchFieldsByName))
+	assert.Equal(t, "abc", dest.Title)
+}
+
+func TestConvert_ChangedKind(t *testing.T) {
+	type U struct {
+		X int
+	}
+	type V struct {
+		X string
+	}
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &U{3}))
+
+	var dest *V
+	assert.Equal(t, ErrIncompatibleLayout, DecodeWithPolicy(&b, &dest, MatchFieldsByName))
+}
+
+func TestConvert_ChangedSize(t *testing.T) {
+	type U struct {
+		X int32
+	}
+	type V struct {
+		X int64
+	}
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &U{3}))
+
+	var dest *V
+	assert.Equal(t, ErrIncompatibleLayout, DecodeWithPolicy(&b, &dest, MatchFieldsByName))
+}
+
+type treeV1 struct {
+	Label    string
+	Children []*treeV1
+	Parent   *treeV1
+	Attrs    map[string]recordV1
+	Sizes    [3]uint16
+}
+
+type treeV2 struct {
+	Depth    int
+	Sizes    [3]uint16
+	Attrs    map[string]recordV2
+	Parent   *treeV2
+	Children []*treeV2
+	Label    string
+}
+
+func TestConvert_Nested(t *testing.T) {
+	root := treeV1{Label: "root", Sizes: [3]uint16{1, 2, 3}}
+	child := treeV1{
+		Label:  "child",
+		Parent: &root,
+		Attrs:  map[string]recordV1{"a": {ID: 1, Name: "x"}, "b": {ID: 2}},
+	}
+	root.Children = []*treeV1{&child, &child}
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &root))
+
+	var dest *treeV2
+	require.NoError(t, DecodeWithPolicy(&b, &dest, MatchFieldsByName))
+
+	assert.Equal(t, "root", dest.Label)
+	assert.Equal(t, [3]uint16{1, 2, 3}, dest.Sizes)
+	require.Len(t, dest.Children, 2)
+	assert.Same(t, dest.Children[0], dest.Children[1])
+	assert.Equal(t, "root", dest.Children[0].Parent.Label)
+	assert.Equal(t, "child", dest.Children[0].Label)
+	assert.Equal(t, map[string]recordV2{"a": {ID: 1, Name: "x"}, "b": {ID: 2}}, dest.Children[0].Attrs)
+}
+
+func TestConvert_Interface(t *testing.T) {
+	type U struct {
+		S shape
+		X int
+	}
+	type V struct {
+		S shape
+	}
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &U{S: &polygon{Name: "p", Points: [][2]float64{{1, 2}}}}))
+
+	var dest *V
+	require.NoError(t, DecodeWithPolicy(&b, &dest, MatchFieldsByName))
+	require.IsType(t, &polygon{}, dest.S)
+	assert.Equal(t, "p", dest.S.(*polygon).Name)
+	assert.Equal(t, [][2]float64{{1, 2}}, dest.S.(*polygon).Points)
+}
+
+func TestConvert_PointerToSliceElement(t *testing.T) {
+	type U struct {
+		Xs    []int
+		First *int
+		Y     int
+	}
+	type V struct {
+		First *int
+		Xs    []int
+	}
+	xs := []int{5}
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &U{Xs: xs, First: &xs[0]}))
+
+	var dest *V
+	require.NoError(t, DecodeWithPolicy(&b, &dest, MatchFieldsByName))
+	assert.Equal(t, []int{5}, dest.Xs)
+	assert.Equal(t, 5, *dest.First)
+}
+
+func TestConvert_Aliasing(t *testing.T) {
+	type aliasingV2 struct {
+		M     map[string]int
+		T, S  string
+		P     *int
+		B, A  []int
+		All   []int
+		Self  *aliasingV2
+		Extra int
+	}
+	src := newAliasing()
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, src))
+
+	var dest *aliasingV2
+	require.NoError(t, DecodeWithPolicy(&b, &dest, MatchFieldsByName))
+	assert.Equal(t, src.All, dest.All)
+	assert.Equal(t, src.A, dest.A)
+	assert.Equal(t, src.B, dest.B)
+	assert.Equal(t, src.T, dest.T)
+	assert.Equal(t, stringData(dest.S)+6, stringData(dest.T))
+	assert.Same(t, dest, dest.Self)
+
+	dest.All[3] = 40
+	assert.Equal(t, 40, *dest.P)
+	assert.Equal(t, 40, dest.B[1])
+	dest.A[1] = 30
+	assert.Equal(t, 30, dest.B[0])
+}
+
+func TestConvert_AliasingWithinStruct(t *testing.T) {
+	type U struct {
+		Arr [4]int
+		Sub []int
+		Ptr *int
+	}
+	type V struct {
+		Ptr  *int
+		Sub  []int
+		Name string
+		Arr  [4]int
+	}
+	src := U{Arr: [4]int{1, 2, 3, 4}}
+	src.Sub = src.Arr[1:3]
+	src.Ptr = &src.Arr[1]
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &src))
+
+	var dest *V
+	require.NoError(t, DecodeWithPolicy(&b, &dest, MatchFieldsByName))
+	assert.Equal(t, [4]int{1, 2, 3, 4}, dest.Arr)
+	assert.Equal(t, []int{2, 3}, dest.Sub)
+	assert.Same(t, &dest.Arr[1], dest.Ptr)
+	assert.Same(t, &dest.Arr[1], &dest.Sub[0])
+}
+
+func TestConvert_SameLayout(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &recordV1{ID: 3, Name: "abc"}))
+
+	var dest *recordV1
+	require.NoError(t, DecodeWithPolicy(&b, &dest, MatchFieldsByName))
+	assert.Equal(t, recordV1{ID: 3, Name: "abc"}, *dest)
+}
+
+func TestConvert_PointerOutOfBounds(t *testing.T) {
+	src := validateNode{Next: &validateNode{}}
+	buf, ptrs := encodeForTest(t, &src)
+	putWord(buf, nodeNext, uint64(len(buf)))
+
+	type V struct {
+		Next *V
+	}
+	l := layout{desc: mustDescribe(t, reflect.TypeOf(src)), convert: true}
+	_, err := l.decode(buf, ptrs, 0, reflect.TypeOf(V{}))
+	assert.Error(t, err)
+}
+
+func TestConvert_StringTooLong(t *testing.T) {
+	src := validateNode{S: "abc"}
+	buf, ptrs := encodeForTest(t, &src)
+	putWord(buf, nodeSLen, 1000)
+
+	type V struct {
+		S string
+	}
+	l := layout{desc: mustDescribe(t, reflect.TypeOf(src)), convert: true}
+	_, err := l.decode(buf, ptrs, 0, reflect.TypeOf(V{}))
+	assert.Error(t, err)
+}
+
+func TestConvert_InvalidDescriptor(t *testing.T) {
+	desc := descriptor{{Kind: reflect.Struct, Size: 8, Fields: []field{{Name: "X", Type: 0}}}}
+	_, err := newLayout(MatchFieldsByName, reflect.TypeOf(recordV1{}), desc, nil)
+	assert.Error(t, err)
+}
+
+func TestConvert_ZeroSizeArrayElement(t *testing.T) {
+	// an array of 2 words whose elements have size 0 but contain a pointer
+	w := uintptrSize
+	desc := descriptor{
+		{Kind: reflect.Struct, Size: 2 * w, Fields: []field{{Name: "A", Type: 1}}},
+		{Kind: reflect.Array, Size: 2 * w, Elem: 2},
+		{Kind: reflect.Struct, Size: 0, Fields: []field{{Name: "P", Type: 3}}},
+		{Kind: reflect.Ptr, Size: w, Elem: 4},
+		{Kind: reflect.Int, Size: w},
+	}
+	_, err := newLayout(MatchFieldsByName, reflect.TypeOf(recordV1{}), desc, nil)
+	assert.Error(t, err)
+}
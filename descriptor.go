@@ -20,7 +20,8 @@ type descriptor []typ
 type typ struct {
 	Kind   reflect.Kind // Kind is the kind of this type
 	Size   uintptr      // Size is the size in bits, as per reflect.Value.Size
-	Elem   int          // Elem is index of the underlying type for pointers, slices, and arrays
+	Elem   int          // Elem is index of the underlying type for pointers, slices, arrays, and maps
+	Key    int          // Key is the index of the key type for maps
 	Fields []field      // Fields contains the fields for structs
 }
 
@@ -45,6 +46,9 @@ func descriptorsEqual(a, b descriptor) bool {
 		if a[i].Elem != b[i].Elem {
 			return false
 		}
+		if a[i].Key != b[i].Key {
+			return false
+		}
 		if len(a[i].Fields) != len(b[i].Fields) {
 			return false
 		}
@@ -63,14 +67,19 @@ func descriptorsEqual(a, b descriptor) bool {
 	return true
 }
 
-// describe computes the descriptor for a type
-func describe(t reflect.Type) descriptor {
+// describe computes the descriptor for a type. It returns an
+// UnsupportedTypeError if t refers to a type that cannot be stored.
+func describe(t reflect.Type) (descriptor, error) {
 	var nextID int
 	var desc descriptor
 	var queue []reflect.Type
+	var paths []string
 	seen := make(map[reflect.Type]int)
 
-	push := func(t reflect.Type) int {
+	push := func(t reflect.Type, path string) int {
+		if b := builtins[t]; b != nil {
+			t = b.layout
+		}
 		if id, found := seen[t]; found {
 			return id
 		}
@@ -78,23 +87,29 @@ func describe(t reflect.Type) descriptor {
 		seen[t] = id
 		nextID++
 		queue = append(queue, t)
+		paths = append(paths, path)
 		return id
 	}
 
-	push(t)
+	push(t, "")
 	for len(queue) > 0 {
-		cur := queue[0]
-		queue = queue[1:]
+		cur, path := queue[0], paths[0]
+		queue, paths = queue[1:], paths[1:]
 		t := typ{
 			Size: cur.Size(),
 			Kind: cur.Kind(),
 		}
 
 		switch cur.Kind() {
-		case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map:
-			panic(fmt.Sprintf("cannot compute descriptor for %v", cur.Kind()))
-		case reflect.Array, reflect.Slice, reflect.Ptr:
-			t.Elem = push(cur.Elem())
+		case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+			return nil, &UnsupportedTypeError{Type: cur, Path: path}
+		case reflect.Ptr:
+			t.Elem = push(cur.Elem(), path)
+		case reflect.Array, reflect.Slice:
+			t.Elem = push(cur.Elem(), path+"[]")
+		case reflect.Map:
+			t.Key = push(cur.Key(), path+"[key]")
+			t.Elem = push(cur.Elem(), path+"[]")
 		case reflect.Struct:
 			for i := 0; i < cur.NumField(); i++ {
 				f := cur.Field(i)
@@ -102,19 +117,243 @@ func describe(t reflect.Type) descriptor {
 					continue
 				}
 
-				name := f.Name
-				if tag := f.Tag.Get("memdump"); tag != "" {
-					name = tag
-				}
 				t.Fields = append(t.Fields, field{
-					Name:   name,
+					Name:   fieldName(f),
 					Offset: f.Offset,
-					Type:   push(f.Type),
+					Type:   push(f.Type, fieldPath(path, f.Name)),
 				})
 			}
 		}
 
 		desc = append(desc, t)
 	}
-	return desc
+	return desc, nil
+}
+
+// fieldPath gets the path of a struct field for use in errors
+func fieldPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// fieldName gets the name under which a struct field is stored, which is its
+// memdump tag if present
+func fieldName(f reflect.StructField) string {
+	if tag := f.Tag.Get("memdump"); tag != "" {
+		return tag
+	}
+	return f.Name
+}
+
+// check verifies that each type index in the descriptor is in range and that
+// no struct or array contains itself, so that a descriptor read from the
+// stream can be traversed safely.
+func (d descriptor) check() error {
+	if len(d) == 0 {
+		return fmt.Errorf("descriptor is empty")
+	}
+	inRange := func(id int) bool { return id >= 0 && id < len(d) }
+	for i, t := range d {
+		if !inRange(t.Elem) || !inRange(t.Key) {
+			return fmt.Errorf("type %d in descriptor refers to a type that is out of range", i)
+		}
+		for _, f := range t.Fields {
+			if !inRange(f.Type) {
+				return fmt.Errorf("field %q in descriptor refers to a type that is out of range", f.Name)
+			}
+		}
+	}
+
+	// look for cycles among the types that are stored inline
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(d))
+	var visit func(id int) error
+	visit = func(id int) error {
+		switch state[id] {
+		case visiting:
+			return fmt.Errorf("type %d in descriptor contains itself", id)
+		case done:
+			return nil
+		}
+		state[id] = visiting
+		switch d[id].Kind {
+		case reflect.Array:
+			if err := visit(d[id].Elem); err != nil {
+				return err
+			}
+		case reflect.Struct:
+			for _, f := range d[id].Fields {
+				if err := visit(f.Type); err != nil {
+					return err
+				}
+			}
+		}
+		state[id] = done
+		return nil
+	}
+	for i := range d {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSizes verifies that the size of each type with a fixed size matches
+// its kind on a machine with the given word size, that each array is a whole
+// number of its elements, and that each struct field lies within its struct.
+// The descriptor must have been checked.
+func (d descriptor) checkSizes(word uintptr) error {
+	for i, t := range d {
+		var want uintptr
+		switch t.Kind {
+		case reflect.Array:
+			elem := d[t.Elem].Size
+			if (elem == 0 && t.Size != 0) || (elem != 0 && t.Size%elem != 0) {
+				return fmt.Errorf("type %d in descriptor is an array of size %d with elements of size %d", i, t.Size, elem)
+			}
+			continue
+		case reflect.Struct:
+			for _, f := range t.Fields {
+				if f.Offset > t.Size || d[f.Type].Size > t.Size-f.Offset {
+					return fmt.Errorf("field %q in descriptor lies outside its struct of size %d", f.Name, t.Size)
+				}
+			}
+			continue
+		case reflect.Bool, reflect.Int8, reflect.Uint8:
+			want = 1
+		case reflect.Int16, reflect.Uint16:
+			want = 2
+		case reflect.Int32, reflect.Uint32, reflect.Float32:
+			want = 4
+		case reflect.Int64, reflect.Uint64, reflect.Float64, reflect.Complex64:
+			want = 8
+		case reflect.Complex128:
+			want = 16
+		case reflect.Int, reflect.Uint, reflect.Uintptr, reflect.Ptr, reflect.Map, reflect.UnsafePointer:
+			want = word
+		case reflect.String, reflect.Interface:
+			want = 2 * word
+		case reflect.Slice:
+			want = 3 * word
+		default:
+			continue
+		}
+		if t.Size != want {
+			return fmt.Errorf("type %d in descriptor is a %v of size %d, expected %d", i, t.Kind, t.Size, want)
+		}
+	}
+	return nil
+}
+
+// align computes the alignment of the type at index id on a machine with the
+// given word size. The descriptor must have been checked.
+func (d descriptor) align(id int, word uintptr) uintptr {
+	t := d[id]
+	switch t.Kind {
+	case reflect.Array:
+		return d.align(t.Elem, word)
+	case reflect.Struct:
+		var a uintptr = 1
+		for _, f := range t.Fields {
+			if fa := d.align(f.Type, word); fa > a {
+				a = fa
+			}
+		}
+		return a
+	case reflect.Complex64, reflect.Complex128:
+		return scalarAlign(t.Size/2, word)
+	default:
+		return scalarAlign(t.Size, word)
+	}
+}
+
+// scalarAlign gets the alignment of a scalar of the given size on a machine
+// with the given word size
+func scalarAlign(size, word uintptr) uintptr {
+	switch {
+	case size == 0:
+		return 1
+	case size > word:
+		return word
+	default:
+		return size
+	}
+}
+
+// entryLayout computes the offset of the value and the overall size of the
+// entries that maps with the given key and element types are encoded as,
+// following the same rules as reflect.StructOf
+func (d descriptor) entryLayout(key, elem int, word uintptr) (valueOffset, size uintptr) {
+	keyAlign, elemAlign := d.align(key, word), d.align(elem, word)
+	valueOffset = roundUp(d[key].Size, elemAlign)
+	size = valueOffset + d[elem].Size
+	if d[elem].Size == 0 && size > 0 {
+		// a trailing zero-size field is padded so that its address does
+		// not point past the end of the struct
+		size++
+	}
+	if elemAlign > keyAlign {
+		keyAlign = elemAlign
+	}
+	return valueOffset, roundUp(size, keyAlign)
+}
+
+// roundUp rounds x up to a multiple of align
+func roundUp(x, align uintptr) uintptr {
+	return (x + align - 1) / align * align
+}
+
+// relayout computes the descriptor that the same types would have on a machine
+// with the given architecture, laying out struct fields in the same order. The
+// descriptor must have been checked.
+func (d descriptor) relayout(a arch) descriptor {
+	out := make(descriptor, len(d))
+	done := make([]bool, len(d))
+	var visit func(id int)
+	visit = func(id int) {
+		if done[id] {
+			return
+		}
+		t := d[id]
+		t.Fields = nil
+		switch t.Kind {
+		case reflect.Int, reflect.Uint, reflect.Uintptr, reflect.Ptr, reflect.Map, reflect.UnsafePointer:
+			t.Size = a.WordSize
+		case reflect.String, reflect.Interface:
+			t.Size = 2 * a.WordSize
+		case reflect.Slice:
+			t.Size = 3 * a.WordSize
+		case reflect.Array:
+			visit(t.Elem)
+			if d[t.Elem].Size > 0 {
+				t.Size = d[id].Size / d[t.Elem].Size * out[t.Elem].Size
+			}
+		case reflect.Struct:
+			var off, align uintptr = 0, 1
+			for _, f := range d[id].Fields {
+				visit(f.Type)
+				fa := out.align(f.Type, a.WordSize)
+				if fa > align {
+					align = fa
+				}
+				off = roundUp(off, fa)
+				t.Fields = append(t.Fields, field{Name: f.Name, Offset: off, Type: f.Type})
+				off += out[f.Type].Size
+			}
+			t.Size = roundUp(off, align)
+		}
+		out[id] = t
+		done[id] = true
+	}
+	for i := range d {
+		visit(i)
+	}
+	return out
 }
@@ -5,11 +5,19 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// mustDescribe computes the descriptor for a type that is known to be supported
+func mustDescribe(t *testing.T, typ reflect.Type) descriptor {
+	d, err := describe(typ)
+	require.NoError(t, err)
+	return d
+}
+
 func assertCompareDescriptors(t *testing.T, a interface{}, b interface{}, expected bool) {
-	da := describe(reflect.TypeOf(a))
-	db := describe(reflect.TypeOf(b))
+	da := mustDescribe(t, reflect.TypeOf(a))
+	db := mustDescribe(t, reflect.TypeOf(b))
 	assert.Equal(t, expected, descriptorsEqual(da, db))
 }
 
@@ -163,11 +171,70 @@ func TestDescriptorsEqual_DifferentNumFields(t *testing.T) {
 	assertCompareDescriptors(t, v{}, w{}, true)
 }
 
-func TestDescribe_PanicsOnMap(t *testing.T) {
+func TestDescribeMap(t *testing.T) {
+	var x map[string]int
+	var y map[string]int64
+	var z map[int]int
+
+	assertCompareDescriptors(t, x, x, true)
+	assertCompareDescriptors(t, &x, &x, true)
+	assertCompareDescriptors(t, z, z, true)
+
+	assertCompareDescriptors(t, x, y, false)
+	assertCompareDescriptors(t, x, z, false)
+	assertCompareDescriptors(t, &x, x, false)
+	assertCompareDescriptors(t, x, []int{}, false)
+}
+
+func TestDescribe_Unsupported(t *testing.T) {
 	type T struct {
-		A map[string]int
+		A []struct {
+			B map[string]func()
+		}
+	}
+	_, err := describe(reflect.TypeOf(T{}))
+	require.Error(t, err)
+	unsupported, ok := err.(*UnsupportedTypeError)
+	require.True(t, ok)
+	assert.Equal(t, reflect.TypeOf(func() {}), unsupported.Type)
+	assert.Equal(t, "A[].B[]", unsupported.Path)
+	assert.Equal(t, "memdump: unsupported type func() at A[].B[]", err.Error())
+
+	_, err = describe(reflect.TypeOf(make(chan int)))
+	assert.EqualError(t, err, "memdump: unsupported type chan int")
+}
+
+func TestEntryLayout(t *testing.T) {
+	cases := []reflect.Type{
+		reflect.TypeOf(map[string]int{}),
+		reflect.TypeOf(map[int8]complex64{}),
+		reflect.TypeOf(map[string]struct{}{}),
+		reflect.TypeOf(map[struct{}]struct{}{}),
+		reflect.TypeOf(map[int16][3]byte{}),
+		reflect.TypeOf(map[[3]byte]struct {
+			A byte
+			B int32
+		}{}),
+	}
+	for _, mt := range cases {
+		d := mustDescribe(t, mt)
+		entry := mapEntryType(mt)
+		valueOffset, size := d.entryLayout(d[0].Key, d[0].Elem, uintptrSize)
+		assert.Equal(t, entry.Field(1).Offset, valueOffset, "%v", mt)
+		assert.Equal(t, entry.Size(), size, "%v", mt)
 	}
-	assert.Panics(t, func() {
-		describe(reflect.TypeOf(T{}))
-	})
+}
+
+func TestDescriptorCheck(t *testing.T) {
+	type T struct {
+		A []T
+		B map[string]*T
+	}
+	assert.NoError(t, mustDescribe(t, reflect.TypeOf(T{})).check())
+
+	cyclic := descriptor{{Kind: reflect.Array, Size: 8, Elem: 0}}
+	assert.Error(t, cyclic.check())
+
+	outOfRange := descriptor{{Kind: reflect.Ptr, Size: 8, Elem: 3}}
+	assert.Error(t, outOfRange.check())
 }
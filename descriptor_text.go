@@ -0,0 +1,194 @@
+package memdump
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Descriptor describes the memory layout of a type, which decoders compare
+// against the layout stored with the data. Types with equal descriptors have
+// identical layouts.
+type Descriptor struct {
+	d descriptor
+}
+
+// Describe computes the descriptor for a type. It returns an
+// UnsupportedTypeError if t refers to a type that cannot be stored.
+func Describe(t reflect.Type) (Descriptor, error) {
+	if t == nil {
+		return Descriptor{}, &InvalidArgumentError{Expected: "a type"}
+	}
+	d, err := describe(t)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	return Descriptor{d: d}, nil
+}
+
+// Equal reports whether two descriptors describe the same layout
+func (d Descriptor) Equal(other Descriptor) bool {
+	return descriptorsEqual(d.d, other.d)
+}
+
+// String renders the descriptor with one line for each type, numbered from
+// zero, followed by an indented line for each struct field. The text does not
+// depend on the version of Go, and can be read back with ParseDescriptor.
+func (d Descriptor) String() string {
+	var b strings.Builder
+	for i, t := range d.d {
+		fmt.Fprintf(&b, "%d %s size=%d", i, t.Kind, t.Size)
+		if hasElem(t.Kind) || t.Elem != 0 {
+			fmt.Fprintf(&b, " elem=%d", t.Elem)
+		}
+		if t.Kind == reflect.Map || t.Key != 0 {
+			fmt.Fprintf(&b, " key=%d", t.Key)
+		}
+		b.WriteByte('\n')
+		for _, f := range t.Fields {
+			fmt.Fprintf(&b, "\t%s offset=%d type=%d\n", strconv.Quote(f.Name), f.Offset, f.Type)
+		}
+	}
+	return b.String()
+}
+
+// Fingerprint returns the SHA-256 hash of the text form of the descriptor, in
+// hexadecimal
+func (d Descriptor) Fingerprint() string {
+	sum := sha256.Sum256([]byte(d.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseDescriptor reads a descriptor in the form written by Descriptor.String
+func ParseDescriptor(s string) (Descriptor, error) {
+	var d descriptor
+	for i, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		var err error
+		if strings.HasPrefix(line, "\t") {
+			if len(d) == 0 {
+				return Descriptor{}, fmt.Errorf("line %d: field before the first type", i+1)
+			}
+			var f field
+			f, err = parseField(line[1:])
+			d[len(d)-1].Fields = append(d[len(d)-1].Fields, f)
+		} else {
+			var t typ
+			t, err = parseType(line, len(d))
+			d = append(d, t)
+		}
+		if err != nil {
+			return Descriptor{}, fmt.Errorf("line %d: %v", i+1, err)
+		}
+	}
+	err := d.check()
+	if err != nil {
+		return Descriptor{}, err
+	}
+	return Descriptor{d: d}, nil
+}
+
+// kindsByName maps the name of each kind, as written by Descriptor.String, to
+// the kind
+var kindsByName = func() map[string]reflect.Kind {
+	m := make(map[string]reflect.Kind)
+	for k := reflect.Bool; k <= reflect.UnsafePointer; k++ {
+		m[k.String()] = k
+	}
+	return m
+}()
+
+// hasElem reports whether types of the given kind refer to an element type
+func hasElem(k reflect.Kind) bool {
+	switch k {
+	case reflect.Ptr, reflect.Array, reflect.Slice, reflect.Map:
+		return true
+	}
+	return false
+}
+
+// parseType parses a line such as "3 ptr size=8 elem=4" describing type id
+func parseType(line string, id int) (typ, error) {
+	var t typ
+	words := strings.Fields(line)
+	if len(words) < 3 {
+		return t, fmt.Errorf("expected a type but got %q", line)
+	}
+	if words[0] != strconv.Itoa(id) {
+		return t, fmt.Errorf("expected type %d but got %q", id, words[0])
+	}
+	kind, ok := kindsByName[words[1]]
+	if !ok {
+		return t, fmt.Errorf("unknown kind %q", words[1])
+	}
+	t.Kind = kind
+	size, err := parseAttr(words[2], "size")
+	if err != nil {
+		return t, err
+	}
+	t.Size = uintptr(size)
+	for _, word := range words[3:] {
+		switch {
+		case strings.HasPrefix(word, "elem="):
+			t.Elem, err = parseIndex(word, "elem")
+		case strings.HasPrefix(word, "key="):
+			t.Key, err = parseIndex(word, "key")
+		default:
+			err = fmt.Errorf("unexpected %q", word)
+		}
+		if err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+// parseField parses a line such as `"Name" offset=8 type=2`, without the
+// leading tab
+func parseField(line string) (field, error) {
+	var f field
+	quoted, err := strconv.QuotedPrefix(line)
+	if err != nil {
+		return f, fmt.Errorf("expected a quoted field name in %q", line)
+	}
+	f.Name, _ = strconv.Unquote(quoted)
+	words := strings.Fields(line[len(quoted):])
+	if len(words) != 2 {
+		return f, fmt.Errorf("expected an offset and a type after the field name")
+	}
+	offset, err := parseAttr(words[0], "offset")
+	if err != nil {
+		return f, err
+	}
+	f.Offset = uintptr(offset)
+	f.Type, err = parseIndex(words[1], "type")
+	return f, err
+}
+
+// parseAttr parses a word of the form name=value, where value is an unsigned
+// integer that fits in a uintptr
+func parseAttr(word, name string) (uint64, error) {
+	if !strings.HasPrefix(word, name+"=") {
+		return 0, fmt.Errorf("expected %s= but got %q", name, word)
+	}
+	v, err := strconv.ParseUint(word[len(name)+1:], 10, strconv.IntSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return v, nil
+}
+
+// parseIndex parses a word of the form name=value, where value is the index of
+// a type in the descriptor
+func parseIndex(word, name string) (int, error) {
+	v, err := parseAttr(word, name)
+	if err != nil {
+		return 0, err
+	}
+	if v > uint64(maxInt) {
+		return 0, fmt.Errorf("%s %d is out of range", name, v)
+	}
+	return int(v), nil
+}
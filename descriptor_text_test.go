@@ -0,0 +1,85 @@
+package memdump
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type describedRecord struct {
+	ID     int64
+	Name   string `memdump:"full name"`
+	Next   *describedRecord
+	Scores map[string][2]float32
+}
+
+func TestDescriptor_String(t *testing.T) {
+	d, err := Describe(reflect.TypeOf(describedRecord{}))
+	require.NoError(t, err)
+
+	expected := `0 struct size=40
+	"ID" offset=0 type=1
+	"full name" offset=8 type=2
+	"Next" offset=24 type=3
+	"Scores" offset=32 type=4
+1 int64 size=8
+2 string size=16
+3 ptr size=8 elem=0
+4 map size=8 elem=5 key=2
+5 array size=8 elem=6
+6 float32 size=4
+`
+	if reflect.TypeOf(0).Size() == 8 {
+		assert.Equal(t, expected, d.String())
+	}
+
+	parsed, err := ParseDescriptor(d.String())
+	require.NoError(t, err)
+	assert.True(t, d.Equal(parsed))
+	assert.Equal(t, d.String(), parsed.String())
+	assert.Equal(t, d.Fingerprint(), parsed.Fingerprint())
+	assert.Len(t, d.Fingerprint(), 64)
+}
+
+func TestDescriptor_Equal(t *testing.T) {
+	a, err := Describe(reflect.TypeOf(recordV1{}))
+	require.NoError(t, err)
+	b, err := Describe(reflect.TypeOf(recordV1{}))
+	require.NoError(t, err)
+	c, err := Describe(reflect.TypeOf(recordV2{}))
+	require.NoError(t, err)
+
+	assert.True(t, a.Equal(b))
+	assert.Equal(t, a.Fingerprint(), b.Fingerprint())
+	assert.False(t, a.Equal(c))
+	assert.NotEqual(t, a.Fingerprint(), c.Fingerprint())
+}
+
+func TestDescribe_Errors(t *testing.T) {
+	_, err := Describe(reflect.TypeOf(struct{ F func() }{}))
+	assert.IsType(t, &UnsupportedTypeError{}, err)
+
+	_, err = Describe(nil)
+	assert.IsType(t, &InvalidArgumentError{}, err)
+}
+
+func TestParseDescriptor_Invalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"\t\"X\" offset=0 type=0\n",
+		"1 int size=8\n",
+		"0 widget size=8\n",
+		"0 int\n",
+		"0 int size=-1\n",
+		"0 int size=8 color=3\n",
+		"0 ptr size=8 elem=1\n",
+		"0 struct size=8\n\tX offset=0 type=1\n1 int size=8\n",
+		"0 struct size=8\n\t\"X\" offset=0\n",
+		"0 struct size=8\n\t\"X\" offset=0 type=0\n",
+	} {
+		_, err := ParseDescriptor(s)
+		assert.Error(t, err, "%q", s)
+	}
+}
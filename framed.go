@@ -0,0 +1,321 @@
+package memdump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// magic begins every stream written with protocol 3 or later. Its first byte
+// can never begin a gob stream or the protocol number of a heterogeneous
+// stream, so streams written with earlier protocols can be recognized.
+var magic = []byte{0x89, 'm', 'e', 'm', 'd', 'u', 'm', 'p'}
+
+// segmentAlign is the alignment, relative to the beginning of the stream,
+// of the data in each length-prefixed segment
+const segmentAlign = 8
+
+// endOfSegments is written in place of a segment length to mark the end of
+// the segments in a stream that has a trailer
+const endOfSegments = ^uint64(0)
+
+// crcTable is used for the checksums in streams written with checksumFlag
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// maxEagerSegment is the largest segment for which the full length is
+// allocated before reading, so that a corrupt length cannot force a huge
+// allocation
+const maxEagerSegment = 1 << 26
+
+// segmentReader reads the segments of a stream
+type segmentReader interface {
+	// Next returns the next segment, or (nil, io.EOF) if there are no more segments.
+	Next() ([]byte, error)
+}
+
+// writePreamble writes the magic number and protocol number
+func writePreamble(w io.Writer, protocol int32) error {
+	_, err := w.Write(magic)
+	if err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, protocol)
+}
+
+// readPreamble reads the magic number and protocol number. Streams written
+// with protocols 1 and 2 have no magic number, in which case readPreamble
+// returns zero and consumes nothing. The error is io.EOF only if the stream is
+// empty, and io.ErrUnexpectedEOF if it ends within the preamble.
+func readPreamble(r *bufio.Reader) (int32, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	if first[0] != magic[0] {
+		return 0, nil
+	}
+
+	buf := make([]byte, len(magic))
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(buf, magic) {
+		return 0, fmt.Errorf("invalid magic number %x", buf)
+	}
+
+	var protocol int32
+	err = binary.Read(r, binary.LittleEndian, &protocol)
+	if err != nil {
+		return 0, truncated(err)
+	}
+	return protocol, nil
+}
+
+// preambleSize is the number of bytes written by writePreamble
+const preambleSize = 12
+
+// splitProtocol separates checksumFlag and compressionFlag from a protocol
+// number
+func splitProtocol(protocol int32) (base int32, checksums, compressed bool) {
+	base = protocol &^ (checksumFlag | compressionFlag)
+	return base, protocol&checksumFlag != 0, protocol&compressionFlag != 0
+}
+
+// segmentError describes an error reading a segment of record i. The error is
+// wrapped so that the caller can test for ErrCorrupt or io.ErrUnexpectedEOF.
+func segmentError(what string, i int, err error) error {
+	err = truncated(err)
+	if err == ErrCorrupt {
+		return fmt.Errorf("error reading %s of record %d: %w", what, i, err)
+	}
+	return fmt.Errorf("error reading %s: %w", what, err)
+}
+
+// truncated converts io.EOF to io.ErrUnexpectedEOF, for segments that must be
+// present, so that a stream cut short is not mistaken for the end of a stream
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// framedWriter writes length-prefixed segments
+type framedWriter struct {
+	w         io.Writer
+	offset    int64
+	checksums bool // checksums is set if each segment is followed by its checksum
+}
+
+func newFramedWriter(w io.Writer, offset int64) *framedWriter {
+	return &framedWriter{
+		w:      w,
+		offset: offset,
+	}
+}
+
+func (w *framedWriter) Write(buf []byte) (int, error) {
+	n, err := w.w.Write(buf)
+	w.offset += int64(n)
+	return n, err
+}
+
+// WriteSegment writes a segment consisting of zero padding up to a multiple
+// of segmentAlign, then the length of seg as a uint64, then seg itself, then
+// the checksum of seg as a uint32 if checksums are enabled.
+func (w *framedWriter) WriteSegment(seg []byte) error {
+	return w.WriteAlignedSegment(seg, segmentAlign)
+}
+
+// WriteAlignedSegment writes a segment whose data begins at a multiple of
+// align, which must itself be a multiple of segmentAlign.
+func (w *framedWriter) WriteAlignedSegment(seg []byte, align int64) error {
+	err := w.WriteAlignedPrefix(uint64(len(seg)), align)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(seg)
+	if err != nil || !w.checksums {
+		return err
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.Checksum(seg, crcTable))
+	_, err = w.Write(sum[:])
+	return err
+}
+
+// WriteAlignedPrefix writes the padding and length prefix of a segment of the
+// given size, after which the caller writes the segment itself. It cannot be
+// used when checksums are enabled.
+func (w *framedWriter) WriteAlignedPrefix(size uint64, align int64) error {
+	pos := lengthOffset(w.offset, align)
+	prefix := make([]byte, pos-w.offset+8)
+	binary.LittleEndian.PutUint64(prefix[pos-w.offset:], size)
+	_, err := w.Write(prefix)
+	return err
+}
+
+// WriteEnd writes a length prefix containing endOfSegments, after which
+// framedReader reports io.EOF.
+func (w *framedWriter) WriteEnd() error {
+	pos := lengthOffset(w.offset, segmentAlign)
+	prefix := make([]byte, pos-w.offset+8)
+	binary.LittleEndian.PutUint64(prefix[pos-w.offset:], endOfSegments)
+	_, err := w.Write(prefix)
+	return err
+}
+
+// lengthOffset gets the offset of the length prefix for a segment written at
+// the provided offset such that the data that follows is aligned to align.
+func lengthOffset(offset, align int64) int64 {
+	data := offset + 8
+	if data%align != 0 {
+		data += align - data%align
+	}
+	return data - 8
+}
+
+// framedReader reads length-prefixed segments
+type framedReader struct {
+	r         io.Reader
+	offset    int64
+	ended     bool // ended is set once endOfSegments has been read
+	checksums bool // checksums is set if each segment is followed by its checksum
+}
+
+func newFramedReader(r io.Reader, offset int64) *framedReader {
+	return &framedReader{
+		r:      r,
+		offset: offset,
+	}
+}
+
+// Next returns the next segment, or (nil, io.EOF) if there are no more
+// segments. Each segment is returned in a freshly allocated buffer.
+func (r *framedReader) Next() ([]byte, error) {
+	return r.NextAligned(segmentAlign)
+}
+
+// NextAligned reads a segment written by WriteAlignedSegment.
+func (r *framedReader) NextAligned(align int64) ([]byte, error) {
+	if r.ended {
+		return nil, io.EOF
+	}
+	prefix := make([]byte, lengthOffset(r.offset, align)-r.offset+8)
+	n, err := io.ReadFull(r.r, prefix)
+	r.offset += int64(n)
+	if err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint64(prefix[len(prefix)-8:])
+	if size == endOfSegments {
+		r.ended = true
+		return nil, io.EOF
+	}
+	if size > uint64(maxInt) {
+		return nil, fmt.Errorf("segment length %d is too large", size)
+	}
+
+	var seg []byte
+	if size <= maxEagerSegment {
+		seg = make([]byte, size)
+		n, err = io.ReadFull(r.r, seg)
+	} else {
+		seg, err = io.ReadAll(io.LimitReader(r.r, int64(size)))
+		n = len(seg)
+		if err == nil && n < int(size) {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	r.offset += int64(n)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	if r.checksums {
+		var sum [4]byte
+		n, err = io.ReadFull(r.r, sum[:])
+		r.offset += int64(n)
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(sum[:]) != crc32.Checksum(seg, crcTable) {
+			return nil, ErrCorrupt
+		}
+	}
+	return seg, nil
+}
+
+// sliceReader reads length-prefixed segments from a stream held in memory,
+// and returns each segment as part of the stream rather than as a copy
+type sliceReader struct {
+	buf       []byte // buf contains the whole stream
+	offset    int64
+	ended     bool
+	checksums bool
+}
+
+// Next returns the next segment, or (nil, io.EOF) if there are no more
+// segments.
+func (r *sliceReader) Next() ([]byte, error) {
+	return r.NextAligned(segmentAlign)
+}
+
+// NextAligned reads a segment written by WriteAlignedSegment.
+func (r *sliceReader) NextAligned(align int64) ([]byte, error) {
+	if r.ended || r.offset == int64(len(r.buf)) {
+		return nil, io.EOF
+	}
+	pos := lengthOffset(r.offset, align)
+	if pos+8 > int64(len(r.buf)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	size := binary.LittleEndian.Uint64(r.buf[pos:])
+	if size == endOfSegments {
+		r.ended = true
+		return nil, io.EOF
+	}
+	if size > uint64(int64(len(r.buf))-pos-8) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	end := pos + 8 + int64(size)
+	seg := r.buf[pos+8 : end : end]
+	r.offset = end
+
+	if r.checksums {
+		if end+4 > int64(len(r.buf)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		r.offset += 4
+		if binary.LittleEndian.Uint32(r.buf[end:]) != crc32.Checksum(seg, crcTable) {
+			return nil, ErrCorrupt
+		}
+	}
+	return seg, nil
+}
+
+// framedSegments gets a reader for the length-prefixed segments that follow
+// the preamble of a stream, which is read from data if it is non-nil and
+// from r otherwise
+func framedSegments(r io.Reader, data []byte, checksums bool) segmentReader {
+	if data != nil {
+		return &sliceReader{buf: data, offset: preambleSize, checksums: checksums}
+	}
+	fr := newFramedReader(r, preambleSize)
+	fr.checksums = checksums
+	return fr
+}
+
+// maxInt is the largest value of type int
+const maxInt = int(^uint(0) >> 1)
@@ -0,0 +1,317 @@
+package memdump
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFramed_Simple(t *testing.T) {
+	var b bytes.Buffer
+	w := newFramedWriter(&b, 0)
+	require.NoError(t, w.WriteSegment([]byte("abc")))
+	require.NoError(t, w.WriteSegment(nil))
+	require.NoError(t, w.WriteSegment([]byte("defggg")))
+
+	r := newFramedReader(&b, 0)
+
+	seg, err := r.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", string(seg))
+
+	seg, err = r.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(seg))
+
+	seg, err = r.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "defggg", string(seg))
+
+	seg, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, seg)
+}
+
+func TestFramed_Aligned(t *testing.T) {
+	var b bytes.Buffer
+	w := newFramedWriter(&b, 3)
+	require.NoError(t, w.WriteSegment([]byte("abc")))
+	require.NoError(t, w.WriteSegment([]byte("def")))
+
+	// each segment should begin at a multiple of 8 relative to the stream
+	assert.Equal(t, "abc", string(b.Bytes()[13:16]))
+	assert.Equal(t, "def", string(b.Bytes()[29:32]))
+
+	r := newFramedReader(&b, 3)
+	seg, err := r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(seg))
+	seg, err = r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "def", string(seg))
+}
+
+func TestFramed_ContainsDelim(t *testing.T) {
+	var b bytes.Buffer
+	w := newFramedWriter(&b, 0)
+	require.NoError(t, w.WriteSegment(join([]byte("abc"), delim, []byte("def"))))
+
+	r := newFramedReader(&b, 0)
+	seg, err := r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, join([]byte("abc"), delim, []byte("def")), seg)
+}
+
+func TestFramed_Truncated(t *testing.T) {
+	var b bytes.Buffer
+	w := newFramedWriter(&b, 0)
+	require.NoError(t, w.WriteSegment([]byte("abcdef")))
+
+	r := newFramedReader(bytes.NewReader(b.Bytes()[:b.Len()-2]), 0)
+	_, err := r.Next()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	r = newFramedReader(bytes.NewReader(b.Bytes()[:4]), 0)
+	_, err = r.Next()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestFramed_Checksum(t *testing.T) {
+	var b bytes.Buffer
+	w := newFramedWriter(&b, 0)
+	w.checksums = true
+	require.NoError(t, w.WriteSegment([]byte("abc")))
+	require.NoError(t, w.WriteSegment([]byte("def")))
+
+	r := newFramedReader(bytes.NewReader(b.Bytes()), 0)
+	r.checksums = true
+	seg, err := r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(seg))
+	seg, err = r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "def", string(seg))
+
+	corrupt := bytes.Replace(b.Bytes(), []byte("def"), []byte("dEf"), 1)
+	r = newFramedReader(bytes.NewReader(corrupt), 0)
+	r.checksums = true
+	_, err = r.Next()
+	require.NoError(t, err)
+	_, err = r.Next()
+	assert.Equal(t, ErrCorrupt, err)
+}
+
+func TestFramed_End(t *testing.T) {
+	var b bytes.Buffer
+	w := newFramedWriter(&b, 0)
+	require.NoError(t, w.WriteSegment([]byte("abc")))
+	require.NoError(t, w.WriteEnd())
+	require.NoError(t, w.WriteSegment([]byte("def")))
+
+	r := newFramedReader(&b, 0)
+	_, err := r.Next()
+	require.NoError(t, err)
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestPreamble(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, writePreamble(&b, 123))
+	assert.EqualValues(t, preambleSize, b.Len())
+
+	protocol, err := readPreamble(bufio.NewReader(&b))
+	require.NoError(t, err)
+	assert.EqualValues(t, 123, protocol)
+}
+
+func TestPreamble_Legacy(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte{2, 0, 0, 0}))
+	protocol, err := readPreamble(r)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, protocol)
+	assert.Equal(t, 4, r.Buffered())
+}
+
+type delimHolder struct {
+	A [16]byte
+	B []byte
+}
+
+func TestHomogeneous_DataContainsDelim(t *testing.T) {
+	var src delimHolder
+	copy(src.A[:], delim)
+	src.B = join(delim, delim)
+
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	require.NoError(t, enc.Encode(&src))
+	require.NoError(t, enc.Encode(&src))
+
+	dec := NewDecoder(&b)
+	for i := 0; i < 2; i++ {
+		var dest delimHolder
+		require.NoError(t, dec.Decode(&dest))
+		assert.Equal(t, src, dest)
+	}
+	var dest delimHolder
+	assert.Equal(t, io.EOF, dec.Decode(&dest))
+}
+
+func TestHeterogeneous_DataContainsDelim(t *testing.T) {
+	var src delimHolder
+	copy(src.A[:], delim)
+	src.B = join(delim, delim)
+
+	var dest delimHolder
+	testEncodeDecode(t, &src, &dest)
+	assert.Equal(t, src, dest)
+}
+
+// readLegacy reads a file in testdata that was written by the first version
+// of this package, before streams recorded the architecture. The files were
+// written on amd64, so the test is skipped on other architectures.
+func readLegacy(t *testing.T, name string) []byte {
+	if nativeArch != archs["amd64"] {
+		t.Skip("the legacy test data was written on amd64")
+	}
+	buf, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return buf
+}
+
+// encodeFramedHeterogeneous writes objs using protocol 4, which has a
+// descriptor in the footer of every object
+func encodeFramedHeterogeneous(t *testing.T, w io.Writer, objs ...interface{}) {
+	fw := newFramedWriter(w, 0)
+	require.NoError(t, writePreamble(fw, framedHeterogeneousProtocol))
+	require.NoError(t, writeGobSegment(fw, header{Protocol: framedHeterogeneousProtocol, Arch: nativeArch}))
+	for _, obj := range objs {
+		var buf bytes.Buffer
+		loc, err := newMemEncoder(&buf).Encode(obj)
+		require.NoError(t, err)
+		require.NoError(t, fw.WriteSegment(buf.Bytes()))
+		require.NoError(t, writeGobSegment(fw, heterogeneousFooter{
+			Pointers:   loc.Pointers,
+			Main:       loc.Main,
+			Descriptor: mustDescribe(t, reflect.TypeOf(obj).Elem()),
+		}))
+	}
+}
+
+func TestHomogeneous_LegacyProtocol(t *testing.T) {
+	type T struct {
+		X int
+		Y string
+	}
+	// written by NewEncoder with protocol 1
+	buf := readLegacy(t, "legacy_homogeneous.memdump")
+
+	dec := NewDecoder(bytes.NewReader(buf))
+	var x T
+	require.NoError(t, dec.Decode(&x))
+	assert.Equal(t, T{1, "s1"}, x)
+	require.NoError(t, dec.Decode(&x))
+	assert.Equal(t, T{2, "s2"}, x)
+	assert.Equal(t, io.EOF, dec.Decode(&x))
+}
+
+func TestHeterogeneous_LegacyProtocol(t *testing.T) {
+	// written by NewHeterogeneousEncoder with protocol 2
+	buf := readLegacy(t, "legacy_heterogeneous.memdump")
+
+	dec := NewHeterogeneousDecoder(bytes.NewReader(buf))
+	var x2 int
+	var s2 string
+	require.NoError(t, dec.Decode(&x2))
+	require.NoError(t, dec.Decode(&s2))
+	assert.Equal(t, 3, x2)
+	assert.Equal(t, "abc", s2)
+	assert.Equal(t, io.EOF, dec.Decode(&x2))
+}
+
+func TestHomogeneous_Checksum(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	require.NoError(t, enc.EnableChecksums())
+	for _, name := range []string{"first", "second", "third"} {
+		require.NoError(t, enc.Encode(&recordV1{Name: name}))
+	}
+
+	dec := NewDecoder(bytes.NewReader(b.Bytes()))
+	var dest recordV1
+	for i := 0; i < 3; i++ {
+		require.NoError(t, dec.Decode(&dest))
+	}
+	assert.Equal(t, "third", dest.Name)
+	assert.Equal(t, io.EOF, dec.Decode(&dest))
+
+	// corrupt the data of the second record
+	corrupt := bytes.Replace(b.Bytes(), []byte("second"), []byte("secoNd"), 1)
+	dec = NewDecoder(bytes.NewReader(corrupt))
+	require.NoError(t, dec.Decode(&dest))
+	err := dec.Decode(&dest)
+	assert.True(t, errors.Is(err, ErrCorrupt))
+	assert.Contains(t, err.Error(), "record 1")
+}
+
+func TestHeterogeneous_Checksum(t *testing.T) {
+	x, s := 3, "abcdef"
+	var b bytes.Buffer
+	enc := NewHeterogeneousEncoder(&b)
+	require.NoError(t, enc.EnableChecksums())
+	require.NoError(t, enc.Encode(&x))
+	require.NoError(t, enc.Encode(&s))
+
+	dec := NewHeterogeneousDecoder(bytes.NewReader(b.Bytes()))
+	var x2 int
+	var s2 string
+	require.NoError(t, dec.Decode(&x2))
+	require.NoError(t, dec.Decode(&s2))
+	assert.Equal(t, s, s2)
+
+	corrupt := bytes.Replace(b.Bytes(), []byte("abcdef"), []byte("abcDef"), 1)
+	dec = NewHeterogeneousDecoder(bytes.NewReader(corrupt))
+	require.NoError(t, dec.Decode(&x2))
+	err := dec.Decode(&s2)
+	assert.True(t, errors.Is(err, ErrCorrupt))
+	assert.Contains(t, err.Error(), "record 1")
+}
+
+func TestChecksum_AfterEncode(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	require.NoError(t, enc.Encode(&recordV1{ID: 1}))
+	assert.Error(t, enc.EnableChecksums())
+
+	henc := NewHeterogeneousEncoder(&b)
+	require.NoError(t, henc.Encode(&recordV1{ID: 1}))
+	assert.Error(t, henc.EnableChecksums())
+}
+
+func TestChecksum_Transcoded(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	require.NoError(t, enc.EnableChecksums())
+	require.NoError(t, enc.Encode(&recordV1{ID: 1, Name: "abc"}))
+
+	native := transcodeVia(t, &b, "s390x")
+	info, err := Inspect(bytes.NewReader(native.Bytes()))
+	require.NoError(t, err)
+	assert.True(t, info.Checksum)
+	assert.Equal(t, framedHomogeneousProtocol, info.Protocol)
+
+	var dest recordV1
+	require.NoError(t, NewDecoder(native).Decode(&dest))
+	assert.Equal(t, recordV1{ID: 1, Name: "abc"}, dest)
+}
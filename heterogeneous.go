@@ -1,6 +1,7 @@
 package memdump
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
@@ -9,86 +10,267 @@ import (
 	"reflect"
 )
 
+// heterogeneousFooter is the footer of each object in streams written with
+// protocols 2 and 4
 type heterogeneousFooter struct {
 	Pointers   []int64 // Pointers contains the offset of each pointer
 	Main       int64   // Main contains the offset of the primary object
 	Descriptor descriptor
+	Types      []registeredType // Types contains the types that may be stored in interfaces
+}
+
+// typeEntry is an entry in the type table of a stream written with protocol
+// 8. It is gob-encoded at the end of the footer of the first object that
+// refers to it.
+type typeEntry struct {
+	Name       string // Name is the name under which the type is registered
+	Descriptor descriptor
+	Types      []registeredType // Types contains the types that may be stored in interfaces reachable from this type
+}
+
+// tableID is the ID in the type table of a type that has been encoded,
+// together with the registered types that were written with it
+type tableID struct {
+	id    uint64
+	types *typeSnapshot
 }
 
 // HeterogeneousEncoder writes memdumps to the provided writer
 type HeterogeneousEncoder struct {
-	w           io.Writer
+	w           *framedWriter
+	buf         bytes.Buffer
 	hasprotocol bool
+	zip         *compressor
+	ids         map[reflect.Type]tableID // ids contains the type table entry for each type encoded so far
+	ntypes      uint64                   // ntypes is the number of entries in the type table
 }
 
 // NewHeterogeneousEncoder creates an HeterogeneousEncoder that writes memdumps to the provided writer
 func NewHeterogeneousEncoder(w io.Writer) *HeterogeneousEncoder {
 	return &HeterogeneousEncoder{
-		w: w,
+		w:   newFramedWriter(w, 0),
+		ids: make(map[reflect.Type]tableID),
+	}
+}
+
+// EnableChecksums causes a CRC-32C checksum to be written after each segment,
+// which decoders verify. It must be called before the first call to Encode.
+func (e *HeterogeneousEncoder) EnableChecksums() error {
+	if e.hasprotocol {
+		return errEncoderStarted
 	}
+	e.w.checksums = true
+	return nil
+}
+
+// EnableCompression causes each data segment to be compressed with
+// compress/flate at the given level, such as flate.BestSpeed. Decoders
+// decompress the segments automatically. It must be called before the first
+// call to Encode.
+func (e *HeterogeneousEncoder) EnableCompression(level int) error {
+	if e.hasprotocol {
+		return errEncoderStarted
+	}
+	zip, err := newCompressor(level)
+	if err != nil {
+		return err
+	}
+	e.zip = zip
+	return nil
 }
 
 // Encode writes a memdump of the provided object to output. You must pass a
 // pointer to the object you wish to encode. To encode a pointer, pass a
 // double-pointer.
 func (e *HeterogeneousEncoder) Encode(obj interface{}) error {
-	t := reflect.TypeOf(obj)
-	if t.Kind() != reflect.Ptr {
-		panic(fmt.Sprintf("expected a pointer but got %T", obj))
+	t, err := checkPointer(obj)
+	if err != nil {
+		return err
+	}
+
+	// the descriptor is only computed for types that are not yet in the
+	// type table, or when more types have been registered since. Each entry
+	// holds only the registered types that its own type can hold.
+	types := snapshotTypes(t.Elem())
+	ref, found := e.ids[t]
+	var entry *typeEntry
+	if !found || ref.types != types {
+		desc, err := describe(t.Elem())
+		if err != nil {
+			return err
+		}
+		ref = tableID{id: e.ntypes, types: types}
+		entry = &typeEntry{Name: registeredName(t.Elem()), Descriptor: desc, Types: types.table}
 	}
 
-	// write a protocol heterogeneousProtocol number
+	// write the magic number, protocol, and header
 	if !e.hasprotocol {
-		err := binary.Write(e.w, binary.LittleEndian, heterogeneousProtocol)
+		protocol := tabledHeterogeneousProtocol
+		if e.w.checksums {
+			protocol |= checksumFlag
+		}
+		var compression string
+		if e.zip != nil {
+			protocol |= compressionFlag
+			compression = flateCompression
+		}
+		err = writePreamble(e.w, protocol)
 		if err != nil {
 			return fmt.Errorf("error writing protocol: %v", err)
 		}
+
+		e.buf.Reset()
+		err = gob.NewEncoder(&e.buf).Encode(header{
+			Protocol:    tabledHeterogeneousProtocol,
+			Arch:        nativeArch,
+			Compression: compression,
+		})
+		if err != nil {
+			return fmt.Errorf("error encoding header: %v", err)
+		}
+		err = e.w.WriteSegment(e.buf.Bytes())
+		if err != nil {
+			return fmt.Errorf("error writing header: %v", err)
+		}
 		e.hasprotocol = true
 	}
 
 	// first segment: write the object data
-	mem := newMemEncoder(e.w)
-	ptrs, err := mem.Encode(obj)
+	e.buf.Reset()
+	mem := newMemEncoder(&e.buf)
+	mem.types = types
+	loc, err := mem.Encode(obj)
+	if err != nil {
+		return fmt.Errorf("error encoding data segment: %w", err)
+	}
+	data := e.buf.Bytes()
+	if e.zip != nil {
+		data, err = e.zip.compress(data)
+		if err != nil {
+			return fmt.Errorf("error compressing data segment: %w", err)
+		}
+	}
+	err = e.w.WriteSegment(data)
 	if err != nil {
 		return fmt.Errorf("error writing data segment: %v", err)
 	}
 
-	// write delimiter
-	_, err = e.w.Write(delim)
+	// second segment: write the type ID and locations
+	e.buf.Reset()
+	err = encodeTableFooter(&e.buf, ref.id, loc, entry)
 	if err != nil {
-		return fmt.Errorf("error writing delimiter: %v", err)
+		return fmt.Errorf("error encoding footer: %v", err)
 	}
-
-	// second segment: write the metadata
-	gob := gob.NewEncoder(e.w)
-	err = gob.Encode(heterogeneousFooter{
-		Pointers:   ptrs,
-		Descriptor: describe(t.Elem()),
-	})
+	err = e.w.WriteSegment(e.buf.Bytes())
 	if err != nil {
-		return fmt.Errorf("error writing heterogeneousFooter: %v", err)
+		return fmt.Errorf("error writing footer: %v", err)
+	}
+	if entry != nil {
+		e.ids[t] = ref
+		e.ntypes++
 	}
+	return nil
+}
 
-	// write delimiter
-	_, err = e.w.Write(delim)
+// encodeTableFooter writes the footer of an object in a stream written with
+// protocol 8, which contains the ID of its type in the type table and its
+// locations, followed by the type table entry if this is the first object of
+// that type
+func encodeTableFooter(w io.Writer, id uint64, loc *locations, entry *typeEntry) error {
+	err := binary.Write(w, binary.LittleEndian, id)
+	if err != nil {
+		return err
+	}
+	err = encodeLocations(w, loc)
 	if err != nil {
-		return fmt.Errorf("error writing delimiter: %v", err)
+		return err
+	}
+	if entry != nil {
+		return gob.NewEncoder(w).Encode(entry)
 	}
 	return nil
 }
 
+// decodeTableFooter reads a footer written by encodeTableFooter, given the
+// number of entries in the type table so far. It returns the new entry if the
+// footer defines one.
+func decodeTableFooter(seg []byte, ntypes int) (int, *locations, *typeEntry, error) {
+	r := bytes.NewReader(seg)
+	var id uint64
+	err := binary.Read(r, binary.LittleEndian, &id)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if id > uint64(ntypes) {
+		return 0, nil, nil, fmt.Errorf("type ID %d is not in the type table", id)
+	}
+	var loc locations
+	err = decodeLocations(r, &loc)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if id < uint64(ntypes) {
+		return int(id), &loc, nil, nil
+	}
+	var entry typeEntry
+	err = gob.NewDecoder(r).Decode(&entry)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("error decoding type table entry: %v", err)
+	}
+	return int(id), &loc, &entry, nil
+}
+
 // HeterogeneousDecoder reads memdumps from the provided reader
 type HeterogeneousDecoder struct {
-	r           io.Reader
-	dr          *DelimitedReader
+	r           *bufio.Reader
+	data        []byte // data contains the whole stream for decoders created by NewHeterogeneousDecoderBytes
+	sr          segmentReader
 	hasprotocol bool
+	policy      LayoutPolicy
+	n           int // n is the number of records read so far
+	compressed  bool
+	scan        scanner
+	tabled      bool                 // tabled is set for streams with a type table
+	table       []*tableEntry        // table contains the type table read so far
+	pending     *heterogeneousRecord // pending is the object read by PeekDescriptor
+}
+
+// tableEntry is an entry in the type table of a stream being decoded, together
+// with the result of comparing it to each Go type it has been decoded as
+type tableEntry struct {
+	typeEntry
+	layouts map[reflect.Type]tableLayout
+}
+
+// tableLayout is the result of newLayout for a type table entry and a Go type
+type tableLayout struct {
+	l   *layout
+	err error
 }
 
 // NewHeterogeneousDecoder creates a HeterogeneousDecoder that reads memdumps
 func NewHeterogeneousDecoder(r io.Reader) *HeterogeneousDecoder {
 	return &HeterogeneousDecoder{
-		r:  r,
-		dr: NewDelimitedReader(r),
+		r: bufio.NewReader(r),
+	}
+}
+
+// NewHeterogeneousDecoderBytes creates a HeterogeneousDecoder that reads
+// memdumps from a stream held in memory. Each object is relocated in place
+// within data, as for NewDecoderBytes.
+func NewHeterogeneousDecoderBytes(data []byte) *HeterogeneousDecoder {
+	return &HeterogeneousDecoder{
+		r:    bufio.NewReader(bytes.NewReader(data)),
+		data: data,
+	}
+}
+
+// SetLayoutPolicy determines what happens when an object in the stream was
+// written with a different layout than the type passed to Decode.
+func (d *HeterogeneousDecoder) SetLayoutPolicy(policy LayoutPolicy) {
+	d.policy = policy
+	for _, entry := range d.table {
+		entry.layouts = make(map[reflect.Type]tableLayout)
 	}
 }
 
@@ -96,9 +278,9 @@ func NewHeterogeneousDecoder(r io.Reader) *HeterogeneousDecoder {
 // The object passed to Decode must be a pointer to the type
 // was originally passed to Encode().
 func (d *HeterogeneousDecoder) Decode(dest interface{}) error {
-	t := reflect.TypeOf(dest)
-	if t.Kind() != reflect.Ptr {
-		panic(fmt.Sprintf("expected a pointer but got %T", dest))
+	t, err := checkPointer(dest)
+	if err != nil {
+		return err
 	}
 
 	ptr, err := d.DecodePtr(t.Elem())
@@ -109,53 +291,205 @@ func (d *HeterogeneousDecoder) Decode(dest interface{}) error {
 	return nil
 }
 
+// readProtocol reads the protocol, which tells us whether the segments that
+// follow are delimited (protocol 2) or length-prefixed (protocols 4 and 8).
+func (d *HeterogeneousDecoder) readProtocol() error {
+	protocol, err := readPreamble(d.r)
+	if err == io.EOF {
+		// an encoder that was given no objects writes nothing
+		return io.EOF
+	} else if err != nil {
+		return fmt.Errorf("error reading protocol: %v", err)
+	}
+
+	switch base, checksums, compressed := splitProtocol(protocol); base {
+	case 0:
+		// streams written with protocol 2 begin with the bare protocol number
+		err = binary.Read(d.r, binary.LittleEndian, &protocol)
+		if err != nil {
+			return fmt.Errorf("error reading protocol: %v", err)
+		}
+		if protocol != heterogeneousProtocol {
+			return fmt.Errorf("invalid protocol %d", protocol)
+		}
+		d.sr = NewDelimitedReader(d.r)
+	case framedHeterogeneousProtocol, tabledHeterogeneousProtocol:
+		d.tabled = base == tabledHeterogeneousProtocol
+		d.sr = framedSegments(d.r, d.data, checksums)
+		seg, err := d.sr.Next()
+		if err != nil {
+			return fmt.Errorf("error reading header segment: %w", truncated(err))
+		}
+		var h header
+		err = gob.NewDecoder(bytes.NewBuffer(seg)).Decode(&h)
+		if err != nil {
+			return fmt.Errorf("error decoding header: %v", err)
+		}
+		err = checkArch(h.Arch)
+		if err != nil {
+			return err
+		}
+		err = checkCompression(compressed, &h)
+		if err != nil {
+			return err
+		}
+		d.compressed = compressed
+	default:
+		return fmt.Errorf("invalid protocol %d", protocol)
+	}
+	return nil
+}
+
 // DecodePtr reads an object of the specified type from the input
 // and returns a pointer to it. The provided type must be the result
 // of calling reflect.TypeOf(x) where x is the object originally
 // passed to Encode(). The return valoue will be of type *x
 func (d *HeterogeneousDecoder) DecodePtr(typ reflect.Type) (interface{}, error) {
+	if typ == nil {
+		return nil, &InvalidArgumentError{Expected: "a type"}
+	}
+	rec, err := d.next()
+	if err != nil {
+		return nil, err
+	}
+
+	// compare descriptors, which is only done once for each entry in the
+	// type table and each Go type
+	var l *layout
+	if rec.entry != nil {
+		tl, found := rec.entry.layouts[typ]
+		if !found {
+			tl.l, tl.err = newLayout(d.policy, typ, rec.entry.Descriptor, rec.entry.Types)
+			rec.entry.layouts[typ] = tl
+		}
+		l, err = tl.l, tl.err
+	} else {
+		l, err = newLayout(d.policy, typ, rec.desc, rec.types)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// relocate the data
+	return l.decode(rec.data, rec.loc.Pointers, rec.loc.Main, typ)
+}
+
+// DecodeNext reads the next object from the input and returns a pointer to it.
+// The type of the object must have been registered with Register or
+// RegisterType, under the name that the encoder recorded for it. Otherwise the
+// object is left in place, so that it can be read with DecodePtr instead. It
+// returns io.EOF at the end of the stream.
+func (d *HeterogeneousDecoder) DecodeNext() (interface{}, error) {
+	_, name, err := d.PeekDescriptor()
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("the name of the type of record %d was not recorded", d.n-1)
+	}
+	t, found := lookupName(name)
+	if !found {
+		return nil, fmt.Errorf("type %q of record %d has not been registered", name, d.n-1)
+	}
+	return d.DecodePtr(t)
+}
+
+// PeekDescriptor reads the next object from the input without decoding it,
+// and returns its descriptor together with the name under which its type was
+// registered, so that the caller can choose the type to pass to DecodePtr.
+// The name is empty for streams written before protocol 8. It returns io.EOF
+// at the end of the stream.
+func (d *HeterogeneousDecoder) PeekDescriptor() (Descriptor, string, error) {
+	if d.pending == nil {
+		rec, err := d.read()
+		if err != nil {
+			return Descriptor{}, "", err
+		}
+		d.pending = rec
+	}
+	if d.pending.entry != nil {
+		return Descriptor{d: d.pending.entry.Descriptor}, d.pending.entry.Name, nil
+	}
+	return Descriptor{d: d.pending.desc}, "", nil
+}
+
+// heterogeneousRecord is an object read from a heterogeneous stream, which has
+// either an entry in the type table or its own descriptor
+type heterogeneousRecord struct {
+	data  []byte
+	loc   locations
+	entry *tableEntry
+	desc  descriptor
+	types []registeredType
+}
+
+// next gets the object read by PeekDescriptor, or else reads the next object
+func (d *HeterogeneousDecoder) next() (*heterogeneousRecord, error) {
+	if d.pending != nil {
+		rec := d.pending
+		d.pending = nil
+		return rec, nil
+	}
+	return d.read()
+}
+
+// read reads the segments of the next object and decodes its footer
+func (d *HeterogeneousDecoder) read() (*heterogeneousRecord, error) {
 	// read protocol
 	if !d.hasprotocol {
-		var protocol int32
-		err := binary.Read(d.r, binary.LittleEndian, &protocol)
+		err := d.readProtocol()
 		if err != nil {
-			return nil, fmt.Errorf("error reading protocol: %v", err)
-		}
-		if protocol != heterogeneousProtocol {
-			return nil, fmt.Errorf("invalid protocol %d", protocol)
+			return nil, err
 		}
 		d.hasprotocol = true
 	}
 
 	// first segment: read the memory buffer
-	dataseg, err := d.dr.Next()
+	dataseg, err := d.sr.Next()
 	if len(dataseg) == 0 && err == io.EOF {
 		return nil, io.EOF
 	}
 	if err != nil {
-		return nil, fmt.Errorf("error reading data segment: %v", err)
+		return nil, segmentError("data segment", d.n, err)
 	}
 
 	// read the footer
-	footerseg, err := d.dr.Next()
+	footerseg, err := d.sr.Next()
 	if err != nil {
-		return nil, fmt.Errorf("error reading footer segment: %v", err)
+		return nil, segmentError("footer segment", d.n, err)
+	}
+	d.n++
+	if d.compressed {
+		dataseg, err = decompress(dataseg)
+		if err != nil {
+			return nil, err
+		}
 	}
+	rec := heterogeneousRecord{data: dataseg}
 
 	// decode footer
+	if d.tabled {
+		id, loc, entry, err := decodeTableFooter(footerseg, len(d.table))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding footer: %v", err)
+		}
+		if entry != nil {
+			d.table = append(d.table, &tableEntry{
+				typeEntry: *entry,
+				layouts:   make(map[reflect.Type]tableLayout),
+			})
+		}
+		rec.loc, rec.entry = *loc, d.table[id]
+		return &rec, nil
+	}
+
 	var f heterogeneousFooter
 	dec := gob.NewDecoder(bytes.NewBuffer(footerseg))
 	err = dec.Decode(&f)
 	if err != nil {
 		return nil, fmt.Errorf("error decoding footer: %v", err)
 	}
-
-	// compare descriptors
-	descr := describe(typ)
-	if !descriptorsEqual(descr, f.Descriptor) {
-		return nil, ErrIncompatibleLayout
-	}
-
-	// relocate the data
-	return relocate(dataseg, f.Pointers, f.Main, typ)
+	rec.loc = locations{Main: f.Main, Pointers: f.Pointers}
+	rec.desc, rec.types = f.Descriptor, f.Types
+	return &rec, nil
 }
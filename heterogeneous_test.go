@@ -2,8 +2,12 @@ package memdump
 
 import (
 	"bytes"
+	"fmt"
+	"io"
+	"reflect"
 	"strings"
 	"testing"
+	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -118,17 +122,293 @@ func TestHeterogeneous_Incompatible(t *testing.T) {
 func TestHeterogeneousEncodeUnsupportedTypes(t *testing.T) {
 	var buf bytes.Buffer
 	enc := NewHeterogeneousEncoder(&buf)
-	assert.Panics(t, func() {
-		enc.Encode(&map[string]int{})
-	})
-	assert.Panics(t, func() {
-		enc.Encode(func() {})
-	})
-	assert.Panics(t, func() {
-		enc.Encode(make(chan int))
-	})
-	assert.Panics(t, func() {
-		var x interface{} = "abc"
-		enc.Encode(&x)
-	})
+	err := enc.Encode(func() {})
+	assert.IsType(t, &InvalidArgumentError{}, err)
+
+	ch := make(chan int)
+	err = enc.Encode(&ch)
+	assert.IsType(t, &UnsupportedTypeError{}, err)
+
+	// interfaces are supported, but only for registered types
+	type unregistered struct{ X int }
+	var x interface{} = unregistered{3}
+	assert.Error(t, enc.Encode(&x))
+}
+
+func TestHeterogeneous_DecoderBytes(t *testing.T) {
+	x, s := 3, "abc"
+	var b bytes.Buffer
+	enc := NewHeterogeneousEncoder(&b)
+	require.NoError(t, enc.Encode(&x))
+	require.NoError(t, enc.Encode(&s))
+	buf := b.Bytes()
+
+	dec := NewHeterogeneousDecoderBytes(buf)
+	ptr, err := dec.DecodePtr(reflect.TypeOf(0))
+	require.NoError(t, err)
+	assert.Equal(t, 3, *ptr.(*int))
+	assert.True(t, within(unsafe.Pointer(ptr.(*int)), buf))
+	var s2 string
+	require.NoError(t, dec.Decode(&s2))
+	assert.Equal(t, s, s2)
+	assert.Equal(t, io.EOF, dec.Decode(&s2))
+}
+
+func TestHeterogeneous_TypeTable(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewHeterogeneousEncoder(&b)
+	for i := 0; i < 100; i++ {
+		x, s := i, strings.Repeat("x", i%5)
+		require.NoError(t, enc.Encode(&x))
+		require.NoError(t, enc.Encode(&s))
+	}
+	assert.Len(t, enc.ids, 2)
+
+	// the type table entries appear once each, in the first two footers
+	s, err := openRawStream(bytes.NewReader(b.Bytes()))
+	require.NoError(t, err)
+	for i := 0; i < 200; i++ {
+		rec, err := s.next()
+		require.NoError(t, err)
+		assert.Equal(t, i%2, rec.typeID)
+		assert.Equal(t, i < 2, rec.newType)
+	}
+	_, err = s.next()
+	assert.Equal(t, io.EOF, err)
+
+	dec := NewHeterogeneousDecoder(bytes.NewReader(b.Bytes()))
+	for i := 0; i < 100; i++ {
+		var x int
+		var s string
+		require.NoError(t, dec.Decode(&x))
+		require.NoError(t, dec.Decode(&s))
+		assert.Equal(t, i, x)
+		assert.Equal(t, strings.Repeat("x", i%5), s)
+	}
+	var x int
+	assert.Equal(t, io.EOF, dec.Decode(&x))
+}
+
+func TestHeterogeneous_TypeTableLayouts(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewHeterogeneousEncoder(&b)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, enc.Encode(&recordV1{ID: i, Name: "x"}))
+	}
+
+	// the result of comparing layouts is cached for each type, and reset
+	// when the policy changes
+	dec := NewHeterogeneousDecoder(bytes.NewReader(b.Bytes()))
+	var dest recordV2
+	assert.Equal(t, ErrIncompatibleLayout, dec.Decode(&dest))
+	dec.SetLayoutPolicy(MatchFieldsByName)
+	require.NoError(t, dec.Decode(&dest))
+	assert.Equal(t, recordV2{ID: 1, Name: "x"}, dest)
+	var same recordV1
+	require.NoError(t, dec.Decode(&same))
+	assert.Equal(t, recordV1{ID: 2, Name: "x"}, same)
+}
+
+func TestHeterogeneous_TypeTableRegister(t *testing.T) {
+	type registeredLater struct{ X int }
+	var b bytes.Buffer
+	enc := NewHeterogeneousEncoder(&b)
+	var x interface{} = 1
+	Register(0)
+	require.NoError(t, enc.Encode(&x))
+
+	// registering a type adds a new entry to the table
+	Register(registeredLater{})
+	defer unregister(reflect.TypeOf(registeredLater{}))
+	x = registeredLater{2}
+	require.NoError(t, enc.Encode(&x))
+	assert.Equal(t, uint64(2), enc.ntypes)
+
+	dec := NewHeterogeneousDecoder(&b)
+	var dest interface{}
+	require.NoError(t, dec.Decode(&dest))
+	assert.Equal(t, 1, dest)
+	require.NoError(t, dec.Decode(&dest))
+	assert.Equal(t, registeredLater{2}, dest)
+}
+
+func TestHeterogeneous_TypeTableCorrupt(t *testing.T) {
+	x := 3
+	var b bytes.Buffer
+	fw := newFramedWriter(&b, 0)
+	require.NoError(t, writePreamble(fw, tabledHeterogeneousProtocol))
+	require.NoError(t, writeGobSegment(fw, header{Protocol: tabledHeterogeneousProtocol, Arch: nativeArch}))
+	var buf bytes.Buffer
+	loc, err := newMemEncoder(&buf).Encode(&x)
+	require.NoError(t, err)
+	require.NoError(t, fw.WriteSegment(buf.Bytes()))
+	buf.Reset()
+	require.NoError(t, encodeTableFooter(&buf, 1, loc, nil))
+	require.NoError(t, fw.WriteSegment(buf.Bytes()))
+
+	dec := NewHeterogeneousDecoder(&b)
+	err = dec.Decode(&x)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "type ID 1 is not in the type table")
+}
+
+func TestHeterogeneous_FramedProtocol(t *testing.T) {
+	x, s := 3, "abc"
+	var b bytes.Buffer
+	encodeFramedHeterogeneous(t, &b, &x, &s)
+
+	dec := NewHeterogeneousDecoder(bytes.NewReader(b.Bytes()))
+	var dx int
+	var ds string
+	require.NoError(t, dec.Decode(&dx))
+	require.NoError(t, dec.Decode(&ds))
+	assert.Equal(t, 3, dx)
+	assert.Equal(t, "abc", ds)
+	assert.Equal(t, io.EOF, dec.Decode(&dx))
+
+	info, err := Inspect(bytes.NewReader(b.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, framedHeterogeneousProtocol, info.Protocol)
+	assert.Len(t, info.Records, 2)
+}
+
+type shapeCircle struct{ Radius float64 }
+type shapeSquare struct {
+	Side  float64
+	Label string
+}
+
+func TestHeterogeneous_DecodeNext(t *testing.T) {
+	RegisterType("shapes.Circle", shapeCircle{})
+	RegisterType("shapes.Square", shapeSquare{})
+	defer unregister(reflect.TypeOf(shapeCircle{}))
+	defer unregister(reflect.TypeOf(shapeSquare{}))
+
+	var b bytes.Buffer
+	enc := NewHeterogeneousEncoder(&b)
+	require.NoError(t, enc.Encode(&shapeCircle{1.5}))
+	require.NoError(t, enc.Encode(&shapeSquare{2, "b"}))
+	require.NoError(t, enc.Encode(&shapeCircle{3}))
+	buf := b.Bytes()
+
+	dec := NewHeterogeneousDecoder(bytes.NewReader(buf))
+	var objs []interface{}
+	for {
+		obj, err := dec.DecodeNext()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		objs = append(objs, obj)
+	}
+	assert.Equal(t, []interface{}{&shapeCircle{1.5}, &shapeSquare{2, "b"}, &shapeCircle{3}}, objs)
+
+	info, err := Inspect(bytes.NewReader(buf))
+	require.NoError(t, err)
+	require.Len(t, info.Records, 3)
+	assert.Equal(t, "shapes.Square", info.Records[1].Type)
+}
+
+func TestHeterogeneous_PeekDescriptor(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewHeterogeneousEncoder(&b)
+	require.NoError(t, enc.Encode(&shapeCircle{1.5}))
+	require.NoError(t, enc.Encode(&shapeSquare{2, "b"}))
+
+	circle, err := Describe(reflect.TypeOf(shapeCircle{}))
+	require.NoError(t, err)
+	square, err := Describe(reflect.TypeOf(shapeSquare{}))
+	require.NoError(t, err)
+
+	// unregistered types are recorded under the name Register would use
+	dec := NewHeterogeneousDecoder(&b)
+	desc, name, err := dec.PeekDescriptor()
+	require.NoError(t, err)
+	assert.True(t, desc.Equal(circle))
+	assert.Equal(t, typeName(reflect.TypeOf(shapeCircle{})), name)
+
+	// peeking again returns the same object
+	desc, _, err = dec.PeekDescriptor()
+	require.NoError(t, err)
+	assert.True(t, desc.Equal(circle))
+	var c shapeCircle
+	require.NoError(t, dec.Decode(&c))
+	assert.Equal(t, shapeCircle{1.5}, c)
+
+	desc, _, err = dec.PeekDescriptor()
+	require.NoError(t, err)
+	assert.True(t, desc.Equal(square))
+	_, err = dec.DecodeNext()
+	assert.EqualError(t, err, fmt.Sprintf("type %q of record 1 has not been registered", typeName(reflect.TypeOf(shapeSquare{}))))
+	var s shapeSquare
+	require.NoError(t, dec.Decode(&s))
+	assert.Equal(t, shapeSquare{2, "b"}, s)
+
+	_, _, err = dec.PeekDescriptor()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestHeterogeneous_DecodeNextFramedProtocol(t *testing.T) {
+	x := 3
+	var b bytes.Buffer
+	encodeFramedHeterogeneous(t, &b, &x)
+
+	dec := NewHeterogeneousDecoder(&b)
+	_, name, err := dec.PeekDescriptor()
+	require.NoError(t, err)
+	assert.Empty(t, name)
+	_, err = dec.DecodeNext()
+	assert.Error(t, err)
+}
+
+func TestRegisterType_Duplicate(t *testing.T) {
+	type renamed struct{ X int }
+	RegisterType("renamed", renamed{})
+	defer unregister(reflect.TypeOf(renamed{}))
+
+	RegisterType("renamed", renamed{})
+	assert.Panics(t, func() { RegisterType("other", renamed{}) })
+	assert.Panics(t, func() { RegisterType("renamed", shapeCircle{}) })
+}
+
+func TestHeterogeneous_EntryTypes(t *testing.T) {
+	x := 3
+	holder := struct{ S shape }{square{2}}
+	var b bytes.Buffer
+	enc := NewHeterogeneousEncoder(&b)
+	require.NoError(t, enc.Encode(&x))
+	require.NoError(t, enc.Encode(&holder))
+	require.NoError(t, enc.Encode(&x))
+	buf := b.Bytes()
+
+	// each entry in the type table holds only the types that its own type
+	// can hold
+	fr := newFramedReader(bytes.NewReader(buf[preambleSize:]), preambleSize)
+	_, err := fr.Next()
+	require.NoError(t, err)
+	var entries [][]registeredType
+	for {
+		_, err := fr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		footer, err := fr.Next()
+		require.NoError(t, err)
+		_, _, entry, err := decodeTableFooter(footer, len(entries))
+		require.NoError(t, err)
+		if entry != nil {
+			entries = append(entries, entry.Types)
+		}
+	}
+	require.Len(t, entries, 2)
+	assert.Empty(t, entries[0])
+	assert.Len(t, entries[1], 2)
+
+	var dest struct{ S shape }
+	dec := NewHeterogeneousDecoder(bytes.NewReader(buf))
+	var dx int
+	require.NoError(t, dec.Decode(&dx))
+	require.NoError(t, dec.Decode(&dest))
+	assert.Equal(t, holder, dest)
 }
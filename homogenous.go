@@ -1,8 +1,10 @@
 package memdump
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"reflect"
@@ -10,21 +12,41 @@ import (
 
 // header is gob-encoded in the first segment
 type header struct {
-	Protocol   int32
-	Descriptor descriptor
+	Protocol    int32
+	Descriptor  descriptor
+	Types       []registeredType // Types contains the types that may be stored in interfaces
+	Arch        arch             // Arch is the architecture that the data was written on
+	Compression string           // Compression names the codec for data segments, if they are compressed
 }
 
 // Encoder writes memdumps to the provided writer
 type Encoder struct {
-	w io.Writer
-	t reflect.Type
+	w       *framedWriter
+	t       reflect.Type
+	buf     bytes.Buffer
+	types   *typeSnapshot
+	indexed bool
+	offsets []int64 // offsets contains the offset of each record in an indexed stream
+	closed  bool
+	zip     *compressor
 }
 
 // NewEncoder creates an Encoder that writes memdumps to the provided writer.
 // Each object passed to Encode must be of the same type.
 func NewEncoder(w io.Writer) *Encoder {
 	return &Encoder{
-		w: w,
+		w: newFramedWriter(w, 0),
+	}
+}
+
+// NewIndexedEncoder creates an Encoder that also records the offset of each
+// object, and writes them to the end of the output when Close is called. The
+// objects can then be read in any order with OpenIndexed, as well as in
+// sequence with Decoder.
+func NewIndexedEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w:       newFramedWriter(w, 0),
+		indexed: true,
 	}
 }
 
@@ -32,79 +54,226 @@ func NewEncoder(w io.Writer) *Encoder {
 // pointer to the object you wish to encode. (To encode a pointer, pass a
 // pointer to a pointer.)
 func (e *Encoder) Encode(obj interface{}) error {
-	t := reflect.TypeOf(obj)
-	if t.Kind() != reflect.Ptr {
-		panic(fmt.Sprintf("expected a pointer but got %T", obj))
+	err := e.begin(obj)
+	if err != nil {
+		return err
 	}
-	if e.t != nil && e.t != t {
-		panic(fmt.Sprintf("each call to Encode should pass the same type, but got %v then %v", e.t, t))
+	data, loc, err := e.encodeData(obj, &e.buf, e.zip)
+	if err != nil {
+		return err
 	}
+	return e.writeRecord(data, loc)
+}
 
+// begin checks the type of obj, and writes the header if nothing has been
+// encoded yet
+func (e *Encoder) begin(obj interface{}) error {
+	t, err := checkPointer(obj)
+	if err != nil {
+		return err
+	}
+	if !e.closed && e.t != nil && e.t != t {
+		return &InvalidArgumentError{Type: t, Expected: fmt.Sprintf("%v as in previous calls to Encode", e.t)}
+	}
+	return e.start(t)
+}
+
+// start writes the header for objects of type t, which must be the type of
+// the objects encoded so far, if nothing has been encoded yet
+func (e *Encoder) start(t reflect.Type) error {
+	if e.closed {
+		return errEncoderClosed
+	}
 	if e.t == nil {
+		desc, err := describe(t.Elem())
+		if err != nil {
+			return err
+		}
+
+		// write the magic number and protocol
+		protocol := framedHomogeneousProtocol
+		if e.indexed {
+			protocol = indexedProtocol
+		}
+		if e.w.checksums {
+			protocol |= checksumFlag
+		}
+		var compression string
+		if e.zip != nil {
+			protocol |= compressionFlag
+			compression = flateCompression
+		}
+		err = writePreamble(e.w, protocol)
+		if err != nil {
+			return fmt.Errorf("error writing protocol: %v", err)
+		}
+
 		// write the header
-		gob := gob.NewEncoder(e.w)
-		err := gob.Encode(header{
-			Protocol:   homogeneousProtocol,
-			Descriptor: describe(t.Elem()),
+		e.types = snapshotTypes(t.Elem())
+		e.buf.Reset()
+		gob := gob.NewEncoder(&e.buf)
+		err = gob.Encode(header{
+			Protocol:    protocol,
+			Descriptor:  desc,
+			Types:       e.types.table,
+			Arch:        nativeArch,
+			Compression: compression,
 		})
 		if err != nil {
-			return fmt.Errorf("error writing footer: %v", err)
+			return fmt.Errorf("error encoding header: %v", err)
+		}
+		err = e.w.WriteSegment(e.buf.Bytes())
+		if err != nil {
+			return fmt.Errorf("error writing header: %v", err)
 		}
 
 		e.t = t
-		_, err = e.w.Write(delim)
+	}
+	return nil
+}
+
+// encodeData encodes obj into buf, and compresses the result if zip is not
+// nil. The data that is returned is valid until buf or zip is next used.
+func (e *Encoder) encodeData(obj interface{}, buf *bytes.Buffer, zip *compressor) ([]byte, *locations, error) {
+	buf.Reset()
+	mem := newMemEncoder(buf)
+	mem.types = e.types
+	loc, err := mem.Encode(obj)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error encoding data segment: %w", err)
+	}
+	data := buf.Bytes()
+	if zip != nil {
+		data, err = zip.compress(data)
 		if err != nil {
-			return fmt.Errorf("error writing delimeter: %v", err)
+			return nil, nil, fmt.Errorf("error compressing data segment: %w", err)
 		}
 	}
+	return data, loc, nil
+}
 
-	// first segment: write the object data
-	mem := newMemEncoder(e.w)
-	ptrs, err := mem.Encode(obj)
+// writeRecord writes the data segment of an object, followed by the footer
+// containing its locations
+func (e *Encoder) writeRecord(data []byte, loc *locations) error {
+	if e.indexed {
+		e.offsets = append(e.offsets, e.w.offset)
+	}
+	err := e.w.WriteSegment(data)
 	if err != nil {
 		return fmt.Errorf("error writing data segment: %v", err)
 	}
 
-	// write delimiter
-	_, err = e.w.Write(delim)
+	// second segment: write the footer
+	e.buf.Reset()
+	err = encodeLocations(&e.buf, loc)
 	if err != nil {
-		return fmt.Errorf("error writing delimiter: %v", err)
+		return fmt.Errorf("error encoding footer: %v", err)
 	}
-
-	// second segment: write the footer
-	err = encodeLocations(e.w, &locations{Pointers: ptrs})
+	err = e.w.WriteSegment(e.buf.Bytes())
 	if err != nil {
 		return fmt.Errorf("error writing footer: %v", err)
 	}
+	return nil
+}
 
-	// write delimiter
-	_, err = e.w.Write(delim)
+// errEncoderStarted is returned when checksums or compression are enabled
+// after the protocol, which records whether they are used, has been written
+var errEncoderStarted = errors.New("memdump: checksums and compression must be enabled before the first call to Encode")
+
+// EnableChecksums causes a CRC-32C checksum to be written after each segment,
+// which decoders verify. It must be called before the first call to Encode.
+func (e *Encoder) EnableChecksums() error {
+	if e.t != nil {
+		return errEncoderStarted
+	}
+	e.w.checksums = true
+	return nil
+}
+
+// EnableCompression causes each data segment to be compressed with
+// compress/flate at the given level, such as flate.BestSpeed. Decoders
+// decompress the segments automatically. It must be called before the first
+// call to Encode.
+func (e *Encoder) EnableCompression(level int) error {
+	if e.t != nil {
+		return errEncoderStarted
+	}
+	zip, err := newCompressor(level)
 	if err != nil {
-		return fmt.Errorf("error writing delimiter: %v", err)
+		return err
 	}
+	e.zip = zip
 	return nil
 }
 
+// Close writes the index for an Encoder created by NewIndexedEncoder, and does
+// nothing for other encoders. It does not close the underlying writer. Encode
+// must not be called after Close.
+func (e *Encoder) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	if !e.indexed || e.t == nil {
+		return nil
+	}
+	return writeIndex(e.w, e.offsets)
+}
+
 // Decoder reads memdumps from the provided reader
 type Decoder struct {
-	dr *DelimitedReader
-	t  reflect.Type
+	r      *bufio.Reader
+	data   []byte // data contains the whole stream for decoders created by NewDecoderBytes
+	sr     segmentReader
+	t      reflect.Type
+	typ    reflect.Type // typ is the type passed to SetType or to the first call to Decode or DecodePtr
+	layout *layout
+	policy LayoutPolicy
+	n      int // n is the number of records read so far
+	scan   scanner
+
+	compressed bool
 }
 
 // NewDecoder creates a Decoder that reads memdumps
 func NewDecoder(r io.Reader) *Decoder {
 	return &Decoder{
-		dr: NewDelimitedReader(r),
+		r: bufio.NewReader(r),
 	}
 }
 
+// NewDecoderBytes creates a Decoder that reads memdumps from a stream held in
+// memory. Each object is relocated in place within data, which is only copied
+// if it is not suitably aligned or if the stream is compressed. The objects
+// returned by Decode refer to data, so data must not be modified or reused
+// while they are in use, and it cannot be decoded a second time.
+func NewDecoderBytes(data []byte) *Decoder {
+	return &Decoder{
+		r:    bufio.NewReader(bytes.NewReader(data)),
+		data: data,
+	}
+}
+
+// SetLayoutPolicy determines what happens when the objects in the stream were
+// written with a different layout than the type passed to Decode. It must be
+// called before the first call to Decode.
+func (d *Decoder) SetLayoutPolicy(policy LayoutPolicy) {
+	d.policy = policy
+}
+
+// SetType sets the type of the objects that Next decodes, for decoders that
+// are read with Next before any call to Decode or DecodePtr
+func (d *Decoder) SetType(t reflect.Type) {
+	d.typ = t
+}
+
 // Decode reads an object of the specified type from the input.
 // The object passed to Decode must be a pointer to the type
 // was originally passed to Encode().
 func (d *Decoder) Decode(dest interface{}) error {
-	t := reflect.TypeOf(dest)
-	if t.Kind() != reflect.Ptr {
-		panic(fmt.Sprintf("expected a pointer but got %T", dest))
+	t, err := checkPointer(dest)
+	if err != nil {
+		return err
 	}
 
 	ptr, err := d.DecodePtr(t.Elem())
@@ -115,52 +284,100 @@ func (d *Decoder) Decode(dest interface{}) error {
 	return nil
 }
 
+// readHeader reads the protocol and header, which tell us whether the segments
+// that follow are delimited (protocol 1) or length-prefixed (protocols 3 and 6).
+func (d *Decoder) readHeader() (*header, error) {
+	protocol, err := readPreamble(d.r)
+	if err == io.EOF {
+		// an encoder that was given no objects writes nothing
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading protocol: %v", err)
+	}
+	base, checksums, compressed := splitProtocol(protocol)
+	switch base {
+	case 0:
+		d.sr = NewDelimitedReader(d.r)
+	case framedHomogeneousProtocol, indexedProtocol:
+		d.sr = framedSegments(d.r, d.data, checksums)
+	default:
+		return nil, fmt.Errorf("invalid protocol %d", protocol)
+	}
+
+	seg, err := d.sr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("error reading header segment: %w", truncated(err))
+	}
+
+	var h header
+	dec := gob.NewDecoder(bytes.NewBuffer(seg))
+	err = dec.Decode(&h)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding header: %v", err)
+	}
+	err = checkCompression(compressed, &h)
+	if err != nil {
+		return nil, err
+	}
+	d.compressed = compressed
+	return &h, nil
+}
+
 // DecodePtr reads an object of the specified type from the input
 // and returns a pointer to it. The provided type must be the result
 // of calling reflect.TypeOf(x) where x is the object originally
 // passed to Encode(). The return valoue will be of type *x
 func (d *Decoder) DecodePtr(t reflect.Type) (interface{}, error) {
+	if t == nil {
+		return nil, &InvalidArgumentError{Expected: "a type"}
+	}
+	if d.typ == nil {
+		d.typ = t
+	}
 	if d.t != nil && d.t != t {
-		panic(fmt.Sprintf("each call to Encode should pass the same type, but got %v then %v", d.t, t))
+		return nil, &InvalidArgumentError{Type: t, Expected: fmt.Sprintf("%v as in previous calls to Decode", d.t)}
 	}
 
 	// read the header
 	if d.t == nil {
-		// decode the descriptor
-		seg, err := d.dr.Next()
+		header, err := d.readHeader()
 		if err != nil {
-			return nil, fmt.Errorf("error reading header segment: %v", err)
+			return nil, err
 		}
 
-		var header header
-		dec := gob.NewDecoder(bytes.NewBuffer(seg))
-		err = dec.Decode(&header)
+		// compare architectures and descriptors
+		err = checkArch(header.Arch)
 		if err != nil {
-			return nil, fmt.Errorf("error decoding header: %v", err)
+			return nil, err
 		}
-
-		// compare descriptors
-		expectedDescr := describe(t)
-		if !descriptorsEqual(expectedDescr, header.Descriptor) {
-			return nil, ErrIncompatibleLayout
+		d.layout, err = newLayout(d.policy, t, header.Descriptor, header.Types)
+		if err != nil {
+			return nil, err
 		}
 
 		d.t = t
 	}
 
 	// read the data
-	dataseg, err := d.dr.Next()
+	dataseg, err := d.sr.Next()
 	if len(dataseg) == 0 && err == io.EOF {
 		return nil, io.EOF
 	}
 	if err != nil {
-		return nil, fmt.Errorf("error reading data segment: %v", err)
+		return nil, segmentError("data segment", d.n, err)
 	}
 
 	// read the footer
-	footerseg, err := d.dr.Next()
+	footerseg, err := d.sr.Next()
 	if err != nil {
-		return nil, fmt.Errorf("error decoding footer: %v", err)
+		return nil, segmentError("footer segment", d.n, err)
+	}
+	d.n++
+	if d.compressed {
+		dataseg, err = decompress(dataseg)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// decode footer
@@ -171,5 +388,5 @@ func (d *Decoder) DecodePtr(t reflect.Type) (interface{}, error) {
 	}
 
 	// relocate the data
-	return relocate(dataseg, f.Pointers, f.Main, t)
+	return d.layout.decode(dataseg, f.Pointers, f.Main, t)
 }
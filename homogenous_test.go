@@ -3,7 +3,9 @@ package memdump
 import (
 	"bytes"
 	"io"
+	"reflect"
 	"testing"
+	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -40,3 +42,66 @@ func TestHomogenous_Struct(t *testing.T) {
 
 	assert.EqualValues(t, src, dest)
 }
+
+func TestHomogenous_TypeChange(t *testing.T) {
+	x, y := 1, "abc"
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	require.NoError(t, enc.Encode(&x))
+	err := enc.Encode(&y)
+	assert.EqualError(t, err, "memdump: expected *int as in previous calls to Encode but got *string")
+	assert.IsType(t, &InvalidArgumentError{}, enc.Encode(x))
+
+	var dx int
+	var dy string
+	dec := NewDecoder(&b)
+	require.NoError(t, dec.Decode(&dx))
+	assert.Equal(t, x, dx)
+	assert.IsType(t, &InvalidArgumentError{}, dec.Decode(&dy))
+	assert.IsType(t, &InvalidArgumentError{}, dec.Decode(dx))
+}
+
+func TestHomogenous_Unsupported(t *testing.T) {
+	type T struct {
+		Ch chan int
+	}
+	var b bytes.Buffer
+	err := NewEncoder(&b).Encode(&T{})
+	assert.IsType(t, &UnsupportedTypeError{}, err)
+	assert.Zero(t, b.Len())
+
+	// decoders check the type before comparing layouts
+	require.NoError(t, NewEncoder(&b).Encode(&struct{ Ch uintptr }{}))
+	var dest T
+	err = NewDecoder(&b).Decode(&dest)
+	assert.IsType(t, &UnsupportedTypeError{}, err)
+}
+
+func TestHomogenous_DecoderBytes(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	require.NoError(t, enc.EnableChecksums())
+	require.NoError(t, enc.Encode(&recordV1{ID: 1, Name: "abc"}))
+	require.NoError(t, enc.Encode(&recordV1{ID: 2, Name: "def"}))
+	buf := b.Bytes()
+
+	dec := NewDecoderBytes(buf)
+	for i := 1; i <= 2; i++ {
+		ptr, err := dec.DecodePtr(reflect.TypeOf(recordV1{}))
+		require.NoError(t, err)
+		rec := ptr.(*recordV1)
+		assert.Equal(t, i, rec.ID)
+		assert.True(t, within(unsafe.Pointer(rec), buf))
+	}
+	var dest recordV1
+	assert.Equal(t, io.EOF, dec.Decode(&dest))
+}
+
+func TestHomogenous_DecoderBytesTruncated(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, NewEncoder(&b).Encode(&recordV1{ID: 1, Name: "abc"}))
+
+	dec := NewDecoderBytes(b.Bytes()[:b.Len()-3])
+	var dest recordV1
+	assert.Error(t, dec.Decode(&dest))
+}
@@ -0,0 +1,260 @@
+package memdump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// An indexed stream is a homogeneous stream with length-prefixed segments,
+// followed by an end marker, then a segment containing the offset of each
+// record as a little-endian uint64, then a fixed-size trailer:
+//
+//	offset of the index segment (uint64)
+//	number of records (uint64)
+//	indexMagic
+
+// indexMagic ends every indexed stream
+var indexMagic = []byte{'m', 'e', 'm', 'i', 'n', 'd', 'e', 'x'}
+
+// indexTrailerSize is the size of the trailer at the end of an indexed stream
+const indexTrailerSize = 24
+
+var errEncoderClosed = errors.New("memdump: Encode called after Close")
+
+// writeIndex writes the end marker, the index segment, and the trailer
+func writeIndex(w *framedWriter, offsets []int64) error {
+	err := w.WriteEnd()
+	if err != nil {
+		return fmt.Errorf("error writing end marker: %v", err)
+	}
+
+	pos := w.offset
+	index := make([]byte, 8*len(offsets))
+	for i, off := range offsets {
+		binary.LittleEndian.PutUint64(index[8*i:], uint64(off))
+	}
+	err = w.WriteSegment(index)
+	if err != nil {
+		return fmt.Errorf("error writing index: %v", err)
+	}
+
+	trailer := make([]byte, indexTrailerSize)
+	binary.LittleEndian.PutUint64(trailer, uint64(pos))
+	binary.LittleEndian.PutUint64(trailer[8:], uint64(len(offsets)))
+	copy(trailer[16:], indexMagic)
+	_, err = w.Write(trailer)
+	if err != nil {
+		return fmt.Errorf("error writing index trailer: %v", err)
+	}
+	return nil
+}
+
+// IndexedReader reads individual objects from a stream written by an Encoder
+// created with NewIndexedEncoder, without reading the objects before them.
+// Get may be called from multiple goroutines at once.
+type IndexedReader struct {
+	r          io.ReaderAt
+	header     header
+	offsets    []int64
+	end        int64 // end is the offset of the end marker
+	checksums  bool
+	compressed bool
+	policy     LayoutPolicy
+
+	mu     sync.Mutex
+	t      reflect.Type
+	layout *layout
+}
+
+// OpenIndexed reads the header and index of a stream of the given size in
+// bytes that was written by an Encoder created with NewIndexedEncoder.
+func OpenIndexed(r io.ReaderAt, size int64) (*IndexedReader, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("invalid size %d", size)
+	}
+
+	// an indexed encoder that was closed without encoding anything writes
+	// nothing at all
+	ir := IndexedReader{r: r}
+	if size == 0 {
+		return &ir, nil
+	}
+
+	// read the protocol and header
+	br := bufio.NewReader(io.NewSectionReader(r, 0, size))
+	protocol, err := readPreamble(br)
+	if err != nil {
+		return nil, fmt.Errorf("error reading protocol: %v", err)
+	}
+	var base int32
+	base, ir.checksums, ir.compressed = splitProtocol(protocol)
+	if base != indexedProtocol {
+		return nil, fmt.Errorf("stream has no index (protocol %d)", protocol)
+	}
+	fr := newFramedReader(br, preambleSize)
+	fr.checksums = ir.checksums
+	seg, err := fr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("error reading header segment: %w", truncated(err))
+	}
+	err = gob.NewDecoder(bytes.NewBuffer(seg)).Decode(&ir.header)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding header: %v", err)
+	}
+	err = checkArch(ir.header.Arch)
+	if err != nil {
+		return nil, err
+	}
+	err = checkCompression(ir.compressed, &ir.header)
+	if err != nil {
+		return nil, err
+	}
+
+	ir.offsets, ir.end, err = readIndex(r, size, ir.checksums)
+	if err != nil {
+		return nil, err
+	}
+	return &ir, nil
+}
+
+// readIndex reads the trailer and then the index of an indexed stream, and
+// returns the offset of each object and of the end marker
+func readIndex(r io.ReaderAt, size int64, checksums bool) ([]int64, int64, error) {
+	if size < preambleSize+indexTrailerSize {
+		return nil, 0, fmt.Errorf("stream is too short to contain an index")
+	}
+	trailer := make([]byte, indexTrailerSize)
+	_, err := r.ReadAt(trailer, size-indexTrailerSize)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading index trailer: %v", err)
+	}
+	if !bytes.Equal(trailer[16:], indexMagic) {
+		return nil, 0, fmt.Errorf("stream is missing its index trailer (was the encoder closed?)")
+	}
+	pos := binary.LittleEndian.Uint64(trailer)
+	count := binary.LittleEndian.Uint64(trailer[8:])
+	if pos < preambleSize+8 || pos > uint64(size-indexTrailerSize) {
+		return nil, 0, fmt.Errorf("index offset %d is out of range", pos)
+	}
+
+	end := int64(pos) - 8
+	fr := newFramedReader(io.NewSectionReader(r, int64(pos), size-indexTrailerSize-int64(pos)), int64(pos))
+	fr.checksums = checksums
+	index, err := fr.Next()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading index: %w", err)
+	}
+	if len(index)%8 != 0 || uint64(len(index)/8) != count {
+		return nil, 0, fmt.Errorf("index is %d bytes but should contain %d offsets", len(index), count)
+	}
+	offsets := make([]int64, count)
+	for i := range offsets {
+		off := binary.LittleEndian.Uint64(index[8*i:])
+		if off < preambleSize || off >= uint64(end) {
+			return nil, 0, fmt.Errorf("offset %d of object %d is out of range", off, i)
+		}
+		offsets[i] = int64(off)
+	}
+	return offsets, end, nil
+}
+
+// SetLayoutPolicy determines what happens when the objects in the stream were
+// written with a different layout than the type passed to Get. It must be
+// called before the first call to Get.
+func (r *IndexedReader) SetLayoutPolicy(policy LayoutPolicy) {
+	r.policy = policy
+}
+
+// Len gets the number of objects in the stream
+func (r *IndexedReader) Len() int {
+	return len(r.offsets)
+}
+
+// Get reads the object with index i, counting from zero, into dest, which
+// must be a pointer to the type that was originally passed to Encode.
+func (r *IndexedReader) Get(i int, dest interface{}) error {
+	t, err := checkPointer(dest)
+	if err != nil {
+		return err
+	}
+
+	ptr, err := r.GetPtr(i, t.Elem())
+	if err != nil {
+		return err
+	}
+	reflect.ValueOf(dest).Elem().Set(reflect.ValueOf(ptr).Elem())
+	return nil
+}
+
+// GetPtr reads the object with index i, counting from zero, and returns a
+// pointer to it. The provided type must be the type of the objects originally
+// passed to Encode.
+func (r *IndexedReader) GetPtr(i int, t reflect.Type) (interface{}, error) {
+	if t == nil {
+		return nil, &InvalidArgumentError{Expected: "a type"}
+	}
+	if i < 0 || i >= len(r.offsets) {
+		return nil, fmt.Errorf("index %d is out of range for a stream of %d objects", i, len(r.offsets))
+	}
+	layout, err := r.layoutFor(t)
+	if err != nil {
+		return nil, err
+	}
+
+	// read the data and footer, which lie before the next object
+	off, end := r.offsets[i], r.end
+	if i+1 < len(r.offsets) {
+		end = r.offsets[i+1]
+	}
+	if end < off {
+		return nil, fmt.Errorf("object %d overlaps the next object", i)
+	}
+	fr := newFramedReader(io.NewSectionReader(r.r, off, end-off), off)
+	fr.checksums = r.checksums
+	dataseg, err := fr.Next()
+	if err != nil {
+		return nil, segmentError("data segment", i, err)
+	}
+	footerseg, err := fr.Next()
+	if err != nil {
+		return nil, segmentError("footer segment", i, err)
+	}
+	if r.compressed {
+		dataseg, err = decompress(dataseg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var f locations
+	err = decodeLocations(bytes.NewBuffer(footerseg), &f)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding footer: %v", err)
+	}
+	return layout.decode(dataseg, f.Pointers, f.Main, t)
+}
+
+// layoutFor compares t with the descriptor in the header the first time it is
+// called, and checks that t is the same type on later calls
+func (r *IndexedReader) layoutFor(t reflect.Type) (*layout, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.t == nil {
+		l, err := newLayout(r.policy, t, r.header.Descriptor, r.header.Types)
+		if err != nil {
+			return nil, err
+		}
+		r.t, r.layout = t, l
+	}
+	if r.t != t {
+		return nil, &InvalidArgumentError{Type: t, Expected: fmt.Sprintf("%v as in previous calls to Get", r.t)}
+	}
+	return r.layout, nil
+}
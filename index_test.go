@@ -0,0 +1,201 @@
+package memdump
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeIndexed(t *testing.T, n int) []byte {
+	var b bytes.Buffer
+	enc := NewIndexedEncoder(&b)
+	for i := 0; i < n; i++ {
+		require.NoError(t, enc.Encode(&recordV1{ID: i, Name: strings.Repeat("x", i%7)}))
+	}
+	require.NoError(t, enc.Close())
+	return b.Bytes()
+}
+
+// openIndexedFile opens the indexed stream in f
+func openIndexedFile(t *testing.T, f *os.File) (*IndexedReader, error) {
+	info, err := f.Stat()
+	require.NoError(t, err)
+	return OpenIndexed(f, info.Size())
+}
+
+func TestIndexed_Get(t *testing.T) {
+	buf := writeIndexed(t, 100)
+	r, err := OpenIndexed(bytes.NewReader(buf), int64(len(buf)))
+	require.NoError(t, err)
+	require.Equal(t, 100, r.Len())
+
+	for _, i := range []int{57, 0, 99, 3, 57} {
+		var dest recordV1
+		require.NoError(t, r.Get(i, &dest))
+		assert.Equal(t, recordV1{ID: i, Name: strings.Repeat("x", i%7)}, dest)
+	}
+
+	var dest recordV1
+	assert.Error(t, r.Get(100, &dest))
+	assert.Error(t, r.Get(-1, &dest))
+	assert.IsType(t, &InvalidArgumentError{}, r.Get(0, &struct{ X int }{}))
+}
+
+func TestIndexed_Sequential(t *testing.T) {
+	dec := NewDecoder(bytes.NewReader(writeIndexed(t, 3)))
+	for i := 0; i < 3; i++ {
+		var dest recordV1
+		require.NoError(t, dec.Decode(&dest))
+		assert.Equal(t, i, dest.ID)
+	}
+	var dest recordV1
+	assert.Equal(t, io.EOF, dec.Decode(&dest))
+	assert.Equal(t, io.EOF, dec.Decode(&dest))
+}
+
+func TestIndexed_Concurrent(t *testing.T) {
+	buf := writeIndexed(t, 50)
+	r, err := OpenIndexed(bytes.NewReader(buf), int64(len(buf)))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	errs := make([]error, r.Len())
+	for i := 0; i < r.Len(); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var dest recordV1
+			errs[i] = r.Get(i, &dest)
+			if errs[i] == nil && dest.ID != i {
+				errs[i] = fmt.Errorf("got record %d at index %d", dest.ID, i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+}
+
+func TestIndexed_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.memdump")
+	require.NoError(t, os.WriteFile(path, writeIndexed(t, 10), 0644))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	r, err := openIndexedFile(t, f)
+	require.NoError(t, err)
+	require.Equal(t, 10, r.Len())
+	var dest recordV1
+	require.NoError(t, r.Get(9, &dest))
+	assert.Equal(t, 9, dest.ID)
+}
+
+func TestIndexed_Empty(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewIndexedEncoder(&b)
+	require.NoError(t, enc.Close())
+	assert.Zero(t, b.Len())
+
+	r, err := OpenIndexed(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	require.NoError(t, err)
+	assert.Equal(t, 0, r.Len())
+}
+
+func TestIndexed_EncodeAfterClose(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewIndexedEncoder(&b)
+	require.NoError(t, enc.Encode(&recordV1{ID: 1}))
+	require.NoError(t, enc.Close())
+	assert.Error(t, enc.Encode(&recordV1{ID: 2}))
+}
+
+func TestIndexed_NoIndex(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, NewEncoder(&b).Encode(&recordV1{ID: 1}))
+	_, err := OpenIndexed(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	assert.Error(t, err)
+
+	// the index is missing if the encoder was not closed
+	b.Reset()
+	require.NoError(t, NewIndexedEncoder(&b).Encode(&recordV1{ID: 1}))
+	_, err = OpenIndexed(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	assert.Error(t, err)
+
+	_, err = OpenIndexed(strings.NewReader("x"), 1)
+	assert.Error(t, err)
+}
+
+func TestIndexed_Size(t *testing.T) {
+	// the size need not be available from the reader itself
+	type readerAt struct{ io.ReaderAt }
+	buf := writeIndexed(t, 3)
+	r, err := OpenIndexed(readerAt{bytes.NewReader(buf)}, int64(len(buf)))
+	require.NoError(t, err)
+	assert.Equal(t, 3, r.Len())
+
+	// the stream may be followed by other data
+	r, err = OpenIndexed(bytes.NewReader(append(buf, "trailing"...)), int64(len(buf)))
+	require.NoError(t, err)
+	assert.Equal(t, 3, r.Len())
+
+	_, err = OpenIndexed(bytes.NewReader(buf), int64(len(buf))-1)
+	assert.Error(t, err)
+	_, err = OpenIndexed(bytes.NewReader(buf), -1)
+	assert.Error(t, err)
+}
+
+func TestIndexed_Corrupt(t *testing.T) {
+	buf := writeIndexed(t, 5)
+	corrupt := append([]byte(nil), buf...)
+	corrupt[len(corrupt)-indexTrailerSize] ^= 0xff
+	_, err := OpenIndexed(bytes.NewReader(corrupt), int64(len(corrupt)))
+	assert.Error(t, err)
+
+	corrupt = append([]byte(nil), buf...)
+	corrupt[len(corrupt)-indexTrailerSize+8]++
+	_, err = OpenIndexed(bytes.NewReader(corrupt), int64(len(corrupt)))
+	assert.Error(t, err)
+}
+
+func TestIndexed_Transcoded(t *testing.T) {
+	native := transcodeVia(t, bytes.NewReader(writeIndexed(t, 20)), "386")
+	r, err := OpenIndexed(bytes.NewReader(native.Bytes()), int64(native.Len()))
+	require.NoError(t, err)
+	require.Equal(t, 20, r.Len())
+
+	var dest recordV1
+	require.NoError(t, r.Get(13, &dest))
+	assert.Equal(t, recordV1{ID: 13, Name: "xxxxxx"}, dest)
+}
+
+func TestIndexed_Checksum(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewIndexedEncoder(&b)
+	require.NoError(t, enc.EnableChecksums())
+	for _, name := range []string{"first", "second", "third"} {
+		require.NoError(t, enc.Encode(&recordV1{Name: name}))
+	}
+	require.NoError(t, enc.Close())
+
+	corrupt := bytes.Replace(b.Bytes(), []byte("second"), []byte("secoNd"), 1)
+	r, err := OpenIndexed(bytes.NewReader(corrupt), int64(len(corrupt)))
+	require.NoError(t, err)
+	var dest recordV1
+	require.NoError(t, r.Get(2, &dest))
+	assert.Equal(t, "third", dest.Name)
+	err = r.Get(1, &dest)
+	assert.True(t, errors.Is(err, ErrCorrupt))
+	assert.Contains(t, err.Error(), "record 1")
+}
@@ -0,0 +1,165 @@
+package memdump
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+)
+
+// StreamInfo summarizes the contents of a stream, as reported by Inspect
+type StreamInfo struct {
+	Protocol int32        // Protocol is the protocol number of the stream, apart from Checksum
+	Format   string       // Format is "single", "homogeneous", "indexed", or "heterogeneous"
+	Checksum bool         // Checksum is set if each segment is followed by its checksum
+	Compress string       // Compress names the codec for data segments, if they are compressed
+	Arch     string       // Arch is the architecture the data was written on, if recorded
+	Layout   string       // Layout describes the type of every object in a homogeneous or single-object stream
+	Types    []string     // Types contains the names of types that may be stored in interfaces
+	Table    []TypeInfo   // Table contains the type table of a heterogeneous stream that has one
+	Records  []RecordInfo // Records contains one entry for each object in the stream
+}
+
+// TypeInfo describes one entry in the type table of a heterogeneous stream
+type TypeInfo struct {
+	Name   string // Name is the name recorded for the type, if any
+	Layout string // Layout describes the type
+}
+
+// RecordInfo summarizes one object in a stream
+type RecordInfo struct {
+	DataSize int    // DataSize is the size of the data segment in bytes, after decompression
+	Pointers int    // Pointers is the number of pointers in the data segment
+	Main     int64  // Main is the offset of the object within the data segment
+	Layout   string // Layout describes the type of the object in a heterogeneous stream without a type table
+	Type     string // Type is the name recorded for the type of the object in a heterogeneous stream, if any
+	TypeID   int    // TypeID is the index in StreamInfo.Table of the type of the object, if the stream has a type table
+}
+
+// Inspect reads the headers and footers in a stream written by Encode, Encoder,
+// or HeterogeneousEncoder, without needing to know the type of the objects in
+// it. Files written by Encode before protocol 5 have no header, so they cannot
+// be inspected.
+func Inspect(r io.Reader) (*StreamInfo, error) {
+	s, err := openRawStream(r)
+	if err != nil {
+		return nil, err
+	}
+
+	info := StreamInfo{
+		Protocol: s.protocol,
+		Format:   s.format(),
+		Checksum: s.checksums,
+		Compress: s.header.Compression,
+		Types:    typeNames(nil, s.header.Types),
+	}
+	if s.header.Arch.WordSize != 0 {
+		info.Arch = s.header.Arch.String()
+	}
+	if s.header.Descriptor != nil {
+		info.Layout = s.header.Descriptor.format()
+	}
+
+	for {
+		rec, err := s.next()
+		if err == io.EOF {
+			return &info, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading record %d: %w", len(info.Records), err)
+		}
+
+		ri := RecordInfo{
+			DataSize: len(rec.data),
+			Pointers: len(rec.loc.Pointers),
+			Main:     rec.loc.Main,
+		}
+		// a stream with a type table describes each type once, however many
+		// records refer to it
+		if rec.newType {
+			info.Table = append(info.Table, TypeInfo{Name: rec.name, Layout: rec.desc.format()})
+			info.Types = typeNames(info.Types, rec.types)
+		}
+		if s.protocol == tabledHeterogeneousProtocol {
+			ri.Type, ri.TypeID = rec.name, rec.typeID
+		} else if s.heterogeneous() {
+			ri.Layout = rec.desc.format()
+			info.Types = typeNames(info.Types, rec.types)
+		}
+		info.Records = append(info.Records, ri)
+	}
+}
+
+// typeNames adds the names in a table of registered types to names, skipping
+// any that are already present
+func typeNames(names []string, table []registeredType) []string {
+outer:
+	for _, entry := range table {
+		for _, name := range names {
+			if name == entry.Name {
+				continue outer
+			}
+		}
+		names = append(names, entry.Name)
+	}
+	return names
+}
+
+// format renders the descriptor as Go-like declarations. Structs are named
+// T0, T1, ... after their index in the descriptor.
+func (d descriptor) format() string {
+	if err := d.check(); err != nil {
+		return fmt.Sprintf("invalid descriptor: %v", err)
+	}
+
+	var b strings.Builder
+	if d[0].Kind != reflect.Struct {
+		fmt.Fprintf(&b, "%s // %d bytes\n", d.typeString(0, nil), d[0].Size)
+	}
+	for i, t := range d {
+		if t.Kind != reflect.Struct {
+			continue
+		}
+		fmt.Fprintf(&b, "type T%d struct { // %d bytes\n", i, t.Size)
+		w := tabwriter.NewWriter(&b, 0, 4, 1, ' ', 0)
+		for _, f := range t.Fields {
+			fmt.Fprintf(w, "    %s\t%s\t// offset %d\n", f.Name, d.typeString(f.Type, nil), f.Offset)
+		}
+		w.Flush()
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// typeString renders the type at index id as a Go type expression. Types that
+// refer to themselves other than through a struct are rendered as #id.
+func (d descriptor) typeString(id int, visiting []int) string {
+	for _, v := range visiting {
+		if v == id {
+			return fmt.Sprintf("#%d", id)
+		}
+	}
+	visiting = append(visiting, id)
+
+	t := d[id]
+	switch t.Kind {
+	case reflect.Struct:
+		return fmt.Sprintf("T%d", id)
+	case reflect.Ptr:
+		return "*" + d.typeString(t.Elem, visiting)
+	case reflect.Slice:
+		return "[]" + d.typeString(t.Elem, visiting)
+	case reflect.Array:
+		var n uintptr
+		if d[t.Elem].Size > 0 {
+			n = t.Size / d[t.Elem].Size
+		}
+		return fmt.Sprintf("[%d]%s", n, d.typeString(t.Elem, visiting))
+	case reflect.Map:
+		return fmt.Sprintf("map[%s]%s", d.typeString(t.Key, visiting), d.typeString(t.Elem, visiting))
+	case reflect.Interface:
+		return "interface"
+	default:
+		return t.Kind.String()
+	}
+}
@@ -0,0 +1,98 @@
+package memdump
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspect_Single(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &recordV1{ID: 1, Name: "abc"}))
+
+	info, err := Inspect(&b)
+	require.NoError(t, err)
+	assert.Equal(t, singleProtocol, info.Protocol)
+	assert.Equal(t, "single", info.Format)
+	assert.Equal(t, nativeArch.String(), info.Arch)
+	assert.Contains(t, info.Layout, "type T0 struct")
+	assert.Contains(t, info.Layout, "Name  string")
+	require.Len(t, info.Records, 1)
+	assert.Equal(t, 1, info.Records[0].Pointers)
+}
+
+func TestInspect_Homogeneous(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	require.NoError(t, enc.Encode(&recordV1{ID: 1, Name: "abc"}))
+	require.NoError(t, enc.Encode(&recordV1{ID: 2}))
+
+	info, err := Inspect(&b)
+	require.NoError(t, err)
+	assert.Equal(t, "homogeneous", info.Format)
+	require.Len(t, info.Records, 2)
+	assert.Equal(t, 1, info.Records[0].Pointers)
+	assert.Equal(t, 0, info.Records[1].Pointers)
+}
+
+func TestInspect_Indexed(t *testing.T) {
+	info, err := Inspect(bytes.NewReader(writeIndexed(t, 3)))
+	require.NoError(t, err)
+	assert.Equal(t, indexedProtocol, info.Protocol)
+	assert.Equal(t, "indexed", info.Format)
+	assert.Len(t, info.Records, 3)
+}
+
+func TestInspect_Heterogeneous(t *testing.T) {
+	x, s := 3, "abc"
+	var b bytes.Buffer
+	enc := NewHeterogeneousEncoder(&b)
+	require.NoError(t, enc.Encode(&x))
+	require.NoError(t, enc.Encode(&s))
+	require.NoError(t, enc.Encode(&x))
+
+	info, err := Inspect(&b)
+	require.NoError(t, err)
+	assert.Equal(t, "heterogeneous", info.Format)
+	assert.Empty(t, info.Layout)
+	require.Len(t, info.Table, 2)
+	assert.Equal(t, fmt.Sprintf("int // %d bytes\n", uintptrSize), info.Table[0].Layout)
+	assert.Equal(t, fmt.Sprintf("string // %d bytes\n", 2*uintptrSize), info.Table[1].Layout)
+	require.Len(t, info.Records, 3)
+	assert.Equal(t, 0, info.Records[0].TypeID)
+	assert.Equal(t, 1, info.Records[1].TypeID)
+	assert.Equal(t, 0, info.Records[2].TypeID)
+	assert.Empty(t, info.Records[2].Layout)
+}
+
+func TestInspect_Legacy(t *testing.T) {
+	info, err := Inspect(bytes.NewReader(readLegacy(t, "legacy_heterogeneous.memdump")))
+	require.NoError(t, err)
+	assert.Equal(t, heterogeneousProtocol, info.Protocol)
+	assert.Len(t, info.Records, 2)
+
+	info, err = Inspect(bytes.NewReader(readLegacy(t, "legacy_homogeneous.memdump")))
+	require.NoError(t, err)
+	assert.Equal(t, homogeneousProtocol, info.Protocol)
+	assert.Empty(t, info.Arch)
+	assert.Len(t, info.Records, 2)
+}
+
+func TestFormatDescriptor(t *testing.T) {
+	type T struct {
+		Xs   []*T
+		M    map[string][2]int32
+		Rest interface{}
+	}
+	expected := fmt.Sprintf(`type T0 struct { // %d bytes
+    Xs   []*T0               // offset 0
+    M    map[string][2]int32 // offset %d
+    Rest interface           // offset %d
+}
+`, 6*uintptrSize, 3*uintptrSize, 4*uintptrSize)
+	assert.Equal(t, expected, mustDescribe(t, reflect.TypeOf(T{})).format())
+}
@@ -0,0 +1,420 @@
+package memdump
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ToJSON writes the objects in a stream written by Encode, Encoder, or
+// HeterogeneousEncoder as JSON, using the layout recorded in the stream rather
+// than the Go types that they were written from. Each object is written as a
+// separate JSON document on its own line. Structs become objects keyed by the
+// name (or memdump tag) of each field, including unexported fields, and other
+// values are written as encoding/json would write them, except that maps whose
+// keys are not strings or integers become arrays of {"key": ..., "value": ...}
+// objects, and a pointer to a value that has already been written, or that
+// encloses the current value, becomes {"$ref": "#/path"}, where the path is a
+// JSON pointer to that value within the document.
+func ToJSON(r io.Reader, w io.Writer) error {
+	s, err := openRawStream(r)
+	if err != nil {
+		return err
+	}
+	from := s.header.Arch.resolve()
+	if from.WordSize != 4 && from.WordSize != 8 {
+		return fmt.Errorf("invalid word size %d", from.WordSize)
+	}
+
+	bw := bufio.NewWriter(w)
+	for i := 0; ; i++ {
+		rec, err := s.next()
+		if err == io.EOF {
+			return bw.Flush()
+		} else if err != nil {
+			return fmt.Errorf("error reading record %d: %v", i, err)
+		}
+
+		err = writeJSON(bw, rec, from)
+		if err != nil {
+			return fmt.Errorf("error converting record %d: %v", i, err)
+		}
+		bw.WriteByte('\n')
+	}
+}
+
+// jsonKey identifies a value that a pointer, slice, map, or interface refers to
+type jsonKey struct {
+	kind regionKind
+	off  int64
+	ref  typeRef
+	n    int64 // n is the length of a slice, or -1 for a single value
+}
+
+// jsonWriter writes the objects in a buffer produced by memEncoder as JSON
+type jsonWriter struct {
+	rawData
+	w       *bufio.Writer
+	descs   []descriptor
+	path    []string           // path contains the JSON pointer segments of the current value
+	written map[jsonKey]string // written contains the JSON pointer of each value that has been or is being written
+}
+
+// writeJSON writes a record as a single JSON document
+func writeJSON(w *bufio.Writer, rec *rawRecord, a arch) error {
+	descs := []descriptor{rec.desc}
+	for _, entry := range rec.types {
+		descs = append(descs, entry.Descriptor)
+	}
+	for _, d := range descs {
+		err := d.check()
+		if err == nil {
+			err = d.checkSizes(a.WordSize)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid descriptor: %v", err)
+		}
+	}
+
+	data, err := newRawData(rec.data, rec.loc.Pointers, a)
+	if err != nil {
+		return err
+	}
+	j := jsonWriter{
+		rawData: data,
+		w:       w,
+		descs:   descs,
+		written: make(map[jsonKey]string),
+	}
+	// the root encloses everything, so pointers back to it are written as
+	// references
+	return j.enter(jsonKey{kind: valueRegion, off: rec.loc.Main, ref: typeRef{}, n: -1}, func() error {
+		return j.value(rec.loc.Main, typeRef{})
+	})
+}
+
+// enter writes the value that a pointer refers to, or a reference to it if it
+// has already been written or encloses the current value, so that shared
+// values are written only once
+func (j *jsonWriter) enter(key jsonKey, write func() error) error {
+	if ptr, found := j.written[key]; found {
+		j.w.WriteString(`{"$ref":`)
+		j.str(ptr)
+		j.w.WriteByte('}')
+		return nil
+	}
+	j.written[key] = jsonPointer(j.path)
+	return write()
+}
+
+// jsonPointer formats a path as a JSON pointer (RFC 6901) fragment
+func jsonPointer(path []string) string {
+	var b strings.Builder
+	b.WriteString("#")
+	for _, seg := range path {
+		b.WriteString("/")
+		b.WriteString(strings.ReplaceAll(strings.ReplaceAll(seg, "~", "~0"), "/", "~1"))
+	}
+	return b.String()
+}
+
+// str writes a JSON string
+func (j *jsonWriter) str(s string) {
+	buf, _ := json.Marshal(s)
+	j.w.Write(buf)
+}
+
+// float writes a floating point number, or a string for values that JSON
+// cannot represent
+func (j *jsonWriter) float(v interface{}, f float64, bits int) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		j.str(strconv.FormatFloat(f, 'g', -1, bits))
+		return
+	}
+	j.w.Write(buf)
+}
+
+// signed reads a signed integer of the given size
+func (j *jsonWriter) signed(off int64, size uintptr) int64 {
+	v := j.getUint(off, size)
+	shift := 64 - 8*size
+	return int64(v<<shift) >> shift
+}
+
+// value writes the object at off, which was stored with the type ref
+func (j *jsonWriter) value(off int64, ref typeRef) error {
+	d := j.descs[ref.desc]
+	t := d[ref.id]
+	if !j.inRange(off, 1, t.Size) {
+		return fmt.Errorf("%v at offset %d is outside buffer of length %d", t.Kind, off, len(j.buf))
+	}
+	word := int64(j.arch.WordSize)
+	elem := typeRef{desc: ref.desc, id: t.Elem}
+
+	switch t.Kind {
+	case reflect.Struct:
+		j.w.WriteByte('{')
+		for i, f := range t.Fields {
+			if i > 0 {
+				j.w.WriteByte(',')
+			}
+			j.str(f.Name)
+			j.w.WriteByte(':')
+			j.path = append(j.path, f.Name)
+			err := j.value(off+int64(f.Offset), typeRef{desc: ref.desc, id: f.Type})
+			j.path = j.path[:len(j.path)-1]
+			if err != nil {
+				return err
+			}
+		}
+		j.w.WriteByte('}')
+	case reflect.Array:
+		var n int64
+		if d[t.Elem].Size > 0 {
+			n = int64(t.Size / d[t.Elem].Size)
+		}
+		return j.array(off, elem, n)
+	case reflect.Bool:
+		j.w.WriteString(strconv.FormatBool(j.buf[off] != 0))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		j.w.WriteString(strconv.FormatInt(j.signed(off, t.Size), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		j.w.WriteString(strconv.FormatUint(j.getUint(off, t.Size), 10))
+	case reflect.Float32:
+		f := math.Float32frombits(uint32(j.getUint(off, 4)))
+		j.float(f, float64(f), 32)
+	case reflect.Float64:
+		f := math.Float64frombits(j.getUint(off, 8))
+		j.float(f, f, 64)
+	case reflect.Complex64, reflect.Complex128:
+		half := t.Size / 2
+		j.w.WriteByte('[')
+		for i := uintptr(0); i < 2; i++ {
+			if i > 0 {
+				j.w.WriteByte(',')
+			}
+			if half == 4 {
+				f := math.Float32frombits(uint32(j.getUint(off+int64(i*half), 4)))
+				j.float(f, float64(f), 32)
+			} else {
+				f := math.Float64frombits(j.getUint(off+int64(i*half), 8))
+				j.float(f, f, 64)
+			}
+		}
+		j.w.WriteByte(']')
+	case reflect.String:
+		p, ok, err := j.pointer(off)
+		if err != nil {
+			return err
+		}
+		n := int64(j.word(off + word))
+		if !ok {
+			n = 0
+		} else if !j.inRange(p, n, 1) {
+			return fmt.Errorf("string at offset %d refers to %d bytes at offset %d, outside buffer of length %d",
+				off, n, p, len(j.buf))
+		}
+		j.str(string(j.buf[p : p+n]))
+	case reflect.Slice:
+		p, ok, err := j.pointer(off)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			j.w.WriteString("null")
+			return nil
+		}
+		n := int64(j.word(off + word))
+		if !j.inRange(p, n, d[t.Elem].Size) {
+			return fmt.Errorf("slice at offset %d refers to %d elements at offset %d, outside buffer of length %d",
+				off, n, p, len(j.buf))
+		}
+		if e := d[t.Elem]; e.Kind == reflect.Uint8 {
+			// encoding/json writes byte slices as base64 strings
+			j.str(base64.StdEncoding.EncodeToString(j.buf[p : p+n]))
+			return nil
+		}
+		return j.enter(jsonKey{kind: valueRegion, off: p, ref: elem, n: n}, func() error {
+			return j.array(p, elem, n)
+		})
+	case reflect.Ptr:
+		p, ok, err := j.pointer(off)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			j.w.WriteString("null")
+			return nil
+		}
+		return j.enter(jsonKey{kind: valueRegion, off: p, ref: elem, n: -1}, func() error {
+			return j.value(p, elem)
+		})
+	case reflect.Map:
+		p, ok, err := j.pointer(off)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			j.w.WriteString("null")
+			return nil
+		}
+		return j.enter(jsonKey{kind: entriesHeader, off: p, ref: ref, n: -1}, func() error {
+			return j.mapValue(p, ref)
+		})
+	case reflect.Interface:
+		id := j.word(off)
+		if id == 0 {
+			j.w.WriteString("null")
+			return nil
+		}
+		if id >= uint64(len(j.descs)) {
+			return fmt.Errorf("interface at offset %d has invalid type ID %d", off, id)
+		}
+		p, ok, err := j.pointer(off + word)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("interface at offset %d has a data pointer that is missing from the pointer table", off)
+		}
+		concrete := typeRef{desc: int(id)}
+		return j.enter(jsonKey{kind: valueRegion, off: p, ref: concrete, n: -1}, func() error {
+			return j.value(p, concrete)
+		})
+	default:
+		return fmt.Errorf("cannot convert objects of kind %v to JSON", t.Kind)
+	}
+	return nil
+}
+
+// array writes the n objects at off as a JSON array
+func (j *jsonWriter) array(off int64, ref typeRef, n int64) error {
+	size := int64(j.descs[ref.desc][ref.id].Size)
+	j.w.WriteByte('[')
+	for i := int64(0); i < n; i++ {
+		if i > 0 {
+			j.w.WriteByte(',')
+		}
+		j.path = append(j.path, strconv.FormatInt(i, 10))
+		err := j.value(off+i*size, ref)
+		j.path = j.path[:len(j.path)-1]
+		if err != nil {
+			return err
+		}
+	}
+	j.w.WriteByte(']')
+	return nil
+}
+
+// mapValue writes the entries referred to by the map at off, which was stored
+// with the type ref. Maps with string or integer keys are written as objects
+// with sorted keys, like encoding/json does.
+func (j *jsonWriter) mapValue(off int64, ref typeRef) error {
+	d := j.descs[ref.desc]
+	t := d[ref.id]
+	word := int64(j.arch.WordSize)
+	if !j.inRange(off, 3, uintptr(word)) {
+		return fmt.Errorf("map entries at offset %d are outside buffer of length %d", off, len(j.buf))
+	}
+	p, ok, err := j.pointer(off)
+	if err != nil {
+		return err
+	}
+	n := int64(j.word(off + word))
+	if !ok {
+		n = 0
+	}
+	valueOffset, size := d.entryLayout(t.Key, t.Elem, j.arch.WordSize)
+	if !j.inRange(p, n, size) || (size == 0 && n > 1) {
+		return fmt.Errorf("map at offset %d has %d entries at offset %d, outside buffer of length %d",
+			off, n, p, len(j.buf))
+	}
+
+	keyRef := typeRef{desc: ref.desc, id: t.Key}
+	elemRef := typeRef{desc: ref.desc, id: t.Elem}
+
+	// find the key of each entry, if they can be object keys
+	keys := make([]string, n)
+	for i := range keys {
+		entry := p + int64(i)*int64(size)
+		key := d[t.Key]
+		switch key.Kind {
+		case reflect.String:
+			kp, ok, err := j.pointer(entry)
+			if err != nil {
+				return err
+			}
+			kn := int64(j.word(entry + word))
+			if !ok {
+				kn = 0
+			} else if !j.inRange(kp, kn, 1) {
+				return fmt.Errorf("map key at offset %d is outside buffer of length %d", entry, len(j.buf))
+			}
+			keys[i] = string(j.buf[kp : kp+kn])
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			keys[i] = strconv.FormatInt(j.signed(entry, key.Size), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			keys[i] = strconv.FormatUint(j.getUint(entry, key.Size), 10)
+		default:
+			return j.mapEntries(p, n, size, valueOffset, keyRef, elemRef)
+		}
+	}
+
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return keys[order[a]] < keys[order[b]] })
+
+	j.w.WriteByte('{')
+	for i, k := range order {
+		if i > 0 {
+			j.w.WriteByte(',')
+		}
+		j.str(keys[k])
+		j.w.WriteByte(':')
+		j.path = append(j.path, keys[k])
+		err := j.value(p+int64(k)*int64(size)+int64(valueOffset), elemRef)
+		j.path = j.path[:len(j.path)-1]
+		if err != nil {
+			return err
+		}
+	}
+	j.w.WriteByte('}')
+	return nil
+}
+
+// mapEntries writes the n map entries at off as an array of key/value objects
+func (j *jsonWriter) mapEntries(off, n int64, size, valueOffset uintptr, keyRef, elemRef typeRef) error {
+	j.w.WriteByte('[')
+	for i := int64(0); i < n; i++ {
+		if i > 0 {
+			j.w.WriteByte(',')
+		}
+		entry := off + i*int64(size)
+		j.path = append(j.path, strconv.FormatInt(i, 10), "key")
+		j.w.WriteString(`{"key":`)
+		err := j.value(entry, keyRef)
+		if err != nil {
+			return err
+		}
+		j.path[len(j.path)-1] = "value"
+		j.w.WriteString(`,"value":`)
+		err = j.value(entry+int64(valueOffset), elemRef)
+		if err != nil {
+			return err
+		}
+		j.w.WriteByte('}')
+		j.path = j.path[:len(j.path)-2]
+	}
+	j.w.WriteByte(']')
+	return nil
+}
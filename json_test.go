@@ -0,0 +1,203 @@
+package memdump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type jsonRecord struct {
+	Bool    bool
+	Int     int
+	Int8    int8
+	Uint16  uint16
+	Float32 float32
+	Float64 float64
+	String  string
+	Bytes   []byte
+	Ints    []int
+	Array   [3]int32
+	Ptr     *int
+	Nil     *int
+	Strings map[string]int
+	Keys    map[int64]string
+	Shape   shape
+	Empty   shape
+	Tagged  int `memdump:"tagged" json:"tagged"`
+}
+
+func TestToJSON_Single(t *testing.T) {
+	x := 7
+	in := jsonRecord{
+		Bool:    true,
+		Int:     -1 << 30,
+		Int8:    -3,
+		Uint16:  65535,
+		Float32: 1.5,
+		Float64: 1e100,
+		String:  "a \"quoted\" <string>",
+		Bytes:   []byte{1, 2, 3},
+		Ints:    []int{4, 5},
+		Array:   [3]int32{-1, 0, 1},
+		Ptr:     &x,
+		Strings: map[string]int{"b": 2, "a": 1},
+		Keys:    map[int64]string{-5: "x", 10: "y"},
+		Shape:   &polygon{Name: "tri", Points: [][2]float64{{0, 0}, {1, 1}}},
+		Tagged:  9,
+	}
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &in))
+
+	var out bytes.Buffer
+	require.NoError(t, ToJSON(&b, &out))
+
+	expected, err := json.Marshal(in)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(expected), out.String())
+	assert.True(t, strings.HasSuffix(out.String(), "}\n"))
+}
+
+func TestToJSON_Stream(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	require.NoError(t, enc.Encode(&recordV1{ID: 1, Name: "abc"}))
+	require.NoError(t, enc.Encode(&recordV1{ID: 2}))
+
+	var out bytes.Buffer
+	require.NoError(t, ToJSON(&b, &out))
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{"ID":1,"Name":"abc","Score":0}`, lines[0])
+	assert.JSONEq(t, `{"ID":2,"Name":"","Score":0}`, lines[1])
+}
+
+func TestToJSON_Heterogeneous(t *testing.T) {
+	x, s := 3, "abc"
+	var b bytes.Buffer
+	enc := NewHeterogeneousEncoder(&b)
+	require.NoError(t, enc.Encode(&x))
+	require.NoError(t, enc.Encode(&s))
+
+	var out bytes.Buffer
+	require.NoError(t, ToJSON(&b, &out))
+	assert.Equal(t, "3\n\"abc\"\n", out.String())
+}
+
+func TestToJSON_Cycle(t *testing.T) {
+	type node struct {
+		Label    string
+		Parent   *node
+		Children []*node
+	}
+	root := &node{Label: "root"}
+	root.Children = []*node{{Label: "a", Parent: root}, {Label: "b", Parent: root}}
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &struct{ Root *node }{root}))
+
+	var out bytes.Buffer
+	require.NoError(t, ToJSON(&b, &out))
+	assert.JSONEq(t, `{"Root": {
+		"Label": "root",
+		"Parent": null,
+		"Children": [
+			{"Label": "a", "Parent": {"$ref": "#/Root"}, "Children": null},
+			{"Label": "b", "Parent": {"$ref": "#/Root"}, "Children": null}
+		]
+	}}`, out.String())
+}
+
+func TestToJSON_SelfCycle(t *testing.T) {
+	type node struct {
+		Label string
+		Self  *node
+	}
+	root := node{Label: "root"}
+	root.Self = &root
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &root))
+
+	var out bytes.Buffer
+	require.NoError(t, ToJSON(&b, &out))
+	assert.JSONEq(t, `{"Label": "root", "Self": {"$ref": "#"}}`, out.String())
+}
+
+func TestToJSON_Shared(t *testing.T) {
+	type node struct {
+		Left, Right *node
+	}
+	// each level points twice at the level below, so expanding every
+	// pointer would write 2^40 leaves
+	var n *node
+	for i := 0; i < 40; i++ {
+		n = &node{Left: n, Right: n}
+	}
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &[]*node{n.Left.Left, n.Left}))
+
+	var out bytes.Buffer
+	require.NoError(t, ToJSON(&b, &out))
+	assert.Less(t, out.Len(), 10000)
+	assert.True(t, strings.HasPrefix(out.String(), `[{"Left":{"Left":`))
+	assert.Contains(t, out.String(), `{"Left":{"$ref":"#/0"},"Right":{"$ref":"#/0"}}`)
+}
+
+func TestToJSON_StructKeys(t *testing.T) {
+	type key struct {
+		A, B int
+	}
+	in := map[key]bool{{1, 2}: true}
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &in))
+
+	var out bytes.Buffer
+	require.NoError(t, ToJSON(&b, &out))
+	assert.JSONEq(t, `[{"key": {"A": 1, "B": 2}, "value": true}]`, out.String())
+}
+
+func TestToJSON_NaN(t *testing.T) {
+	in := []float64{math.NaN(), math.Inf(-1), 2}
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &in))
+
+	var out bytes.Buffer
+	require.NoError(t, ToJSON(&b, &out))
+	assert.JSONEq(t, `["NaN", "-Inf", 2]`, out.String())
+}
+
+func TestToJSON_Transcoded(t *testing.T) {
+	in := recordV1{ID: -2, Name: "abc"}
+	var b, transcoded bytes.Buffer
+	require.NoError(t, Encode(&b, &in))
+	require.NoError(t, Transcode(&b, &transcoded, "s390x"))
+
+	var out bytes.Buffer
+	require.NoError(t, ToJSON(&transcoded, &out))
+	assert.JSONEq(t, `{"ID": -2, "Name": "abc", "Score": 0}`, out.String())
+}
+
+func TestToJSON_InvalidDescriptor(t *testing.T) {
+	var out bytes.Buffer
+	rec := rawRecord{
+		data: make([]byte, 8),
+		desc: descriptor{{Kind: reflect.Struct, Size: 8, Fields: []field{{Name: "X", Type: 1}}}, {Kind: reflect.Int, Size: 3}},
+	}
+	err := writeJSON(bufio.NewWriter(&out), &rec, nativeArch)
+	assert.Error(t, err)
+
+	rec.desc[1].Size = nativeArch.WordSize
+	rec.loc.Main = 4
+	err = writeJSON(bufio.NewWriter(&out), &rec, nativeArch)
+	assert.Error(t, err)
+}
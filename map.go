@@ -0,0 +1,26 @@
+package memdump
+
+import "reflect"
+
+// mapEntryType gets the type of the key/value pairs that maps of type t
+// are encoded as
+func mapEntryType(t reflect.Type) reflect.Type {
+	return reflect.StructOf([]reflect.StructField{
+		{Name: "Key", Type: t.Key()},
+		{Name: "Value", Type: t.Elem()},
+	})
+}
+
+// mapEntries copies the contents of a map into an addressable slice of entries
+func mapEntries(m reflect.Value) reflect.Value {
+	t := reflect.SliceOf(mapEntryType(m.Type()))
+	entries := reflect.New(t).Elem()
+	entries.Set(reflect.MakeSlice(t, m.Len(), m.Len()))
+
+	iter := m.MapRange()
+	for i := 0; iter.Next(); i++ {
+		entries.Index(i).Field(0).Set(iter.Key())
+		entries.Index(i).Field(1).Set(iter.Value())
+	}
+	return entries
+}
@@ -0,0 +1,160 @@
+package memdump
+
+import (
+	"bytes"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMap_Simple(t *testing.T) {
+	src := map[string]int{"a": 1, "b": 2, "c": 3}
+	var dest map[string]int
+	testEncodeDecode(t, &src, &dest)
+	assert.Equal(t, src, dest)
+}
+
+func TestMap_NilAndEmpty(t *testing.T) {
+	type T struct {
+		A map[string]int
+		B map[string]int
+	}
+	src := T{B: map[string]int{}}
+	var dest T
+	testEncodeDecode(t, &src, &dest)
+	assert.Nil(t, dest.A)
+	assert.NotNil(t, dest.B)
+	assert.Empty(t, dest.B)
+}
+
+type mapNode struct {
+	Name     string
+	Children map[string]*mapNode
+	Weights  map[int][]float64
+}
+
+func TestMap_Nested(t *testing.T) {
+	leaf := &mapNode{Name: "leaf", Weights: map[int][]float64{1: {1.5, 2.5}}}
+	src := mapNode{
+		Name: "root",
+		Children: map[string]*mapNode{
+			"x": leaf,
+			"y": leaf,
+			"z": {Name: "other"},
+		},
+	}
+
+	var dest mapNode
+	testEncodeDecode(t, &src, &dest)
+	assert.Equal(t, src, dest)
+
+	// pointers to the same object should still be shared
+	assert.True(t, dest.Children["x"] == dest.Children["y"])
+	assert.False(t, dest.Children["x"] == dest.Children["z"])
+}
+
+func TestMap_Cycle(t *testing.T) {
+	src := &mapNode{Name: "root", Children: map[string]*mapNode{}}
+	src.Children["self"] = src
+
+	var dest *mapNode
+	testEncodeDecode(t, &src, &dest)
+	assert.Equal(t, "root", dest.Name)
+	assert.True(t, dest.Children["self"] == dest)
+}
+
+func TestMap_SharedMap(t *testing.T) {
+	type T struct {
+		A map[string]int
+		B map[string]int
+	}
+	m := map[string]int{"a": 1}
+	src := T{A: m, B: m}
+
+	var dest T
+	testEncodeDecode(t, &src, &dest)
+	assert.Equal(t, src, dest)
+	assert.Equal(t, reflect.ValueOf(dest.A).Pointer(), reflect.ValueOf(dest.B).Pointer())
+}
+
+func TestMap_InSlice(t *testing.T) {
+	type T struct {
+		Tags map[string]string
+		Data []byte
+	}
+	src := []T{
+		{Tags: map[string]string{"k": "v"}, Data: []byte("abc")},
+		{Tags: map[string]string{"k2": "v2"}},
+	}
+
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	require.NoError(t, enc.Encode(&src))
+
+	var dest []T
+	dec := NewDecoder(&b)
+	require.NoError(t, dec.Decode(&dest))
+	assert.Equal(t, src, dest)
+}
+
+func TestMap_Single(t *testing.T) {
+	src := map[int]string{1: "one", 2: "two"}
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &src))
+
+	var dest *map[int]string
+	require.NoError(t, Decode(&b, &dest))
+	assert.Equal(t, src, *dest)
+}
+
+func TestMap_SurvivesGC(t *testing.T) {
+	src := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		src[strconv.Itoa(i)] = i
+	}
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &src))
+
+	var dest *map[string]int
+	require.NoError(t, Decode(&b, &dest))
+	b.Reset()
+
+	for i := 0; i < 3; i++ {
+		runtime.GC()
+		_ = make([]byte, 1<<20)
+	}
+	assert.Equal(t, src, *dest)
+}
+
+func TestMap_EntriesOutOfBounds(t *testing.T) {
+	src := map[string]int{"a": 1}
+	buf, ptrs := encodeForTest(t, &src)
+
+	putWord(buf, 0, uint64(len(buf)))
+	_, err := relocate(buf, ptrs, 0, reflect.TypeOf(src), nil)
+	assert.Error(t, err)
+}
+
+func TestNeedsHeap(t *testing.T) {
+	type withMap struct {
+		M map[string]int
+	}
+	type indirect struct {
+		P *[]withMap
+	}
+	type recursive struct {
+		Next *recursive
+		S    string
+	}
+
+	assert.False(t, needsHeap(reflect.TypeOf(0)))
+	assert.False(t, needsHeap(reflect.TypeOf(recursive{})))
+	assert.True(t, needsHeap(reflect.TypeOf(withMap{})))
+	assert.True(t, needsHeap(reflect.TypeOf(indirect{})))
+}
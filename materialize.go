@@ -0,0 +1,298 @@
+package memdump
+
+import (
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// materializer copies objects out of a relocated decode buffer and onto the
+// Go heap. The objects in the buffer are grouped into regions as they were by
+// memEncoder, and only the regions that contain a map or interface, or that
+// point to another region that is copied, are copied; the copies point back
+// into the buffer for everything else. Pointers into a region that is copied
+// are redirected to the same offset within the copy, so the decoded objects
+// alias one another just as they did in the buffer.
+type materializer struct {
+	regions []memRegion
+	copies  []unsafe.Pointer // copies contains the heap copy of each region, or nil
+	maps    map[uintptr]reflect.Value
+	types   typeTable
+}
+
+// materialize copies the object of type t at ptr, which must be in a relocated
+// decode buffer that has been checked by validate, and returns a pointer to
+// the copy.
+func materialize(ptr unsafe.Pointer, t reflect.Type, types typeTable) (interface{}, error) {
+	m := materializer{
+		maps:  make(map[uintptr]reflect.Value),
+		types: types,
+	}
+
+	objects := m.find(object{ptr: ptr, typ: t, n: 1}, nil)
+	m.regions, _ = mergeObjects(objects)
+	m.copies = make([]unsafe.Pointer, len(m.regions))
+
+	copied, err := m.copied()
+	if err != nil {
+		return nil, err
+	}
+
+	// allocate every copy before filling any of them in, so that pointers
+	// can be redirected as they are copied
+	elems := make([]reflect.Type, len(m.regions))
+	counts := make([]int, len(m.regions))
+	for i, r := range m.regions {
+		if !copied[i] {
+			continue
+		}
+		elems[i], counts[i], err = r.cover()
+		if err != nil {
+			return nil, err
+		}
+		heap := reflect.MakeSlice(reflect.SliceOf(elems[i]), counts[i], counts[i])
+		m.copies[i] = unsafe.Pointer(heap.Pointer())
+	}
+	for i, r := range m.regions {
+		if !copied[i] {
+			continue
+		}
+		size := elems[i].Size()
+		for j := 0; j < counts[i]; j++ {
+			off := uintptr(j) * size
+			m.copy(unsafe.Add(m.copies[i], off), unsafe.Add(r.ptr(), off), elems[i])
+		}
+	}
+	return reflect.NewAt(t, m.redirect(ptr)).Interface(), nil
+}
+
+// find gets every object that is reachable from root through pointers and
+// slices. The entries of maps and the values held by interfaces are followed
+// but not returned, since nothing else can refer to them. Strings are not
+// followed, since their contents are never copied, and nor are the records of
+// values with a builtin handler, which canonicalize replaces. If visit is not nil then
+// it is called for every object reached, including map entries and values
+// held by interfaces, after the objects that it points to have been found.
+func (m *materializer) find(root object, visit func(object)) []object {
+	seen := map[objectKey]bool{{addr: root.addr(), typ: root.typ, n: root.n}: true}
+	objects := []object{root}
+	queue := []object{root}
+	push := func(o object, alias bool) {
+		key := objectKey{addr: o.addr(), typ: o.typ, n: o.n}
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		if alias {
+			objects = append(objects, o)
+		}
+		queue = append(queue, o)
+	}
+
+	for len(queue) > 0 {
+		o := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		size := o.typ.Size()
+		pointers := lookupType(o.typ).pointers
+		for i := 0; i < o.n && len(pointers) > 0; i++ {
+			for _, ptr := range pointers {
+				loc := unsafe.Add(o.ptr, uintptr(i)*size+ptr.offset)
+				switch ptr.typ.Kind() {
+				case reflect.Ptr:
+					if ptr.b != nil {
+						continue
+					}
+					if p := *(*unsafe.Pointer)(loc); p != nil {
+						push(object{ptr: p, typ: ptr.typ.Elem(), n: 1}, true)
+					}
+				case reflect.Slice:
+					if p := *(*unsafe.Pointer)(loc); p != nil {
+						push(object{ptr: p, typ: ptr.typ.Elem(), n: *(*int)(unsafe.Add(loc, uintptrSize))}, true)
+					}
+				case reflect.Map:
+					if p := *(*unsafe.Pointer)(loc); p != nil {
+						push(object{ptr: p, typ: reflect.SliceOf(mapEntryType(ptr.typ)), n: 1}, false)
+					}
+				case reflect.Interface:
+					if id := *(*uintptr)(loc); id != 0 {
+						p := *(*unsafe.Pointer)(unsafe.Add(loc, uintptrSize))
+						push(object{ptr: p, typ: m.types[id-1].typ, n: 1}, false)
+					}
+				}
+			}
+		}
+		if visit != nil {
+			visit(o)
+		}
+	}
+	return objects
+}
+
+// copied determines which regions must be copied: those that contain a map or
+// interface, since the garbage collector does not look inside the buffer for
+// pointers to the rebuilt maps or to the values that reflect allocates when it
+// fills in an interface, and those that point to a region that is copied.
+func (m *materializer) copied() ([]bool, error) {
+	copied := make([]bool, len(m.regions))
+	referrers := make([][]int, len(m.regions))
+	var queue []int
+	for i, r := range m.regions {
+		ptr := r.ptr()
+		err := r.eachSlot(func(sl slot) error {
+			switch sl.typ.Kind() {
+			case reflect.Map, reflect.Interface:
+				if !copied[i] {
+					copied[i] = true
+					queue = append(queue, i)
+				}
+			case reflect.Ptr, reflect.Slice:
+				if p := *(*unsafe.Pointer)(unsafe.Add(ptr, sl.off)); p != nil {
+					if j := findRegion(m.regions, uintptr(p)); j >= 0 {
+						referrers[j] = append(referrers[j], i)
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for len(queue) > 0 {
+		cur := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		for _, i := range referrers[cur] {
+			if !copied[i] {
+				copied[i] = true
+				queue = append(queue, i)
+			}
+		}
+	}
+	return copied, nil
+}
+
+// cover gets an element type and count such that an array of them has the
+// same layout as the whole region, which is the case when each object in the
+// region is either a run of that element type or lies within one element.
+func (r *memRegion) cover() (reflect.Type, int, error) {
+	elem, _ := flatten(r.objects[0].typ, 1)
+	size := elem.Size()
+	if size == 0 || (r.end-r.start)%size != 0 {
+		return nil, 0, fmt.Errorf("cannot copy %d bytes of overlapping objects as %v", r.end-r.start, elem)
+	}
+	n := int((r.end - r.start) / size)
+	for _, o := range r.objects[1:] {
+		t, _ := flatten(o.typ, o.n)
+		if t == elem && (o.addr()-r.start)%size != 0 {
+			return nil, 0, fmt.Errorf("overlapping objects of type %v are misaligned", elem)
+		}
+	}
+
+	// the other objects must agree with the element type about where the
+	// pointers are
+	var slots int
+	err := r.eachSlot(func(slot) error {
+		slots++
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if slots != n*len(lookupType(elem).pointers) {
+		return nil, 0, fmt.Errorf("objects that overlap %v contain pointers in different places", elem)
+	}
+	return elem, n, nil
+}
+
+// flatten gets the element type and count of n objects of type t, looking
+// inside arrays
+func flatten(t reflect.Type, n int) (reflect.Type, int) {
+	for t.Kind() == reflect.Array && t.Elem().Size() > 0 {
+		n *= t.Len()
+		t = t.Elem()
+	}
+	return t, n
+}
+
+// redirect gets the location of the heap copy of the object at p, or p itself
+// if it was not copied
+func (m *materializer) redirect(p unsafe.Pointer) unsafe.Pointer {
+	i := findRegion(m.regions, uintptr(p))
+	if i < 0 || m.copies[i] == nil {
+		return p
+	}
+	return unsafe.Add(m.copies[i], uintptr(p)-m.regions[i].start)
+}
+
+// mapValue builds a map of type t from the encoded entries at src
+func (m *materializer) mapValue(src unsafe.Pointer, t reflect.Type) reflect.Value {
+	if v, found := m.maps[uintptr(src)]; found {
+		return v
+	}
+
+	entryType := mapEntryType(t)
+	entries := reflect.NewAt(reflect.SliceOf(entryType), src).Elem()
+	v := reflect.MakeMapWithSize(t, entries.Len())
+	m.maps[uintptr(src)] = v
+
+	valueOffset := entryType.Field(1).Offset
+	for i := 0; i < entries.Len(); i++ {
+		entry := unsafe.Pointer(entries.Index(i).UnsafeAddr())
+		key := reflect.New(t.Key())
+		m.copy(unsafe.Pointer(key.Pointer()), entry, t.Key())
+		val := reflect.New(t.Elem())
+		m.copy(unsafe.Pointer(val.Pointer()), unsafe.Add(entry, valueOffset), t.Elem())
+		v.SetMapIndex(key.Elem(), val.Elem())
+	}
+	return v
+}
+
+// copy copies an object of type t from src to dst, which must be on the heap,
+// redirecting the pointers in it
+func (m *materializer) copy(dst, src unsafe.Pointer, t reflect.Type) {
+	if len(lookupType(t).pointers) == 0 || t.Kind() == reflect.String {
+		// reflect takes care of the write barriers
+		reflect.NewAt(t, dst).Elem().Set(reflect.NewAt(t, src).Elem())
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			m.copy(unsafe.Add(dst, f.Offset), unsafe.Add(src, f.Offset), f.Type)
+		}
+	case reflect.Array:
+		size := t.Elem().Size()
+		for i := 0; i < t.Len(); i++ {
+			off := uintptr(i) * size
+			m.copy(unsafe.Add(dst, off), unsafe.Add(src, off), t.Elem())
+		}
+	case reflect.Ptr:
+		if p := *(*unsafe.Pointer)(src); p != nil {
+			*(*unsafe.Pointer)(dst) = m.redirect(p)
+		}
+	case reflect.Slice:
+		if p := *(*unsafe.Pointer)(src); p != nil {
+			n := *(*int)(unsafe.Add(src, uintptrSize))
+			*(*int)(unsafe.Add(dst, uintptrSize)) = n
+			*(*int)(unsafe.Add(dst, 2*uintptrSize)) = n
+			*(*unsafe.Pointer)(dst) = m.redirect(p)
+		}
+	case reflect.Map:
+		if p := *(*unsafe.Pointer)(src); p != nil {
+			reflect.NewAt(t, dst).Elem().Set(m.mapValue(p, t))
+		}
+	case reflect.Interface:
+		// the concrete value is copied immediately, since reflect copies
+		// it again when it is stored in the interface
+		if id := *(*uintptr)(src); id != 0 {
+			concrete := m.types[id-1].typ
+			p := *(*unsafe.Pointer)(unsafe.Add(src, uintptrSize))
+			v := reflect.New(concrete)
+			m.copy(unsafe.Pointer(v.Pointer()), p, concrete)
+			reflect.NewAt(t, dst).Elem().Set(v.Elem())
+		}
+	}
+}
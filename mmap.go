@@ -0,0 +1,129 @@
+package memdump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+)
+
+// MappedFile is a memdump file that has been mapped into memory by OpenFile.
+// The object decoded from it refers directly to the mapped memory, so it must
+// not be used after Close has been called.
+type MappedFile struct {
+	data []byte
+}
+
+// Close unmaps the file. Any object obtained from the file becomes invalid.
+func (f *MappedFile) Close() error {
+	if f.data == nil {
+		return nil
+	}
+	err := munmap(f.data)
+	f.data = nil
+	return err
+}
+
+// OpenFile maps a file written by Encode into memory and stores a pointer to
+// the object within it at the location specified by ptrptr, which must be a
+// pointer to a pointer. The mapping is private, so the pointers are relocated
+// in place without the data being copied or modified on disk. The caller must
+// call Close on the returned MappedFile once the object is no longer needed.
+// Data with a different layout cannot be used in place, so OpenFile returns
+// ErrIncompatibleLayout in that case; use DecodeWithPolicy to convert it.
+func OpenFile(path string, ptrptr interface{}) (*MappedFile, error) {
+	v, err := checkPointerToPointer(ptrptr)
+	if err != nil {
+		return nil, err
+	}
+	t := v.Type()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() == 0 || st.Size() > int64(maxInt) {
+		return nil, fmt.Errorf("cannot map a file of size %d", st.Size())
+	}
+
+	// The mapping begins on a page boundary, so the data segment, which
+	// begins at a multiple of dataAlign from the start of the file, is aligned.
+	data, err := mmap(f, int(st.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("error mapping %s: %v", path, err)
+	}
+	m := &MappedFile{data: data}
+
+	out, err := decodeInPlace(data, t.Elem().Elem())
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	v.Elem().Set(reflect.ValueOf(out))
+	return m, nil
+}
+
+// decodeInPlace relocates the data segment of a file written by Encode or
+// EncodeUnbuffered in place
+func decodeInPlace(data []byte, t reflect.Type) (interface{}, error) {
+	// read the magic number and protocol
+	br := bufio.NewReader(bytes.NewReader(data))
+	protocol, err := readPreamble(br)
+	if err != nil {
+		return nil, fmt.Errorf("error reading protocol: %v", err)
+	}
+	if protocol != singleProtocol && protocol != streamedSingleProtocol {
+		return nil, fmt.Errorf("invalid protocol %d (files written before protocol %d must be read with DecodeLegacy)",
+			protocol, singleProtocol)
+	}
+
+	// read the header, and the locations if they precede the data
+	fr := newFramedReader(br, preambleSize)
+	l, err := readSingleHeader(fr, t, StrictLayout)
+	if err != nil {
+		return nil, err
+	}
+	var loc *locations
+	if protocol == singleProtocol {
+		loc, err = readLocationSegment(fr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// find the data segment within the mapping
+	pos := lengthOffset(fr.offset, dataAlign)
+	if pos+8 > int64(len(data)) {
+		return nil, fmt.Errorf("error reading data segment: %v", io.ErrUnexpectedEOF)
+	}
+	size := binary.LittleEndian.Uint64(data[pos:])
+	if size > uint64(int64(len(data))-pos-8) {
+		return nil, fmt.Errorf("error reading data segment: %v", io.ErrUnexpectedEOF)
+	}
+	end := pos + 8 + int64(size)
+
+	// read the locations if they follow the data
+	if protocol == streamedSingleProtocol {
+		loc, err = readLocationSegment(newFramedReader(bytes.NewReader(data[end:]), end))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// relocate the data in place
+	out, err := relocate(data[pos+8:end], loc.Pointers, loc.Main, t, l.types)
+	if err != nil {
+		return nil, fmt.Errorf("error relocating data: %v", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,20 @@
+//go:build linux
+// +build linux
+
+package memdump
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmap maps the first size bytes of f into memory. The mapping is writable
+// but private, so writes to it are never carried through to the file.
+func mmap(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE)
+}
+
+// munmap unmaps memory returned by mmap
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
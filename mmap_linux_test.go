@@ -0,0 +1,105 @@
+//go:build linux
+// +build linux
+
+package memdump
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenFile(t *testing.T) {
+	type T struct {
+		X  int
+		Y  string
+		Ts []*T
+	}
+	src := T{
+		X: 123,
+		Y: "abc",
+		Ts: []*T{
+			{4, "x", nil},
+			{5, "y", nil},
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "data.memdump")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, Encode(f, &src))
+	require.NoError(t, f.Close())
+
+	var dest *T
+	m, err := OpenFile(path, &dest)
+	require.NoError(t, err)
+	assert.EqualValues(t, src, *dest)
+	require.NoError(t, m.Close())
+
+	// the file on disk should be untouched by relocation
+	var buf bytes.Buffer
+	require.NoError(t, Encode(&buf, &src))
+	ondisk, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, buf.Bytes(), ondisk)
+}
+
+func TestOpenFile_Unbuffered(t *testing.T) {
+	type T struct {
+		X  int
+		Ys []string
+	}
+	src := T{X: 123, Ys: []string{"a", "bc"}}
+
+	path := filepath.Join(t.TempDir(), "data.memdump")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, EncodeUnbuffered(f, &src))
+	require.NoError(t, f.Close())
+
+	var dest *T
+	m, err := OpenFile(path, &dest)
+	require.NoError(t, err)
+	assert.EqualValues(t, src, *dest)
+	require.NoError(t, m.Close())
+}
+
+func TestOpenFile_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.memdump")
+	require.NoError(t, os.WriteFile(path, []byte("not a memdump"), 0644))
+
+	var dest *int
+	_, err := OpenFile(path, &dest)
+	assert.Error(t, err)
+}
+
+func TestOpenFile_Missing(t *testing.T) {
+	var dest *int
+	_, err := OpenFile(filepath.Join(t.TempDir(), "missing"), &dest)
+	assert.Error(t, err)
+}
+
+func TestOpenFile_HugePointerCount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.memdump")
+	require.NoError(t, os.WriteFile(path, []byte("not a memdump, but long enough"), 0644))
+
+	var dest *int
+	_, err := OpenFile(path, &dest)
+	assert.Error(t, err)
+}
+
+func TestOpenFile_Incompatible(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.memdump")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, Encode(f, &[]string{"abc"}))
+	require.NoError(t, f.Close())
+
+	var dest *[]int
+	_, err = OpenFile(path, &dest)
+	assert.Equal(t, ErrIncompatibleLayout, err)
+}
@@ -0,0 +1,243 @@
+package memdump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// rawStream reads the records in a stream without decoding them, for tools
+// that work from the descriptors in the stream rather than from Go types
+type rawStream struct {
+	protocol   int32 // protocol is the protocol number without checksumFlag or compressionFlag
+	checksums  bool
+	compressed bool
+	header     header // header is empty apart from Protocol and Arch for heterogeneous streams
+	sr         segmentReader
+	done       bool
+	table      []typeEntry // table contains the type table read so far, for protocol 8
+}
+
+// rawRecord is an object read from a stream together with its layout
+type rawRecord struct {
+	data  []byte
+	loc   locations
+	desc  descriptor
+	types []registeredType
+
+	// typeID is the ID of the type of the object in the type table for
+	// protocol 8, and newType is set if the footer of this object defines it
+	typeID  int
+	newType bool
+	name    string // name is the name recorded for the type of the object, for protocol 8
+}
+
+// openRawStream reads the protocol and header of a stream written by Encode,
+// Encoder, or HeterogeneousEncoder. Files written by Encode before protocol 5
+// have no header, so they cannot be read.
+func openRawStream(r io.Reader) (*rawStream, error) {
+	br := bufio.NewReader(r)
+	protocol, err := readPreamble(br)
+	if err != nil {
+		return nil, fmt.Errorf("error reading protocol: %v", err)
+	}
+
+	// streams written with protocol 2 begin with the bare protocol number,
+	// and streams written with protocol 1 begin with a gob-encoded header
+	s := rawStream{}
+	s.protocol, s.checksums, s.compressed = splitProtocol(protocol)
+	if protocol == 0 {
+		prefix, err := br.Peek(4)
+		if err != nil {
+			return nil, fmt.Errorf("error reading protocol: %v", err)
+		}
+		s.protocol = homogeneousProtocol
+		if int32(binary.LittleEndian.Uint32(prefix)) == heterogeneousProtocol {
+			s.protocol = heterogeneousProtocol
+			br.Discard(4)
+		}
+		s.sr = NewDelimitedReader(br)
+	} else {
+		fr := newFramedReader(br, preambleSize)
+		fr.checksums = s.checksums
+		s.sr = fr
+	}
+
+	switch s.protocol {
+	case homogeneousProtocol, framedHomogeneousProtocol, framedHeterogeneousProtocol, singleProtocol, indexedProtocol, streamedSingleProtocol, tabledHeterogeneousProtocol:
+		seg, err := s.sr.Next()
+		if err != nil {
+			return nil, fmt.Errorf("error reading header segment: %w", truncated(err))
+		}
+		err = gob.NewDecoder(bytes.NewBuffer(seg)).Decode(&s.header)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding header: %v", err)
+		}
+		err = checkCompression(s.compressed, &s.header)
+		if err != nil {
+			return nil, err
+		}
+	case heterogeneousProtocol:
+		s.header.Protocol = heterogeneousProtocol
+	default:
+		return nil, fmt.Errorf("invalid protocol %d", s.protocol)
+	}
+	return &s, nil
+}
+
+// format gets the name of the kind of stream
+func (s *rawStream) format() string {
+	switch s.protocol {
+	case homogeneousProtocol, framedHomogeneousProtocol:
+		return "homogeneous"
+	case indexedProtocol:
+		return "indexed"
+	case heterogeneousProtocol, framedHeterogeneousProtocol, tabledHeterogeneousProtocol:
+		return "heterogeneous"
+	default:
+		return "single"
+	}
+}
+
+// heterogeneous determines whether each record has its own descriptor
+func (s *rawStream) heterogeneous() bool {
+	switch s.protocol {
+	case heterogeneousProtocol, framedHeterogeneousProtocol, tabledHeterogeneousProtocol:
+		return true
+	}
+	return false
+}
+
+// single determines whether the stream contains a single object
+func (s *rawStream) single() bool {
+	return s.protocol == singleProtocol || s.protocol == streamedSingleProtocol
+}
+
+// next reads the next record, or returns io.EOF if there are no more records
+func (s *rawStream) next() (*rawRecord, error) {
+	if s.done {
+		return nil, io.EOF
+	}
+
+	// single-object streams have a location segment and the data
+	if s.single() {
+		s.done = true
+		loc, data, err := readSingle(s.sr.(*framedReader), s.protocol)
+		if err != nil {
+			return nil, err
+		}
+		return &rawRecord{data: data, loc: *loc, desc: s.header.Descriptor, types: s.header.Types}, nil
+	}
+
+	dataseg, err := s.sr.Next()
+	if len(dataseg) == 0 && err == io.EOF {
+		s.done = true
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading data segment: %w", err)
+	}
+	footerseg, err := s.sr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("error reading footer segment: %w", err)
+	}
+	if s.compressed {
+		dataseg, err = decompress(dataseg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rec := rawRecord{data: dataseg}
+	if s.protocol == tabledHeterogeneousProtocol {
+		id, loc, entry, err := decodeTableFooter(footerseg, len(s.table))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding footer: %v", err)
+		}
+		if entry != nil {
+			s.table = append(s.table, *entry)
+		}
+		rec.loc = *loc
+		rec.desc, rec.types = s.table[id].Descriptor, s.table[id].Types
+		rec.typeID, rec.newType, rec.name = id, entry != nil, s.table[id].Name
+	} else if s.heterogeneous() {
+		var f heterogeneousFooter
+		err = gob.NewDecoder(bytes.NewBuffer(footerseg)).Decode(&f)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding footer: %v", err)
+		}
+		rec.loc = locations{Main: f.Main, Pointers: f.Pointers}
+		rec.desc, rec.types = f.Descriptor, f.Types
+	} else {
+		err = decodeLocations(bytes.NewBuffer(footerseg), &rec.loc)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding footer: %v", err)
+		}
+		rec.desc, rec.types = s.header.Descriptor, s.header.Types
+	}
+	return &rec, nil
+}
+
+// rawData is a buffer produced by memEncoder, possibly on another machine,
+// which is read word by word rather than reinterpreted as a Go value
+type rawData struct {
+	buf   []byte
+	isPtr pointerSet
+	arch  arch
+}
+
+func newRawData(buf []byte, ptrs []int64, a arch) (rawData, error) {
+	isPtr, err := newPointerSet(buf, ptrs, a.WordSize)
+	if err != nil {
+		return rawData{}, err
+	}
+	return rawData{buf: buf, isPtr: isPtr, arch: a}, nil
+}
+
+// inRange checks that n objects of the given size at off lie within the buffer
+func (d *rawData) inRange(off, n int64, size uintptr) bool {
+	if off < 0 || off > int64(len(d.buf)) || n < 0 {
+		return false
+	}
+	if size == 0 {
+		return true
+	}
+	return n <= (int64(len(d.buf))-off)/int64(size)
+}
+
+// word reads a machine word
+func (d *rawData) word(off int64) uint64 {
+	return d.getUint(off, d.arch.WordSize)
+}
+
+// getUint reads an unsigned integer of the given size
+func (d *rawData) getUint(off int64, size uintptr) uint64 {
+	order := d.arch.byteOrder()
+	switch size {
+	case 1:
+		return uint64(d.buf[off])
+	case 2:
+		return uint64(order.Uint16(d.buf[off:]))
+	case 4:
+		return uint64(order.Uint32(d.buf[off:]))
+	default:
+		return order.Uint64(d.buf[off:])
+	}
+}
+
+// pointer reads the pointer at off and reports whether it is non-nil. Pointers
+// that are listed in the pointer table are offsets into the buffer; all other
+// pointers must be nil.
+func (d *rawData) pointer(off int64) (int64, bool, error) {
+	w := d.word(off)
+	if !d.isPtr.contains(off) {
+		if w != 0 {
+			return 0, false, fmt.Errorf("pointer at offset %d is not nil but is missing from the pointer table", off)
+		}
+		return 0, false, nil
+	}
+	return int64(w), true, nil
+}
@@ -0,0 +1,252 @@
+package memdump
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+var (
+	registryLock    sync.Mutex
+	registeredNames = make(map[string]reflect.Type)
+	registeredTypes = make(map[reflect.Type]string)
+	snapshots       = make(map[reflect.Type]*typeSnapshot) // snapshots contains the snapshot for each type passed to snapshotTypes
+)
+
+// registeredType is an entry in the table of concrete types that can be
+// stored in interface values, as written to the stream
+type registeredType struct {
+	Name       string
+	Descriptor descriptor
+}
+
+// typeSnapshot is the table of registered types that an encoder writes to
+// the stream, together with the ID of each type. IDs are only meaningful
+// within one snapshot.
+type typeSnapshot struct {
+	table []registeredType
+	ids   map[reflect.Type]uintptr
+}
+
+// id gets the ID of t, or zero if t was not registered
+func (s *typeSnapshot) id(t reflect.Type) uintptr {
+	if s == nil {
+		return 0
+	}
+	return s.ids[t]
+}
+
+// ifaceType is a concrete type read from the stream, resolved to a local type.
+// If the local type has a different layout then typ is set as well as err.
+type ifaceType struct {
+	name string
+	typ  reflect.Type
+	err  error
+}
+
+// typeTable maps type IDs in interface values to concrete types. The ID of
+// the entry at index i is i+1; zero is reserved for nil interfaces.
+type typeTable []ifaceType
+
+// typeName gets the name under which t is registered, which follows the same
+// rules as gob.Register so that it is stable across builds.
+func typeName(t reflect.Type) string {
+	star := ""
+	if t.Name() == "" && t.Kind() == reflect.Ptr {
+		star = "*"
+		t = t.Elem()
+	}
+	if t.Name() == "" {
+		return star + t.String()
+	}
+	if t.PkgPath() == "" {
+		return star + t.Name()
+	}
+	return star + t.PkgPath() + "." + t.Name()
+}
+
+// Register records the concrete type of value so that values of that type
+// can be encoded in interface fields. Decoders must register the same types
+// before decoding. Register panics if value is of a type that cannot be
+// stored, or if a different type has already been registered under the same
+// name.
+func Register(value interface{}) {
+	t := reflect.TypeOf(value)
+	register(typeName(t), t, false)
+}
+
+// RegisterType is like Register, but records the type of sample under the
+// given name, as with gob.RegisterName. HeterogeneousEncoder records the name
+// of each object's type, so that HeterogeneousDecoder can decode objects of
+// registered types without being told their types. RegisterType panics if the
+// type has already been registered under a different name.
+func RegisterType(name string, sample interface{}) {
+	register(name, reflect.TypeOf(sample), true)
+}
+
+// register records t under name. If exact is set then it panics if t is
+// already registered under a different name.
+func register(name string, t reflect.Type, exact bool) {
+	if _, err := describe(t); err != nil {
+		panic(fmt.Sprintf("memdump: cannot register %v: %v", t, err))
+	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if prev, found := registeredNames[name]; found && prev != t {
+		panic(fmt.Sprintf("memdump: registering duplicate types for %q: %v != %v", name, prev, t))
+	}
+	if prev, found := registeredTypes[t]; found {
+		if exact && prev != name {
+			panic(fmt.Sprintf("memdump: registering duplicate names for %v: %q != %q", t, prev, name))
+		}
+		return
+	}
+	registeredNames[name] = t
+	registeredTypes[t] = name
+	snapshots = make(map[reflect.Type]*typeSnapshot)
+}
+
+// registeredName gets the name under which t is registered, or the name it
+// would be registered under by Register if it has not been registered
+func registeredName(t reflect.Type) string {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if name, found := registeredTypes[t]; found {
+		return name
+	}
+	return typeName(t)
+}
+
+// lookupName gets the type registered under name
+func lookupName(name string) (reflect.Type, bool) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	t, found := registeredNames[name]
+	return t, found
+}
+
+// snapshotTypes gets the table of the currently registered types that may be
+// stored in an interface that can be reached from a value of type t, which
+// is empty unless t refers to an interface type
+func snapshotTypes(t reflect.Type) *typeSnapshot {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if s, found := snapshots[t]; found {
+		return s
+	}
+
+	reachable := reachableTypes(t)
+	var names []string
+	for concrete := range reachable {
+		names = append(names, registeredTypes[concrete])
+	}
+	sort.Strings(names)
+
+	s := typeSnapshot{ids: make(map[reflect.Type]uintptr)}
+	for i, name := range names {
+		concrete := registeredNames[name]
+		desc, _ := describe(concrete) // checked by Register
+		s.table = append(s.table, registeredType{
+			Name:       name,
+			Descriptor: desc,
+		})
+		s.ids[concrete] = uintptr(i + 1)
+	}
+	snapshots[t] = &s
+	return &s
+}
+
+// reachableTypes gets the registered types that may be stored in an interface
+// that can be reached from a value of type t, either directly or through
+// another such registered type. The registry lock must be held.
+func reachableTypes(t reflect.Type) map[reflect.Type]bool {
+	reachable := make(map[reflect.Type]bool)
+	visited := make(map[reflect.Type]bool)
+	var visit func(t reflect.Type)
+	visit = func(t reflect.Type) {
+		if visited[t] || builtins[t] != nil {
+			return
+		}
+		visited[t] = true
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Array:
+			visit(t.Elem())
+		case reflect.Map:
+			visit(t.Key())
+			visit(t.Elem())
+		case reflect.Struct:
+			for i := 0; i < t.NumField(); i++ {
+				visit(t.Field(i).Type)
+			}
+		case reflect.Interface:
+			// a value stored in an interface always implements it
+			for concrete := range registeredTypes {
+				if !reachable[concrete] && concrete.Implements(t) {
+					reachable[concrete] = true
+					visit(concrete)
+				}
+			}
+		}
+	}
+	visit(t)
+	return reachable
+}
+
+// tableSnapshot gets a snapshot with the IDs in a table read from the stream,
+// so that more objects can be appended to it. Types that are not registered,
+// or whose layout has changed, are left out, so they cannot be encoded.
+func tableSnapshot(table []registeredType) *typeSnapshot {
+	s := typeSnapshot{table: table, ids: make(map[reflect.Type]uintptr)}
+	for i, entry := range resolveTypes(table) {
+		if entry.typ != nil && entry.err == nil {
+			s.ids[entry.typ] = uintptr(i + 1)
+		}
+	}
+	return &s
+}
+
+// resolveTypes looks up each type in a table read from the stream
+func resolveTypes(table []registeredType) typeTable {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	var out typeTable
+	for _, entry := range table {
+		t, found := registeredNames[entry.Name]
+		var desc descriptor
+		if found {
+			desc, _ = describe(t) // checked by Register
+		}
+		switch {
+		case !found:
+			out = append(out, ifaceType{
+				name: entry.Name,
+				err:  fmt.Errorf("type %q was stored in an interface but has not been registered", entry.Name),
+			})
+		case !descriptorsEqual(desc, entry.Descriptor):
+			out = append(out, ifaceType{
+				name: entry.Name,
+				typ:  t,
+				err:  fmt.Errorf("type %q was stored in an interface: %v", entry.Name, ErrIncompatibleLayout),
+			})
+		default:
+			out = append(out, ifaceType{name: entry.Name, typ: t})
+		}
+	}
+	return out
+}
+
+// sameLayout determines whether every registered type in the table has the
+// same layout as when it was written
+func (tt typeTable) sameLayout() bool {
+	for _, entry := range tt {
+		if entry.typ != nil && entry.err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,219 @@
+package memdump
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type shape interface {
+	Area() float64
+}
+
+type square struct {
+	Side float64
+}
+
+func (s square) Area() float64 { return s.Side * s.Side }
+
+type polygon struct {
+	Name   string
+	Points [][2]float64
+	Parts  map[string]shape
+}
+
+func (p *polygon) Area() float64 { return float64(len(p.Points)) }
+
+type shapeHolder struct {
+	A shape
+	B shape
+	C interface{}
+	D shape
+}
+
+type unregisteredShape struct{}
+
+func (unregisteredShape) Area() float64 { return 0 }
+
+func init() {
+	Register(square{})
+	Register(&polygon{})
+	Register("")
+	Register(0)
+}
+
+func TestTypeName(t *testing.T) {
+	assert.Equal(t, "github.com/alexflint/go-memdump.square", typeName(reflect.TypeOf(square{})))
+	assert.Equal(t, "*github.com/alexflint/go-memdump.polygon", typeName(reflect.TypeOf(&polygon{})))
+	assert.Equal(t, "string", typeName(reflect.TypeOf("")))
+	assert.Equal(t, "[]int", typeName(reflect.TypeOf([]int{})))
+}
+
+func TestSnapshotTypes(t *testing.T) {
+	// no interfaces
+	s := snapshotTypes(reflect.TypeOf(struct {
+		X  int
+		Ys []string
+	}{}))
+	assert.Empty(t, s.table)
+
+	// shape can hold a square or a *polygon, and nothing else that is
+	// registered
+	s = snapshotTypes(reflect.TypeOf(struct{ S []shape }{}))
+	assert.Len(t, s.table, 2)
+	assert.NotZero(t, s.id(reflect.TypeOf(square{})))
+	assert.NotZero(t, s.id(reflect.TypeOf(&polygon{})))
+	assert.Zero(t, s.id(reflect.TypeOf("")))
+
+	// an empty interface can hold anything, and the polygons that it holds
+	// can hold shapes
+	s = snapshotTypes(reflect.TypeOf(shapeHolder{}))
+	assert.NotZero(t, s.id(reflect.TypeOf("")))
+	assert.NotZero(t, s.id(reflect.TypeOf(0)))
+	assert.NotZero(t, s.id(reflect.TypeOf(square{})))
+}
+
+func TestRegister_Duplicate(t *testing.T) {
+	func() {
+		type dup struct{ A int }
+		Register(dup{})
+		Register(dup{})
+	}()
+	assert.Panics(t, func() {
+		type dup struct{ B string }
+		Register(dup{})
+	})
+}
+
+func TestInterface_Heterogeneous(t *testing.T) {
+	poly := &polygon{
+		Name:   "tri",
+		Points: [][2]float64{{0, 0}, {1, 0}, {0, 1}},
+		Parts:  map[string]shape{"sq": square{2}},
+	}
+	src := shapeHolder{
+		A: square{3},
+		B: poly,
+		C: "abc",
+	}
+
+	var dest shapeHolder
+	testEncodeDecode(t, &src, &dest)
+	assert.Equal(t, src, dest)
+	assert.Equal(t, 9., dest.A.Area())
+	assert.Nil(t, dest.D)
+}
+
+func TestInterface_SharedPointer(t *testing.T) {
+	poly := &polygon{Name: "p"}
+	src := shapeHolder{A: poly, B: poly, C: poly}
+
+	var dest shapeHolder
+	testEncodeDecode(t, &src, &dest)
+	assert.True(t, dest.A.(*polygon) == dest.B.(*polygon))
+	assert.True(t, dest.A.(*polygon) == dest.C.(*polygon))
+}
+
+func TestInterface_Homogeneous(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	for i := 0; i < 3; i++ {
+		src := shapeHolder{A: square{float64(i)}, C: i}
+		require.NoError(t, enc.Encode(&src))
+	}
+
+	dec := NewDecoder(&b)
+	for i := 0; i < 3; i++ {
+		var dest shapeHolder
+		require.NoError(t, dec.Decode(&dest))
+		assert.Equal(t, square{float64(i)}, dest.A)
+		assert.Equal(t, i, dest.C)
+	}
+	var dest shapeHolder
+	assert.Equal(t, io.EOF, dec.Decode(&dest))
+}
+
+func TestInterface_Single(t *testing.T) {
+	src := []shape{square{1}, &polygon{Name: "x"}, nil}
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &src))
+
+	var dest *[]shape
+	require.NoError(t, Decode(&b, &dest))
+	assert.Equal(t, src, *dest)
+
+	runtime.GC()
+	assert.Equal(t, "x", (*dest)[1].(*polygon).Name)
+}
+
+func TestInterface_Unregistered(t *testing.T) {
+	src := shapeHolder{B: unregisteredShape{}}
+	expected := &UnregisteredTypeError{Type: reflect.TypeOf(unregisteredShape{}), Path: "B"}
+
+	var b bytes.Buffer
+	for _, encode := range []func(interface{}) error{
+		NewHeterogeneousEncoder(&b).Encode,
+		NewEncoder(&b).Encode,
+		func(obj interface{}) error { return Encode(&b, obj) },
+		func(obj interface{}) error { return EncodeUnbuffered(&b, obj) },
+	} {
+		var unregistered *UnregisteredTypeError
+		err := encode(&src)
+		require.True(t, errors.As(err, &unregistered), "%v", err)
+		assert.Equal(t, expected, unregistered)
+	}
+
+	// interfaces within arrays and slices
+	_, err := newMemEncoder(&b).Encode(&[]shapeHolder{{}, {D: unregisteredShape{}}})
+	assert.Equal(t, &UnregisteredTypeError{Type: reflect.TypeOf(unregisteredShape{}), Path: "D"}, err)
+	_, err = newMemEncoder(&b).Encode(&[2]shape{nil, unregisteredShape{}})
+	assert.Equal(t, &UnregisteredTypeError{Type: reflect.TypeOf(unregisteredShape{}), Path: "[]"}, err)
+}
+
+func TestInterface_UnregisteredOnDecode(t *testing.T) {
+	type local struct{ X int }
+	Register(local{})
+
+	var b bytes.Buffer
+	var src interface{} = local{3}
+	require.NoError(t, NewHeterogeneousEncoder(&b).Encode(&src))
+
+	// simulate a decoder that has not registered the type
+	unregister(reflect.TypeOf(local{}))
+
+	var dest interface{}
+	err := NewHeterogeneousDecoder(&b).Decode(&dest)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("%q", typeName(reflect.TypeOf(local{}))))
+}
+
+func TestInterface_InvalidTypeID(t *testing.T) {
+	var src interface{} = "abc"
+	var b bytes.Buffer
+	mem := newMemEncoder(&b)
+	mem.types = snapshotTypes(reflect.TypeOf(&src).Elem())
+	loc, err := mem.Encode(&src)
+	require.NoError(t, err)
+
+	buf := b.Bytes()
+	putWord(buf, 0, 1000)
+	_, err = relocate(buf, loc.Pointers, loc.Main, reflect.TypeOf(&src).Elem(), resolveTypes(mem.types.table))
+	assert.Error(t, err)
+}
+
+// unregister removes a type from the registry
+func unregister(t reflect.Type) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	delete(registeredNames, registeredTypes[t])
+	delete(registeredTypes, t)
+	snapshots = make(map[reflect.Type]*typeSnapshot)
+}
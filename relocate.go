@@ -47,42 +47,77 @@ func decodeLocations(r io.Reader, f *locations) error {
 		return err
 	}
 
-	// read the list of pointers
-	f.Pointers = make([]int64, n)
-	err = binary.Read(r, binary.LittleEndian, f.Pointers)
-	if err != nil {
-		return err
+	// read the list of pointers in chunks, so that a corrupt count
+	// cannot force a huge allocation
+	if n < 0 {
+		return fmt.Errorf("invalid number of pointers: %d", n)
+	}
+	const chunk = 1 << 16
+	f.Pointers = make([]int64, 0, min64(n, chunk))
+	for int64(len(f.Pointers)) < n {
+		cur := len(f.Pointers)
+		f.Pointers = append(f.Pointers, make([]int64, min64(n-int64(cur), chunk))...)
+		err = binary.Read(r, binary.LittleEndian, f.Pointers[cur:])
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 // relocate adds the base address to each pointer in the buffer, then reinterprets
-// the buffer as an object of type t.
-func relocate(buf []byte, ptrs []int64, main int64, t reflect.Type) (interface{}, error) {
+// the buffer as an object of type t. The buffer is first checked by validate, so
+// that corrupt input results in an error rather than an object containing wild
+// pointers. If t contains maps or interfaces then the parts of the object that
+// refer to them are copied to the heap by materialize. The type IDs in interface
+// values are looked up in types. Values with a builtin handler, such as
+// time.Time, are restored to the canonical runtime objects by canonicalize.
+func relocate(buf []byte, ptrs []int64, main int64, t reflect.Type, types typeTable) (interface{}, error) {
 	if len(buf) == 0 {
 		return nil, fmt.Errorf("cannot relocate an empty buffer")
 	}
 
-	// If the buffer is not aligned then we have to move the
-	// whole thing. We can assume that a freshly allocated
-	// buffer from make() is 8-byte aligned.
-	if uintptr(unsafe.Pointer(&buf[0]))%uintptr(t.Align()) != 0 {
-		buf2 := make([]byte, len(buf))
-		copy(buf2, buf)
-		buf = buf2
+	buf = alignBuffer(buf)
+	err := validate(buf, ptrs, main, t, types)
+	if err != nil {
+		return nil, err
 	}
 
 	base := uintptr(unsafe.Pointer(&buf[0]))
-	for i, loc := range ptrs {
-		if loc < 0 || loc >= int64(len(buf)) {
-			return nil, fmt.Errorf("pointer %d was out of range: %d (buffer len=%d)", i, loc, len(buf))
-		}
+	for _, loc := range ptrs {
 		v := (*uintptr)(unsafe.Pointer(&buf[loc]))
 		*v += base
 	}
-	if main < 0 || main >= int64(len(buf)) {
-		return nil, fmt.Errorf("main offset was out of range: %d (buffer len=%d)", main, len(buf))
+	info := lookupType(t)
+	if info.canonical {
+		err = canonicalize(unsafe.Pointer(&buf[main]), t, types)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if info.heap {
+		return materialize(unsafe.Pointer(&buf[main]), t, types)
 	}
 	return reflect.NewAt(t, unsafe.Pointer(&buf[main])).Interface(), nil
 }
+
+// alignBuffer gets a copy of buf that is aligned to maxAlign, or buf itself
+// if it is already aligned
+func alignBuffer(buf []byte) []byte {
+	// Rounding the size up to a multiple of maxAlign ensures
+	// that make() gives us an aligned buffer.
+	if uintptr(unsafe.Pointer(&buf[0]))%maxAlign != 0 {
+		buf2 := make([]byte, (len(buf)+maxAlign-1)/maxAlign*maxAlign)
+		copy(buf2, buf)
+		buf = buf2[:len(buf)]
+	}
+	return buf
+}
@@ -29,19 +29,19 @@ func TestLocations(t *testing.T) {
 
 func TestRelocate_EmptyBuffer(t *testing.T) {
 	var buf []byte
-	_, err := relocate(buf, nil, 0, reflect.TypeOf(0))
+	_, err := relocate(buf, nil, 0, reflect.TypeOf(0), nil)
 	assert.Error(t, err)
 }
 
 func TestRelocate_MainOutOfBounds(t *testing.T) {
 	buf := []byte{1, 2, 3}
-	_, err := relocate(buf, nil, 100, reflect.TypeOf(0))
+	_, err := relocate(buf, nil, 100, reflect.TypeOf(0), nil)
 	assert.Error(t, err)
 }
 
 func TestRelocate_PointerOutOfBounds(t *testing.T) {
 	buf := []byte{1, 2, 3}
-	_, err := relocate(buf, []int64{100}, 0, reflect.TypeOf(0))
+	_, err := relocate(buf, []int64{100}, 0, reflect.TypeOf(0), nil)
 	assert.Error(t, err)
 }
 
@@ -0,0 +1,115 @@
+package memdump
+
+import (
+	"io"
+)
+
+// scanner holds the state behind the Next, Value, and Err methods of the
+// stream decoders
+type scanner struct {
+	value interface{}
+	err   error
+	done  bool
+}
+
+// next calls decode unless the stream has already ended or failed
+func (s *scanner) next(decode func() (interface{}, error)) bool {
+	if s.done {
+		return false
+	}
+	s.value, s.err = decode()
+	if s.err != nil {
+		s.value = nil
+		s.done = true
+		if s.err == io.EOF {
+			s.err = nil
+		}
+		return false
+	}
+	return true
+}
+
+// Next decodes the next object from the input, as for DecodePtr. The type of
+// the object is taken from SetType or from the first call to Decode or
+// DecodePtr. It returns false at the end of the stream or when an error
+// occurs, after which Err distinguishes the two cases. A stream that ends part
+// way through an object is an error.
+func (d *Decoder) Next() bool {
+	return d.scan.next(func() (interface{}, error) {
+		if d.typ == nil {
+			return nil, &InvalidArgumentError{Expected: "a type set by SetType or a previous call to Decode"}
+		}
+		return d.DecodePtr(d.typ)
+	})
+}
+
+// Value returns a pointer to the object decoded by the last call to Next
+func (d *Decoder) Value() interface{} {
+	return d.scan.value
+}
+
+// Err returns the error that caused Next to return false, or nil if Next
+// reached the end of the stream
+func (d *Decoder) Err() error {
+	return d.scan.err
+}
+
+// Next decodes the next object from the input, whose type must have been
+// registered, as for DecodeNext. It returns false at the end of the stream or
+// when an error occurs, after which Err distinguishes the two cases. A stream
+// that ends part way through an object is an error.
+func (d *HeterogeneousDecoder) Next() bool {
+	return d.scan.next(d.DecodeNext)
+}
+
+// Value returns a pointer to the object decoded by the last call to Next
+func (d *HeterogeneousDecoder) Value() interface{} {
+	return d.scan.value
+}
+
+// Err returns the error that caused Next to return false, or nil if Next
+// reached the end of the stream
+func (d *HeterogeneousDecoder) Err() error {
+	return d.scan.err
+}
+
+// Next decodes the next object from the input. It returns false at the end of
+// the stream or when an error occurs, after which Err distinguishes the two
+// cases. A stream that ends part way through an object is an error.
+func (d *TypedDecoder[T]) Next() bool {
+	return d.dec.Next()
+}
+
+// Value returns the object decoded by the last call to Next
+func (d *TypedDecoder[T]) Value() *T {
+	ptr, _ := d.dec.Value().(*T)
+	return ptr
+}
+
+// Err returns the error that caused Next to return false, or nil if Next
+// reached the end of the stream
+func (d *TypedDecoder[T]) Err() error {
+	return d.dec.Err()
+}
+
+// All returns an iterator over the objects in a stream written by Encoder or
+// TypedEncoder. It yields each object with a nil error, and stops after
+// yielding an error, so the end of the stream is never reported as an error.
+// With Go 1.23 or later it can be used in a range statement:
+//
+//	for obj, err := range memdump.All[T](r) {
+//		...
+//	}
+func All[T any](r io.Reader) func(yield func(*T, error) bool) {
+	return func(yield func(*T, error) bool) {
+		dec := NewTypedDecoder[T](r)
+		for dec.Next() {
+			if !yield(dec.Value(), nil) {
+				return
+			}
+		}
+		if dec.Err() != nil {
+			yield(nil, dec.Err())
+		}
+	}
+}
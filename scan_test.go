@@ -0,0 +1,176 @@
+package memdump
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeRecords(t *testing.T, n int) []byte {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	for i := 0; i < n; i++ {
+		require.NoError(t, enc.Encode(&recordV1{ID: i, Name: "abc"}))
+	}
+	return b.Bytes()
+}
+
+func TestDecoder_Next(t *testing.T) {
+	dec := NewDecoder(bytes.NewReader(writeRecords(t, 3)))
+	dec.SetType(reflect.TypeOf(recordV1{}))
+	var ids []int
+	for dec.Next() {
+		ids = append(ids, dec.Value().(*recordV1).ID)
+	}
+	assert.NoError(t, dec.Err())
+	assert.Equal(t, []int{0, 1, 2}, ids)
+	assert.False(t, dec.Next())
+}
+
+func TestDecoder_NextAfterDecode(t *testing.T) {
+	dec := NewDecoder(bytes.NewReader(writeRecords(t, 3)))
+	var first recordV1
+	require.NoError(t, dec.Decode(&first))
+	var ids []int
+	for dec.Next() {
+		ids = append(ids, dec.Value().(*recordV1).ID)
+	}
+	assert.NoError(t, dec.Err())
+	assert.Equal(t, []int{1, 2}, ids)
+}
+
+func TestDecoder_NextWithoutType(t *testing.T) {
+	dec := NewDecoder(bytes.NewReader(writeRecords(t, 1)))
+	assert.False(t, dec.Next())
+	assert.IsType(t, &InvalidArgumentError{}, dec.Err())
+}
+
+func TestDecoder_NextEmpty(t *testing.T) {
+	dec := NewDecoder(bytes.NewReader(nil))
+	dec.SetType(reflect.TypeOf(recordV1{}))
+	assert.False(t, dec.Next())
+	assert.NoError(t, dec.Err())
+}
+
+func TestDecoder_NextError(t *testing.T) {
+	dec := NewDecoder(bytes.NewReader(writeRecords(t, 3)))
+	dec.SetType(reflect.TypeOf(recordV2{}))
+	assert.False(t, dec.Next())
+	assert.Equal(t, ErrIncompatibleLayout, dec.Err())
+	assert.Nil(t, dec.Value())
+}
+
+func TestDecoder_NextTruncated(t *testing.T) {
+	buf := writeRecords(t, 2)
+	one := len(writeRecords(t, 1))
+
+	// a stream that ends after the header has no records
+	fr := newFramedReader(bytes.NewReader(buf[preambleSize:]), preambleSize)
+	_, err := fr.Next()
+	require.NoError(t, err)
+	header := int(fr.offset)
+
+	// every cut before the first record is complete is an error, except
+	// at the start of the stream and at the end of the header
+	for n := 0; n < one; n++ {
+		dec := NewDecoder(bytes.NewReader(buf[:n]))
+		dec.SetType(reflect.TypeOf(recordV1{}))
+		assert.False(t, dec.Next(), "truncated to %d bytes", n)
+		if n == 0 || n == header {
+			assert.NoError(t, dec.Err())
+		} else {
+			assert.Error(t, dec.Err(), "truncated to %d bytes", n)
+			assert.NotEqual(t, io.EOF, dec.Err())
+		}
+	}
+
+	// every cut after the first record is an error, except at the end of
+	// the first record
+	for n := one; n < len(buf); n++ {
+		dec := NewDecoder(bytes.NewReader(buf[:n]))
+		dec.SetType(reflect.TypeOf(recordV1{}))
+		require.True(t, dec.Next())
+		assert.False(t, dec.Next())
+		if n == one {
+			assert.NoError(t, dec.Err())
+		} else {
+			assert.Error(t, dec.Err(), "truncated to %d bytes", n)
+			assert.NotEqual(t, io.EOF, dec.Err())
+		}
+	}
+}
+
+func TestHeterogeneousDecoder_Next(t *testing.T) {
+	Register(0)
+	Register("")
+	x, s := 3, "abc"
+	var b bytes.Buffer
+	enc := NewHeterogeneousEncoder(&b)
+	require.NoError(t, enc.Encode(&x))
+	require.NoError(t, enc.Encode(&s))
+	buf := b.Bytes()
+
+	dec := NewHeterogeneousDecoder(bytes.NewReader(buf))
+	require.True(t, dec.Next())
+	assert.Equal(t, 3, *dec.Value().(*int))
+	require.True(t, dec.Next())
+	assert.Equal(t, "abc", *dec.Value().(*string))
+	assert.False(t, dec.Next())
+	assert.NoError(t, dec.Err())
+
+	dec = NewHeterogeneousDecoder(bytes.NewReader(buf[:len(buf)-1]))
+	require.True(t, dec.Next())
+	assert.False(t, dec.Next())
+	assert.Error(t, dec.Err())
+}
+
+func TestTypedDecoder_Next(t *testing.T) {
+	dec := NewTypedDecoder[recordV1](bytes.NewReader(writeRecords(t, 3)))
+	var ids []int
+	for dec.Next() {
+		ids = append(ids, dec.Value().ID)
+	}
+	assert.NoError(t, dec.Err())
+	assert.Equal(t, []int{0, 1, 2}, ids)
+	assert.Nil(t, dec.Value())
+}
+
+func TestAll(t *testing.T) {
+	var ids []int
+	All[recordV1](bytes.NewReader(writeRecords(t, 5)))(func(r *recordV1, err error) bool {
+		require.NoError(t, err)
+		ids = append(ids, r.ID)
+		return true
+	})
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, ids)
+
+	// stop early
+	ids = nil
+	All[recordV1](bytes.NewReader(writeRecords(t, 5)))(func(r *recordV1, err error) bool {
+		ids = append(ids, r.ID)
+		return len(ids) < 2
+	})
+	assert.Equal(t, []int{0, 1}, ids)
+}
+
+func TestAll_Truncated(t *testing.T) {
+	buf := writeRecords(t, 2)
+	var ids []int
+	var errs []error
+	All[recordV1](bytes.NewReader(buf[:len(buf)-3]))(func(r *recordV1, err error) bool {
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			ids = append(ids, r.ID)
+		}
+		return true
+	})
+	assert.Equal(t, []int{0}, ids)
+	require.Len(t, errs, 1)
+	assert.True(t, errors.Is(errs[0], io.ErrUnexpectedEOF), "%v", errs[0])
+}
@@ -1,7 +1,6 @@
 package memdump
 
 import (
-	"encoding/binary"
 	"fmt"
 	"io"
 	"reflect"
@@ -20,52 +19,20 @@ var (
 	typeCacheLock sync.Mutex
 )
 
-// block represents a value to be written to the stream
-type block struct {
-	src  reflect.Value
-	dest uintptr
-}
-
 // pointer represents the location of a pointer in a type
 type pointer struct {
 	offset uintptr
 	typ    reflect.Type
+	path   string   // path locates the pointer within the type, for use in errors
+	b      *builtin // b is set if the pointer belongs to a value with a builtin handler, and refers to a record
 }
 
 // typeInfo represents the location of the pointers in a type
 type typeInfo struct {
-	pointers []pointer
-}
-
-// asBytes gets a byte slice with data pointer set to the address of the
-// assigned value and length set to the sizeof the value.
-func asBytes(v reflect.Value) []byte {
-	size := int(v.Type().Size())
-	hdr := reflect.SliceHeader{
-		Data: v.Addr().Pointer(),
-		Len:  size,
-		Cap:  size,
-	}
-	return *(*[]byte)(unsafe.Pointer(&hdr))
-}
-
-// isNil determines whether the pointer contained within v is nil.
-// This is equivalent to checking x==nil, except for strings, where
-// this method checks the data pointer inside the string header.
-func isNil(v reflect.Value) bool {
-	if v.Kind() == reflect.String {
-		hdr := (*reflect.StringHeader)(unsafe.Pointer(v.Addr().Pointer()))
-		return hdr.Data == 0
-	}
-	return v.IsNil()
-}
-
-func readPointer(v reflect.Value) uintptr {
-	if v.Kind() == reflect.String {
-		hdr := (*reflect.StringHeader)(unsafe.Pointer(v.Addr().Pointer()))
-		return hdr.Data
-	}
-	return v.Pointer()
+	pointers  []pointer
+	canonical bool  // canonical is true if decoded values must be passed to canonicalize
+	heap      bool  // heap is true if decoded values must be copied to the Go heap
+	err       error // err is set if the type contains a type that cannot be stored
 }
 
 type byOffset []pointer
@@ -77,6 +44,7 @@ func (xs byOffset) Less(i, j int) bool { return xs[i].offset < xs[j].offset }
 type countingWriter struct {
 	w      io.Writer
 	offset int
+	word   [uintptrSize]byte // word is space for writeWord, which would otherwise allocate
 }
 
 func (w *countingWriter) Write(buf []byte) (int, error) {
@@ -85,10 +53,22 @@ func (w *countingWriter) Write(buf []byte) (int, error) {
 	return n, err
 }
 
+// writeWord writes a machine word in native byte order
+func (w *countingWriter) writeWord(v uintptr) error {
+	*(*uintptr)(unsafe.Pointer(&w.word)) = v
+	_, err := w.Write(w.word[:])
+	return err
+}
+
+// padding is written between regions to align them
+var padding [maxAlign]byte
+
 // memEncoder writes the in-memory representation of an object, together
 // with all referenced objects.
 type memEncoder struct {
-	w countingWriter
+	w     countingWriter
+	types *typeSnapshot        // types contains the IDs of types that may be stored in interfaces
+	begin func(size int) error // begin, if set, is called with the size of the data before any of it is written
 }
 
 func newMemEncoder(w io.Writer) *memEncoder {
@@ -97,142 +77,590 @@ func newMemEncoder(w io.Writer) *memEncoder {
 	}
 }
 
-// memEncoderState contains the state that is local to a single Encode() call.
-type memEncoderState struct {
-	ptrLocs []int64
-	next    uintptr
+// object is a run of n values of type typ in memory that a pointer refers to
+type object struct {
+	ptr unsafe.Pointer
+	typ reflect.Type
+	n   int
 }
 
-// alloc makes room for N objects of the specified type, and returns the
-// base offset for that object. It deals correctly with alignment.
-func (e *memEncoderState) alloc(t reflect.Type, n int) uintptr {
-	align := uintptr(t.Align())
-	if e.next%align != 0 {
-		e.next += align - (e.next % align)
+func (o object) addr() uintptr { return uintptr(o.ptr) }
+func (o object) end() uintptr  { return o.addr() + o.typ.Size()*uintptr(o.n) }
+
+// objectKey identifies an object. Objects may overlap one another, and more
+// than one object may begin at the same address.
+type objectKey struct {
+	addr uintptr
+	typ  reflect.Type
+	n    int
+}
+
+// memRegion is a range of memory made up of objects that overlap, such as an
+// array and the sub-slices of it, or a struct and pointers to its fields. Each
+// region is written once, so references into it alias one another after
+// decoding just as they did before encoding.
+type memRegion struct {
+	start   uintptr
+	end     uintptr
+	dest    uintptr
+	objects []object // objects is sorted by address, so the first object begins at start
+}
+
+// ptr points to the start of the region
+func (r *memRegion) ptr() unsafe.Pointer {
+	return r.objects[0].ptr
+}
+
+// align gets the largest alignment of the objects in the region
+func (r *memRegion) align() uintptr {
+	align := uintptr(1)
+	for _, o := range r.objects {
+		if a := uintptr(o.typ.Align()); a > align {
+			align = a
+		}
 	}
-	cur := e.next
-	e.next += t.Size() * uintptr(n)
-	return cur
+	return align
+}
+
+// unplaced is the dest of a region that has not been laid out yet
+const unplaced = ^uintptr(0)
+
+// objectChunkSize is the number of objects in each chunk of an objectList
+const objectChunkSize = 4096
+
+// objectList is a list of objects that grows a chunk at a time, so that the
+// objects already in it are never copied as it grows
+type objectList struct {
+	chunks [][]object
+	n      int
 }
 
-// arrayFromString gets a fixed-size array representing the bytes pointed to
-// by a string.
-func arrayFromString(strval reflect.Value) reflect.Value {
-	if strval.Kind() != reflect.String {
-		panic(fmt.Sprintf("expected string type but got %s", strval.Type()))
+func (l *objectList) add(o object) {
+	if l.n%objectChunkSize == 0 {
+		l.chunks = append(l.chunks, make([]object, 0, objectChunkSize))
 	}
+	c := &l.chunks[len(l.chunks)-1]
+	*c = append(*c, o)
+	l.n++
+}
 
-	hdr := (*reflect.StringHeader)(unsafe.Pointer(strval.Addr().Pointer()))
-	typ := reflect.ArrayOf(hdr.Len, byteType)
-	return reflect.NewAt(typ, unsafe.Pointer(hdr.Data)).Elem()
+func (l *objectList) at(i int) object {
+	return l.chunks[i/objectChunkSize][i%objectChunkSize]
 }
 
-// arrayFromSlice gets a fixed-size array representing the data pointed to by
-// a slice
-func arrayFromSlice(sliceval reflect.Value) reflect.Value {
-	if sliceval.Kind() != reflect.Slice {
-		panic(fmt.Sprintf("expected string type but got %s", sliceval.Type()))
+// flatten gets the objects in a single slice
+func (l *objectList) flatten() []object {
+	out := make([]object, 0, l.n)
+	for _, c := range l.chunks {
+		out = append(out, c...)
 	}
+	return out
+}
 
-	hdr := (*reflect.SliceHeader)(unsafe.Pointer(sliceval.Addr().Pointer()))
-	typ := reflect.ArrayOf(hdr.Len, sliceval.Type().Elem())
-	return reflect.NewAt(typ, unsafe.Pointer(hdr.Data)).Elem()
+// slot is the location of a pointer, or of a header containing a pointer,
+// within a region
+type slot struct {
+	off uintptr
+	typ reflect.Type
+	b   *builtin
+}
+
+// memEncoderState contains the state that is local to a single Encode() call.
+type memEncoderState struct {
+	objects   objectList                 // objects contains each object in the order it was reached
+	seen      map[uintptr]int            // seen contains the index of the first object reached at each address
+	more      map[objectKey]bool         // more contains the other objects that begin at an address in seen
+	maps      map[uintptr]unsafe.Pointer // maps contains the entries header that each map is encoded as
+	records   map[uintptr]unsafe.Pointer // records contains the record that each object with a builtin handler is encoded as
+	boxes     map[uintptr]unsafe.Pointer // boxes contains a copy of the value held by each interface, by address of the interface
+	keepalive []reflect.Value            // keepalive contains temporary values that objects refer to
+	regions   []memRegion                // regions is sorted by address
+	pointers  int                        // pointers counts the non-nil pointers that scan finds, which bounds the size of ptrLocs
+	ptrLocs   []int64
 }
 
-// Encode writes the in-memory representation of the object pointed to by ptr. It
-// returns the offset of each pointer and an error.
-func (e *memEncoder) Encode(ptr interface{}) ([]int64, error) {
-	var state memEncoderState
+// Encode writes the in-memory representation of the object pointed to by ptr,
+// together with all referenced objects. It returns the location of each pointer
+// and of the object itself. First it finds every object that is reachable from
+// ptr, then it merges objects that overlap into regions, then it writes each
+// region with the pointers in it replaced by offsets.
+func (e *memEncoder) Encode(ptr interface{}) (*locations, error) {
+	s := memEncoderState{
+		seen:    make(map[uintptr]int),
+		maps:    make(map[uintptr]unsafe.Pointer),
+		records: make(map[uintptr]unsafe.Pointer),
+		boxes:   make(map[uintptr]unsafe.Pointer),
+	}
 
 	ptrval := reflect.ValueOf(ptr)
-	objval := ptrval.Elem()
-	cache := make(map[uintptr]uintptr)
-	queue := []block{{
-		src:  objval,
-		dest: state.alloc(objval.Type(), 1),
-	}}
-
-	for len(queue) > 0 {
-		cur := queue[0]
-		queue = queue[1:]
+	root := object{ptr: unsafe.Pointer(ptrval.Pointer()), typ: ptrval.Type().Elem(), n: 1}
+	s.push(root)
+	for i := 0; i < s.objects.n; i++ {
+		err := e.scan(&s, s.objects.at(i))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		blockaddr := cur.src.Addr()
-		blockbytes := asBytes(cur.src)
+	// the objects are only needed in order of address from here on, so the
+	// list and the maps used to find them are released before merging
+	objects := s.objects.flatten()
+	s.objects, s.seen, s.more = objectList{}, nil, nil
+	var reached []int
+	s.regions, reached = mergeObjects(objects)
+
+	// lay out the regions in the order that they were reached, so that the
+	// region containing the main object comes first. A region is reached
+	// when the first object in it is.
+	for i := range s.regions {
+		s.regions[i].dest = unplaced
+	}
+	layout := make([]int, 0, len(s.regions))
+	var next uintptr
+	for _, j := range reached {
+		r := &s.regions[j]
+		if r.dest != unplaced {
+			continue
+		}
+		// each object in a region stays at the same offset from an address
+		// that is a multiple of its alignment
+		r.dest = next + (r.start-next)&(r.align()-1)
+		next = r.dest + r.end - r.start
+		layout = append(layout, j)
+	}
 
-		// check the position of the writer
-		if cur.dest < uintptr(e.w.offset) {
-			panic(fmt.Sprintf("block.dest=%d but writer is at %d", cur.dest, e.w.offset))
+	s.ptrLocs = make([]int64, 0, s.pointers)
+	if e.begin != nil {
+		err := e.begin(int(next))
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, j := range layout {
+		err := e.write(&s, &s.regions[j])
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		// for byte-alignment purposes we may need to fill some bytes
-		if fill := cur.dest - uintptr(e.w.offset); fill > 0 {
-			_, err := e.w.Write(make([]byte, fill))
-			if err != nil {
-				return nil, err
-			}
+	main, _ := s.locate(root.addr())
+	return &locations{Main: int64(main), Pointers: s.ptrLocs}, nil
+}
+
+// push adds an object to the list of objects to encode, if it is not already
+// present. Most objects are the only one at their address, so they are found
+// by address alone.
+func (s *memEncoderState) push(o object) {
+	addr := o.addr()
+	if i, found := s.seen[addr]; found {
+		if first := s.objects.at(i); first.typ == o.typ && first.n == o.n {
+			return
+		}
+		key := objectKey{addr: addr, typ: o.typ, n: o.n}
+		if s.more[key] {
+			return
 		}
+		if s.more == nil {
+			s.more = make(map[objectKey]bool)
+		}
+		s.more[key] = true
+	} else {
+		s.seen[addr] = s.objects.n
+	}
+	s.objects.add(o)
+}
 
-		// look up info about this type
-		info := lookupType(cur.src.Type())
+// scan pushes each object referred to by the pointers in o
+func (e *memEncoder) scan(s *memEncoderState, o object) error {
+	info := lookupType(o.typ)
+	if info.err != nil {
+		return info.err
+	}
+	if len(info.pointers) == 0 {
+		return nil
+	}
 
-		// add each referenced object to the queue
-		var blockpos uintptr
+	size := o.typ.Size()
+	for i := 0; i < o.n; i++ {
 		for _, ptr := range info.pointers {
-			_, err := e.w.Write(blockbytes[blockpos:ptr.offset])
-			if err != nil {
-				return nil, err
+			loc := unsafe.Add(o.ptr, uintptr(i)*size+ptr.offset)
+			v := reflect.NewAt(ptr.typ, loc).Elem()
+
+			// interfaces are encoded as a type ID followed by a pointer to
+			// a copy of the concrete value
+			if ptr.typ.Kind() == reflect.Interface {
+				if v.IsNil() {
+					continue
+				}
+				s.pointers++
+				if _, found := s.boxes[uintptr(loc)]; found {
+					continue
+				}
+				concrete := v.Elem()
+				if e.types.id(concrete.Type()) == 0 {
+					return &UnregisteredTypeError{Type: concrete.Type(), Path: ptr.path}
+				}
+				box := reflect.New(concrete.Type())
+				box.Elem().Set(concrete)
+				s.keepalive = append(s.keepalive, box)
+				s.boxes[uintptr(loc)] = unsafe.Pointer(box.Pointer())
+				s.push(object{ptr: unsafe.Pointer(box.Pointer()), typ: concrete.Type(), n: 1})
+				continue
+			}
+
+			// the remaining kinds all store a data pointer at offset zero
+			p := *(*unsafe.Pointer)(loc)
+			if p == nil {
+				continue
 			}
+			s.pointers++
+			switch {
+			case ptr.b != nil:
+				// the object is encoded as a record
+				if _, found := s.records[uintptr(p)]; found {
+					continue
+				}
+				rec, err := ptr.b.encode(unsafe.Add(loc, -int(ptr.b.offset)))
+				if err != nil {
+					return fmt.Errorf("%s: %w", ptr.path, err)
+				}
+				s.keepalive = append(s.keepalive, rec)
+				s.records[uintptr(p)] = unsafe.Pointer(rec.Pointer())
+				s.push(object{ptr: unsafe.Pointer(rec.Pointer()), typ: rec.Type().Elem(), n: 1})
+			case ptr.typ.Kind() == reflect.Ptr:
+				s.push(object{ptr: p, typ: ptr.typ.Elem(), n: 1})
+			case ptr.typ.Kind() == reflect.Slice:
+				s.push(object{ptr: p, typ: ptr.typ.Elem(), n: v.Len()})
+			case ptr.typ.Kind() == reflect.String:
+				s.push(object{ptr: p, typ: byteType, n: v.Len()})
+			case ptr.typ.Kind() == reflect.Map:
+				// the entries are encoded as a slice, so the map itself
+				// becomes a pointer to a slice header
+				if _, found := s.maps[uintptr(p)]; found {
+					continue
+				}
+				entries := mapEntries(v)
+				s.keepalive = append(s.keepalive, entries)
+				hdr := unsafe.Pointer(entries.UnsafeAddr())
+				s.maps[uintptr(p)] = hdr
+				s.push(object{ptr: hdr, typ: entries.Type(), n: 1})
+			}
+		}
+	}
+	return nil
+}
+
+// objectRef is the address of an object and its position in reach order
+type objectRef struct {
+	addr uintptr
+	i    int
+}
 
-			ptrdata := unsafe.Pointer(blockaddr.Pointer() + ptr.offset)
-			ptrval := reflect.NewAt(ptr.typ, ptrdata).Elem()
+// sortByAddress sorts refs by address, keeping refs with the same address in
+// their original order. It is a radix sort, since there are often millions of
+// refs, and the digits that every address shares are skipped.
+func sortByAddress(refs []objectRef) {
+	if len(refs) == 0 {
+		return
+	}
+	src, dst := refs, make([]objectRef, len(refs))
+	for shift := uint(0); shift < 8*uint(uintptrSize); shift += 8 {
+		var counts [256]int
+		for _, ref := range src {
+			counts[byte(ref.addr>>shift)]++
+		}
+		if counts[byte(src[0].addr>>shift)] == len(src) {
+			continue
+		}
+		var pos int
+		for d, c := range counts {
+			counts[d] = pos
+			pos += c
+		}
+		for _, ref := range src {
+			d := byte(ref.addr >> shift)
+			dst[counts[d]] = ref
+			counts[d]++
+		}
+		src, dst = dst, src
+	}
+	copy(refs, src)
+}
 
-			var dest uintptr
-			if !isNil(ptrval) {
-				state.ptrLocs = append(state.ptrLocs, int64(cur.dest+ptr.offset))
+// mergeObjects groups objects into regions, merging objects that overlap. It
+// sorts objects by address in place. The regions are sorted by address, and
+// reached contains the index of the region of each object in the original
+// order.
+func mergeObjects(objects []object) (regions []memRegion, reached []int) {
+	refs := make([]objectRef, len(objects))
+	for i := range objects {
+		refs[i] = objectRef{addr: objects[i].addr(), i: i}
+	}
+	sortByAddress(refs)
+
+	// objects that begin at the same address are put in order of size, from
+	// largest to smallest, so that each region begins with its largest object
+	for k := 0; k < len(refs); {
+		n := 1
+		for k+n < len(refs) && refs[k+n].addr == refs[k].addr {
+			n++
+		}
+		if n > 1 {
+			same := refs[k : k+n]
+			sort.SliceStable(same, func(a, b int) bool { return objects[same[a].i].end() > objects[same[b].i].end() })
+		}
+		k += n
+	}
 
-				var found bool
-				dest, found = cache[readPointer(ptrval)]
-				if !found {
-					switch ptr.typ.Kind() {
-					case reflect.Ptr:
-						dest = state.alloc(ptr.typ.Elem(), 1)
-						queue = append(queue, block{
-							src:  ptrval.Elem(),
-							dest: dest,
-						})
-					case reflect.Slice:
-						dest = state.alloc(ptr.typ.Elem(), ptrval.Len())
-						arr := arrayFromSlice(ptrval)
-						queue = append(queue, block{
-							src:  arr,
-							dest: dest,
-						})
-					case reflect.String:
-						dest = state.alloc(byteType, ptrval.Len())
-						arr := arrayFromString(ptrval)
-						queue = append(queue, block{
-							src:  arr,
-							dest: dest,
-						})
-					}
-					cache[readPointer(ptrval)] = dest
+	// move each object to its place in the sorted order by following the
+	// cycles of the permutation, rather than copying them all
+	reached = make([]int, len(objects))
+	for k, ref := range refs {
+		reached[ref.i] = k
+	}
+	for k := range objects {
+		for j := reached[k]; j != k; j = reached[k] {
+			objects[k], objects[j] = objects[j], objects[k]
+			reached[k], reached[j] = reached[j], reached[k]
+		}
+	}
+
+	regions = make([]memRegion, 0, len(objects))
+	var cur *memRegion
+	for k := range objects {
+		o := &objects[k]
+		// objects of zero size are merged into any region that contains
+		// their address, or that begins there
+		if cur == nil || (o.addr() >= cur.end && o.addr() != cur.start) {
+			regions = append(regions, memRegion{start: o.addr(), end: o.end(), objects: objects[k : k+1]})
+			cur = &regions[len(regions)-1]
+		} else {
+			cur.objects = cur.objects[:len(cur.objects)+1]
+		}
+		if end := o.end(); end > cur.end {
+			cur.end = end
+		}
+		reached[refs[k].i] = len(regions) - 1
+	}
+	return regions, reached
+}
+
+// findRegion gets the index of the region that contains addr, or -1 if there
+// is none
+func findRegion(regions []memRegion, addr uintptr) int {
+	// find the last region that begins at or before addr
+	lo, hi := 0, len(regions)
+	for lo < hi {
+		m := int(uint(lo+hi) >> 1)
+		if regions[m].start <= addr {
+			lo = m + 1
+		} else {
+			hi = m
+		}
+	}
+	i := lo - 1
+	if i < 0 || (addr >= regions[i].end && addr != regions[i].start) {
+		return -1
+	}
+	return i
+}
+
+// locate gets the offset in the output of the memory at addr
+func (s *memEncoderState) locate(addr uintptr) (uintptr, bool) {
+	i := findRegion(s.regions, addr)
+	if i < 0 {
+		return 0, false
+	}
+	r := s.regions[i]
+	return r.dest + addr - r.start, true
+}
+
+// slotGroup generates the slots of the objects in a region that have the same
+// type and the same offset within an element of that type, which are the
+// sub-slices of one array, in order. Objects in the same group never disagree
+// about where the pointers are, so the slots that they share are generated
+// once.
+type slotGroup struct {
+	size     uintptr
+	pointers []pointer
+	spans    spanSet // spans contains the offsets covered by the objects, which are whole elements
+	span     int     // span is the index of the current span
+	elem     uintptr // elem is the offset of the current element within the current span
+	ptr      int     // ptr is the index of the current pointer within the current element
+}
+
+func (g *slotGroup) done() bool { return g.span == len(g.spans) }
+
+func (g *slotGroup) slot() slot {
+	ptr := g.pointers[g.ptr]
+	return slot{off: uintptr(g.spans[g.span].start) + g.elem + ptr.offset, typ: ptr.typ, b: ptr.b}
+}
+
+func (g *slotGroup) advance() {
+	g.ptr++
+	if g.ptr < len(g.pointers) {
+		return
+	}
+	g.ptr = 0
+	g.elem += g.size
+	if sp := g.spans[g.span]; uintptr(sp.start)+g.elem >= uintptr(sp.end) {
+		g.span++
+		g.elem = 0
+	}
+}
+
+// eachSlot calls fn with the location of each pointer in a region, in order
+func (r *memRegion) eachSlot(fn func(slot) error) error {
+	// most regions are a single object, whose pointers are already in order
+	if len(r.objects) == 1 {
+		o := r.objects[0]
+		size := o.typ.Size()
+		pointers := lookupType(o.typ).pointers
+		for i := 0; i < o.n && len(pointers) > 0; i++ {
+			for _, ptr := range pointers {
+				err := fn(slot{off: uintptr(i)*size + ptr.offset, typ: ptr.typ, b: ptr.b})
+				if err != nil {
+					return err
 				}
 			}
+		}
+		return nil
+	}
 
-			err = binary.Write(&e.w, binary.LittleEndian, uint64(dest))
-			if err != nil {
-				return nil, err
+	// group the objects, and merge the slots of each group
+	var groups []*slotGroup
+	index := make(map[seenKey]*slotGroup)
+	for _, o := range r.objects {
+		pointers := lookupType(o.typ).pointers
+		if len(pointers) == 0 || o.n == 0 {
+			continue
+		}
+		size := o.typ.Size()
+		off := o.addr() - r.start
+		key := seenKey{typ: o.typ, phase: int64(off % size)}
+		g := index[key]
+		if g == nil {
+			g = &slotGroup{size: size, pointers: pointers}
+			index[key] = g
+			groups = append(groups, g)
+		}
+		g.spans.add(int64(off), int64(off+size*uintptr(o.n)))
+	}
+
+	// overlapping objects must agree on where the pointers are
+	var prev slot
+	var started bool
+	for {
+		var next *slotGroup
+		for _, g := range groups {
+			if !g.done() && (next == nil || g.slot().off < next.slot().off) {
+				next = g
 			}
-			blockpos = ptr.offset + uintptrSize
 		}
+		if next == nil {
+			return nil
+		}
+		sl := next.slot()
+		next.advance()
+		if started && prev.off == sl.off {
+			if prev.typ.Kind() != sl.typ.Kind() {
+				return fmt.Errorf("overlapping objects contain both %v and %v at the same address", prev.typ, sl.typ)
+			}
+			continue
+		}
+		if started && sl.off < prev.off+pointerSize(prev.typ) {
+			return fmt.Errorf("overlapping objects contain %v and %v at overlapping addresses", prev.typ, sl.typ)
+		}
+		err := fn(sl)
+		if err != nil {
+			return err
+		}
+		prev, started = sl, true
+	}
+}
+
+// pointerSize gets the number of bytes that are rewritten for a slot of type t
+func pointerSize(t reflect.Type) uintptr {
+	if t.Kind() == reflect.Interface {
+		return 2 * uintptrSize
+	}
+	return uintptrSize
+}
+
+// write writes a region with each pointer replaced by its offset in the output
+func (e *memEncoder) write(s *memEncoderState, r *memRegion) error {
+	// check the position of the writer
+	if r.dest < uintptr(e.w.offset) {
+		return fmt.Errorf("region.dest=%d but writer is at %d", r.dest, e.w.offset)
+	}
+
+	// for byte-alignment purposes we may need to fill some bytes
+	for fill := r.dest - uintptr(e.w.offset); fill > 0; fill = r.dest - uintptr(e.w.offset) {
+		if fill > uintptr(len(padding)) {
+			fill = uintptr(len(padding))
+		}
+		_, err := e.w.Write(padding[:fill])
+		if err != nil {
+			return err
+		}
+	}
 
-		_, err := e.w.Write(blockbytes[blockpos:])
+	ptr := r.ptr()
+	data := unsafe.Slice((*byte)(ptr), r.end-r.start)
+	var pos uintptr
+	err := r.eachSlot(func(sl slot) error {
+		_, err := e.w.Write(data[pos:sl.off])
 		if err != nil {
-			return nil, err
+			return err
+		}
+
+		loc := unsafe.Add(ptr, sl.off)
+		var words [2]uintptr
+		n := 1
+		if sl.typ.Kind() == reflect.Interface {
+			n = 2
+			if box, found := s.boxes[uintptr(loc)]; found {
+				dest, found := s.locate(uintptr(box))
+				if !found {
+					return fmt.Errorf("interface value at %p was not encoded", box)
+				}
+				words[0] = e.types.id(reflect.NewAt(sl.typ, loc).Elem().Elem().Type())
+				words[1] = dest
+				s.ptrLocs = append(s.ptrLocs, int64(r.dest+sl.off+uintptrSize))
+			}
+		} else {
+			p := *(*unsafe.Pointer)(loc)
+			if sl.typ.Kind() == reflect.Map && p != nil {
+				p = s.maps[uintptr(p)]
+			}
+			if sl.b != nil && p != nil {
+				p = s.records[uintptr(p)]
+			}
+			if p != nil {
+				dest, found := s.locate(uintptr(p))
+				if !found {
+					return fmt.Errorf("object at %p was not encoded", p)
+				}
+				words[0] = dest
+				s.ptrLocs = append(s.ptrLocs, int64(r.dest+sl.off))
+			}
+		}
+
+		for _, word := range words[:n] {
+			err = e.w.writeWord(word)
+			if err != nil {
+				return err
+			}
 		}
+		pos = sl.off + uintptrSize*uintptr(n)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	return state.ptrLocs, nil
+	_, err = e.w.Write(data[pos:])
+	return err
 }
 
 // pointerFinder gets the byte offset of each pointer in an object. It
@@ -243,33 +671,108 @@ type pointerFinder struct {
 	pointers []pointer
 }
 
-func (f *pointerFinder) visit(t reflect.Type, base uintptr) {
+func (f *pointerFinder) visit(t reflect.Type, base uintptr, path string) error {
+	if b := builtins[t]; b != nil {
+		// the value is stored as b.layout, in which the only pointer
+		// refers to a record
+		f.pointers = append(f.pointers, pointer{
+			offset: base + b.offset,
+			typ:    b.record,
+			path:   path,
+			b:      b,
+		})
+		return nil
+	}
 	switch t.Kind() {
-	case reflect.Ptr, reflect.String, reflect.Slice:
-		// these four types all store one pointer at offset zero
+	case reflect.Ptr, reflect.String, reflect.Slice, reflect.Map, reflect.Interface:
+		// these types all store one pointer at offset zero, except for
+		// interfaces, which store a type word followed by a pointer
 		f.pointers = append(f.pointers, pointer{
 			offset: base,
 			typ:    t,
+			path:   path,
 		})
 	case reflect.Struct:
 		for i := 0; i < t.NumField(); i++ {
 			field := t.Field(i)
-			f.visit(field.Type, base+field.Offset)
+			err := f.visit(field.Type, base+field.Offset, fieldPath(path, field.Name))
+			if err != nil {
+				return err
+			}
 		}
 	case reflect.Array:
+		if t.Len() == 0 {
+			return nil
+		}
 		elemSize := t.Elem().Size()
-		elemPtrs := lookupType(t.Elem()).pointers
-		for _, elemPtr := range elemPtrs {
+		var elem pointerFinder
+		err := elem.visit(t.Elem(), 0, path+"[]")
+		if err != nil {
+			return err
+		}
+		sort.Sort(byOffset(elem.pointers))
+		for _, elemPtr := range elem.pointers {
 			for i := 0; i < t.Len(); i++ {
 				f.pointers = append(f.pointers, pointer{
 					offset: base + uintptr(i)*elemSize + elemPtr.offset,
 					typ:    elemPtr.typ,
+					path:   elemPtr.path,
+					b:      elemPtr.b,
 				})
 			}
 		}
-	case reflect.Map, reflect.Chan, reflect.Interface, reflect.UnsafePointer, reflect.Func:
-		panic(fmt.Sprintf("cannot serialize objects of %v kind (got %v)", t.Kind(), t))
+	case reflect.Chan, reflect.UnsafePointer, reflect.Func:
+		return &UnsupportedTypeError{Type: t, Path: path}
+	}
+	return nil
+}
+
+// needsHeap determines whether a map or interface is reachable from t. Decoded
+// values of such types are copied out of the decode buffer, because the garbage
+// collector does not look inside the buffer for pointers to the rebuilt maps, or
+// to the values that reflect allocates when it fills in an interface.
+func needsHeap(t reflect.Type) bool {
+	return reaches(t, func(t reflect.Type) bool {
+		return t.Kind() == reflect.Map || t.Kind() == reflect.Interface
+	})
+}
+
+// needsCanonical determines whether a value with a builtin handler is
+// reachable from t. Interfaces may hold such a value, so they count too.
+func needsCanonical(t reflect.Type) bool {
+	return reaches(t, func(t reflect.Type) bool {
+		return builtins[t] != nil || t.Kind() == reflect.Interface
+	})
+}
+
+// reaches determines whether t, or a type reachable from t, satisfies match
+func reaches(t reflect.Type, match func(reflect.Type) bool) bool {
+	seen := make(map[reflect.Type]bool)
+	var visit func(t reflect.Type) bool
+	visit = func(t reflect.Type) bool {
+		if seen[t] {
+			return false
+		}
+		seen[t] = true
+
+		if match(t) {
+			return true
+		}
+		switch t.Kind() {
+		case reflect.Map:
+			return visit(t.Key()) || visit(t.Elem())
+		case reflect.Ptr, reflect.Slice, reflect.Array:
+			return visit(t.Elem())
+		case reflect.Struct:
+			for i := 0; i < t.NumField(); i++ {
+				if visit(t.Field(i).Type) {
+					return true
+				}
+			}
+		}
+		return false
 	}
+	return visit(t)
 }
 
 // lookupType gets the type info for t.
@@ -280,8 +783,13 @@ func lookupType(t reflect.Type) *typeInfo {
 
 	if !found {
 		var f pointerFinder
-		f.visit(t, 0)
-		info = &typeInfo{pointers: f.pointers}
+		err := f.visit(t, 0, "")
+		info = &typeInfo{
+			pointers:  f.pointers,
+			canonical: needsCanonical(t),
+			heap:      needsHeap(t),
+			err:       err,
+		}
 		sort.Sort(byOffset(info.pointers))
 
 		typeCacheLock.Lock()
@@ -2,8 +2,10 @@ package memdump
 
 import (
 	"bytes"
+	"io"
 	"reflect"
 	"testing"
+	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -24,10 +26,154 @@ func TestSerialize_Struct(t *testing.T) {
 
 	var b bytes.Buffer
 	enc := newMemEncoder(&b)
-	ptrs, err := enc.Encode(&obj)
+	loc, err := enc.Encode(&obj)
 	require.NoError(t, err)
 
-	obj2, err := relocate(b.Bytes(), ptrs, 0, reflect.TypeOf(obj))
+	obj2, err := relocate(b.Bytes(), loc.Pointers, loc.Main, reflect.TypeOf(obj), nil)
 	require.NoError(t, err)
 	assert.EqualValues(t, &obj, obj2)
 }
+
+type aliasing struct {
+	All   []int
+	A, B  []int
+	Short []int
+	S, T  string
+	P     *int
+	Self  *aliasing
+	M     map[string]int
+}
+
+func stringData(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+}
+
+func newAliasing() *aliasing {
+	xs := []int{1, 2, 3, 4, 5}
+	s := "hello world"
+	src := &aliasing{All: xs, A: xs[1:3], B: xs[2:5], Short: xs[:1], S: s, T: s[6:], P: &xs[3]}
+	src.Self = src
+	return src
+}
+
+func assertAliasing(t *testing.T, src, dest *aliasing) {
+	assert.Equal(t, src.All, dest.All)
+	assert.Equal(t, src.A, dest.A)
+	assert.Equal(t, src.B, dest.B)
+	assert.Equal(t, src.Short, dest.Short)
+	assert.Equal(t, src.T, dest.T)
+	assert.Equal(t, src.M, dest.M)
+	assert.Equal(t, stringData(dest.S)+6, stringData(dest.T))
+	assert.Same(t, dest, dest.Self)
+
+	dest.All[3] = 40
+	assert.Equal(t, 40, *dest.P)
+	assert.Equal(t, 40, dest.B[1])
+	dest.A[1] = 30
+	assert.Equal(t, 30, dest.B[0])
+}
+
+func TestSerialize_Aliasing(t *testing.T) {
+	src := newAliasing()
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, src))
+	var dest *aliasing
+	require.NoError(t, Decode(&b, &dest))
+	assertAliasing(t, src, dest)
+}
+
+func TestSerialize_AliasingWithMap(t *testing.T) {
+	// the objects that contain maps are copied onto the heap after decoding
+	src := newAliasing()
+	src.M = map[string]int{"a": 1}
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, src))
+	var dest *aliasing
+	require.NoError(t, Decode(&b, &dest))
+	assertAliasing(t, src, dest)
+}
+
+func TestSerialize_AliasingCopiedElements(t *testing.T) {
+	type elem struct {
+		X int
+		M map[string]int
+	}
+	type holder struct {
+		All  []elem
+		Tail []elem
+		P    *elem
+		PX   *int
+	}
+	xs := []elem{{X: 1}, {X: 2, M: map[string]int{"b": 2}}, {X: 3}}
+	src := &holder{All: xs, Tail: xs[1:], P: &xs[2], PX: &xs[1].X}
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, src))
+	var dest *holder
+	require.NoError(t, Decode(&b, &dest))
+	assert.Equal(t, src.All, dest.All)
+	assert.Equal(t, src.Tail, dest.Tail)
+
+	dest.All[2].X = 30
+	dest.All[1].X = 20
+	assert.Equal(t, 30, dest.P.X)
+	assert.Equal(t, 30, dest.Tail[1].X)
+	assert.Equal(t, 20, *dest.PX)
+}
+
+func TestSerialize_SubsliceEncodedOnce(t *testing.T) {
+	xs := make([]byte, 1000)
+	var whole, both bytes.Buffer
+	require.NoError(t, Encode(&whole, &struct{ A []byte }{xs}))
+	require.NoError(t, Encode(&both, &struct{ A, B []byte }{xs, xs[100:900]}))
+	assert.Less(t, both.Len(), whole.Len()+100)
+}
+
+func TestSortByAddress(t *testing.T) {
+	var refs []objectRef
+	for i, addr := range []uintptr{0x30000, 0x10008, 0x2000000, 0x10008, 0x10000, 0} {
+		refs = append(refs, objectRef{addr: addr, i: i})
+	}
+	sortByAddress(refs)
+	assert.Equal(t, []objectRef{
+		{addr: 0, i: 5},
+		{addr: 0x10000, i: 4},
+		{addr: 0x10008, i: 1},
+		{addr: 0x10008, i: 3},
+		{addr: 0x30000, i: 0},
+		{addr: 0x2000000, i: 2},
+	}, refs)
+}
+
+// graphNode is a node in a pointer-heavy graph, for benchmarks and for
+// measuring the memory used by the encoder
+type graphNode struct {
+	ID    int
+	Label string
+	Next  *graphNode
+	Peer  *graphNode
+}
+
+// generateGraph makes a linked list of n nodes in which each node also
+// points at an earlier node
+func generateGraph(n int) *graphNode {
+	nodes := make([]*graphNode, n)
+	for i := range nodes {
+		nodes[i] = &graphNode{ID: i, Label: "node"}
+	}
+	for i := range nodes {
+		if i+1 < n {
+			nodes[i].Next = nodes[i+1]
+		}
+		nodes[i].Peer = nodes[i/2]
+	}
+	return nodes[0]
+}
+
+func BenchmarkEncode_Graph(b *testing.B) {
+	root := generateGraph(1 << 20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, Encode(io.Discard, &root))
+	}
+}
@@ -1,7 +1,9 @@
 package memdump
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/gob"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,27 +13,50 @@ import (
 // Encode writes a memdump of the provided object to output. You must
 // pass a pointer to the object you wish to encode.
 func Encode(w io.Writer, obj interface{}) error {
-	t := reflect.TypeOf(obj)
-	if t.Kind() != reflect.Ptr {
-		panic(fmt.Sprintf("expected a pointer but got %T", obj))
+	t, err := checkPointer(obj)
+	if err != nil {
+		return err
+	}
+	return encodeSingle(w, t, obj)
+}
+
+// encodeSingle writes a memdump of obj, which must be a non-nil pointer of
+// type t
+func encodeSingle(w io.Writer, t reflect.Type, obj interface{}) error {
+	desc, err := describe(t.Elem())
+	if err != nil {
+		return err
 	}
 
 	// write the object data to a temporary buffer
+	types := snapshotTypes(t.Elem())
 	var buf bytes.Buffer
 	mem := newMemEncoder(&buf)
-	ptrs, err := mem.Encode(obj)
+	mem.types = types
+	mem.begin = func(size int) error {
+		buf.Grow(size)
+		return nil
+	}
+	loc, err := mem.Encode(obj)
 	if err != nil {
-		return fmt.Errorf("error while walking data: %v", err)
+		return fmt.Errorf("error while walking data: %w", err)
 	}
 
-	// write the locations at the top
-	err = encodeLocations(w, &locations{Pointers: ptrs})
+	// write the magic number, protocol, and header
+	fw := newFramedWriter(w, 0)
+	err = writeSingleHeader(fw, singleProtocol, desc, types)
+	if err != nil {
+		return err
+	}
+
+	// write the locations
+	err = writeLocationSegment(fw, loc)
 	if err != nil {
 		return fmt.Errorf("error writing location segment: %v", err)
 	}
 
 	// now write the data segment
-	_, err = buf.WriteTo(w)
+	err = fw.WriteAlignedSegment(buf.Bytes(), dataAlign)
 	if err != nil {
 		return fmt.Errorf("error writing data segment: %v", err)
 	}
@@ -39,20 +64,234 @@ func Encode(w io.Writer, obj interface{}) error {
 	return nil
 }
 
+// EncodeUnbuffered is like Encode, but writes the object data directly to w
+// rather than to a temporary buffer, so memory use does not grow with the size
+// of the data. The location of each pointer is written after the data rather
+// than before it. Decode and OpenFile read the output of either function.
+func EncodeUnbuffered(w io.Writer, obj interface{}) error {
+	t, err := checkPointer(obj)
+	if err != nil {
+		return err
+	}
+	desc, err := describe(t.Elem())
+	if err != nil {
+		return err
+	}
+
+	// the memEncoder writes many small pieces
+	bw := bufio.NewWriter(w)
+	fw := newFramedWriter(bw, 0)
+
+	// write the header and the prefix of the data segment once the size of
+	// the data is known, so that nothing is written if the object cannot be
+	// encoded
+	types := snapshotTypes(t.Elem())
+	mem := newMemEncoder(fw)
+	mem.types = types
+	mem.begin = func(size int) error {
+		err := writeSingleHeader(fw, streamedSingleProtocol, desc, types)
+		if err != nil {
+			return err
+		}
+		err = fw.WriteAlignedPrefix(uint64(size), dataAlign)
+		if err != nil {
+			return fmt.Errorf("error writing data segment: %v", err)
+		}
+		return nil
+	}
+	loc, err := mem.Encode(obj)
+	if err != nil {
+		return fmt.Errorf("error while walking data: %w", err)
+	}
+
+	err = writeLocationSegment(fw, loc)
+	if err != nil {
+		return fmt.Errorf("error writing location segment: %v", err)
+	}
+	return bw.Flush()
+}
+
+// writeSingleHeader writes the magic number, protocol, and header for a file
+// containing a single object
+func writeSingleHeader(fw *framedWriter, protocol int32, desc descriptor, types *typeSnapshot) error {
+	err := writePreamble(fw, protocol)
+	if err != nil {
+		return fmt.Errorf("error writing protocol: %v", err)
+	}
+	err = writeGobSegment(fw, header{
+		Protocol:   protocol,
+		Descriptor: desc,
+		Types:      types.table,
+		Arch:       nativeArch,
+	})
+	if err != nil {
+		return fmt.Errorf("error writing header: %v", err)
+	}
+	return nil
+}
+
+// readSingleHeader reads the header segment written by Encode or
+// EncodeUnbuffered, and compares the stored layout with t.
+func readSingleHeader(r *framedReader, t reflect.Type, policy LayoutPolicy) (*layout, error) {
+	seg, err := r.Next()
+	if err != nil {
+		return nil, fmt.Errorf("error reading header segment: %v", err)
+	}
+
+	var h header
+	err = gob.NewDecoder(bytes.NewBuffer(seg)).Decode(&h)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding header: %v", err)
+	}
+	err = checkArch(h.Arch)
+	if err != nil {
+		return nil, err
+	}
+	return newLayout(policy, t, h.Descriptor, h.Types)
+}
+
+// readLocationSegment reads the segment containing the location of each
+// pointer in a file containing a single object
+func readLocationSegment(r *framedReader) (*locations, error) {
+	seg, err := r.Next()
+	if err != nil {
+		return nil, fmt.Errorf("error reading location segment: %v", err)
+	}
+
+	var loc locations
+	err = decodeLocations(bytes.NewBuffer(seg), &loc)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding relocation data: %v", err)
+	}
+	return &loc, nil
+}
+
+// readSingle reads the locations and data of a file containing a single
+// object, which come in the order determined by the protocol
+func readSingle(r *framedReader, protocol int32) (*locations, []byte, error) {
+	var loc *locations
+	var err error
+	if protocol == singleProtocol {
+		loc, err = readLocationSegment(r)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	buf, err := r.NextAligned(dataAlign)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading data segment: %v", err)
+	}
+
+	if protocol == streamedSingleProtocol {
+		loc, err = readLocationSegment(r)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return loc, buf, nil
+}
+
 // Decode reads an object of the specified type from the input
 // and stores a pointer to it at the location specified by ptrptr,
 // which must be a pointer to a pointer. If you originally called
-// Encode with parameter *T then you should pass **T to Decode.
+// Encode with parameter *T then you should pass **T to Decode. If
+// the data was encoded from a type with a different memory layout
+// then Decode returns ErrIncompatibleLayout.
 func Decode(r io.Reader, ptrptr interface{}) error {
-	v := reflect.ValueOf(ptrptr)
-	t := v.Type()
-	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Ptr {
-		panic(fmt.Sprintf("expected a pointer to a pointer but got %v", v.Type()))
+	return DecodeWithPolicy(r, ptrptr, StrictLayout)
+}
+
+// DecodeWithPolicy is like Decode, but policy determines what happens when the
+// data was encoded from a type with a different memory layout.
+func DecodeWithPolicy(r io.Reader, ptrptr interface{}, policy LayoutPolicy) error {
+	v, err := checkPointerToPointer(ptrptr)
+	if err != nil {
+		return err
+	}
+	out, err := decodeSingle(r, v.Type().Elem().Elem(), policy)
+	if err != nil {
+		return err
+	}
+	v.Elem().Set(reflect.ValueOf(out))
+	return nil
+}
+
+// decodeSingle reads a file written by Encode or EncodeUnbuffered and returns
+// a pointer to the object in it, which must be of type t
+func decodeSingle(r io.Reader, t reflect.Type, policy LayoutPolicy) (interface{}, error) {
+	// read the magic number and protocol
+	br := bufio.NewReader(r)
+	protocol, err := readPreamble(br)
+	if err != nil {
+		return nil, fmt.Errorf("error reading protocol: %v", err)
+	}
+	if protocol == 0 {
+		return nil, fmt.Errorf("missing magic number (use DecodeLegacy for data written before protocol %d)", singleProtocol)
+	}
+	if protocol != singleProtocol && protocol != streamedSingleProtocol {
+		return nil, fmt.Errorf("invalid protocol %d", protocol)
+	}
+
+	// read the header, locations, and data
+	fr := newFramedReader(br, preambleSize)
+	l, err := readSingleHeader(fr, t, policy)
+	if err != nil {
+		return nil, err
+	}
+	loc, buf, err := readSingle(fr, protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	// relocate the data
+	out, err := l.decode(buf, loc.Pointers, loc.Main, t)
+	if err == ErrIncompatibleLayout {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("error relocating data: %v", err)
+	}
+	return out, nil
+}
+
+// DecodeBytes is like Decode, but reads a file written by Encode or
+// EncodeUnbuffered that is already in memory. The object is relocated in place
+// within buf, which is only copied if it is not suitably aligned. The object
+// refers to buf, so buf must not be modified or reused while the object is in
+// use, and it cannot be decoded a second time. Data with a different layout
+// cannot be used in place, so DecodeBytes returns ErrIncompatibleLayout in
+// that case.
+func DecodeBytes(buf []byte, ptrptr interface{}) error {
+	v, err := checkPointerToPointer(ptrptr)
+	if err != nil {
+		return err
+	}
+
+	out, err := decodeInPlace(buf, v.Type().Elem().Elem())
+	if err != nil {
+		return err
+	}
+	v.Elem().Set(reflect.ValueOf(out))
+	return nil
+}
+
+// DecodeLegacy reads an object written by versions of Encode that predate
+// protocol 5, which have no header. The layout of the data cannot be checked,
+// so it is up to the caller to pass the same type that was originally encoded.
+// Otherwise it behaves the same as Decode.
+func DecodeLegacy(r io.Reader, ptrptr interface{}) error {
+	v, err := checkPointerToPointer(ptrptr)
+	if err != nil {
+		return err
+	}
+	_, err = describe(v.Type().Elem().Elem())
+	if err != nil {
+		return err
 	}
 
 	// read the locations
 	var loc locations
-	err := decodeLocations(r, &loc)
+	err = decodeLocations(r, &loc)
 	if err != nil {
 		return fmt.Errorf("error decoding relocation data: %v", err)
 	}
@@ -63,7 +302,7 @@ func Decode(r io.Reader, ptrptr interface{}) error {
 	}
 
 	// relocate the data
-	out, err := relocate(buf, loc.Pointers, loc.Main, v.Type().Elem().Elem())
+	out, err := relocate(buf, loc.Pointers, loc.Main, v.Type().Elem().Elem(), nil)
 	if err != nil {
 		return fmt.Errorf("error relocating data: %v", err)
 	}
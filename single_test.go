@@ -2,7 +2,11 @@ package memdump
 
 import (
 	"bytes"
+	"io"
+	"reflect"
+	"runtime"
 	"testing"
+	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -35,15 +39,196 @@ func TestSingle(t *testing.T) {
 	assert.EqualValues(t, src, *dest)
 }
 
-func TestEncode_PanicsForNonPointer(t *testing.T) {
+func TestSingle_Incompatible(t *testing.T) {
+	type U struct {
+		X int
+		Y string
+	}
+	type V struct {
+		X string
+		Y int
+	}
+
+	var b bytes.Buffer
+	err := Encode(&b, &U{3, "abc"})
+	require.NoError(t, err)
+
+	var dest *V
+	err = Decode(&b, &dest)
+	assert.Equal(t, ErrIncompatibleLayout, err)
+}
+
+func TestSingle_DataIsPageAligned(t *testing.T) {
+	src := "abc"
+	var b bytes.Buffer
+	err := Encode(&b, &src)
+	require.NoError(t, err)
+
+	// the string header is followed by the string data
+	hdr := dataAlign + 2*int(uintptrSize)
+	require.Len(t, b.Bytes(), hdr+3)
+	assert.Equal(t, "abc", string(b.Bytes()[hdr:]))
+}
+
+func TestEncodeUnbuffered(t *testing.T) {
+	type T struct {
+		X  int
+		Y  string
+		Ts []*T
+	}
+	src := T{X: 123, Y: "abc", Ts: []*T{{4, "x", nil}, {5, "y", nil}}}
+	src.Ts[1].Ts = src.Ts[:1]
+
+	var b bytes.Buffer
+	require.NoError(t, EncodeUnbuffered(&b, &src))
+
+	var dest *T
+	require.NoError(t, Decode(bytes.NewReader(b.Bytes()), &dest))
+	assert.EqualValues(t, src, *dest)
+	assert.Same(t, dest.Ts[0], dest.Ts[1].Ts[0])
+
+	info, err := Inspect(bytes.NewReader(b.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, streamedSingleProtocol, info.Protocol)
+	assert.Equal(t, "single", info.Format)
+
+	dest = nil
+	require.NoError(t, Decode(transcodeVia(t, &b, "s390x"), &dest))
+	assert.EqualValues(t, src, *dest)
+}
+
+func TestEncodeUnbuffered_DataIsPageAligned(t *testing.T) {
+	src := "abc"
+	var b bytes.Buffer
+	require.NoError(t, EncodeUnbuffered(&b, &src))
+	hdr := dataAlign + 2*int(uintptrSize)
+	assert.Equal(t, "abc", string(b.Bytes()[hdr:hdr+3]))
+}
+
+func TestEncodeUnbuffered_Unsupported(t *testing.T) {
+	// nothing is written if the object cannot be encoded
+	var b bytes.Buffer
+	err := EncodeUnbuffered(&b, &struct{ F interface{} }{F: func() {}})
+	assert.Error(t, err)
+	assert.Zero(t, b.Len())
+}
+
+func TestEncodeUnbuffered_Memory(t *testing.T) {
+	src := make([]byte, 32<<20)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	require.NoError(t, EncodeUnbuffered(io.Discard, &src))
+	runtime.ReadMemStats(&after)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(len(src)/8))
+}
+
+func TestEncodeUnbuffered_MemoryPerObject(t *testing.T) {
+	// the encoder keeps a little state for each object, which for a graph
+	// of small nodes is several times the size of the nodes themselves
+	const n = 1 << 16
+	root := generateGraph(n)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	require.NoError(t, EncodeUnbuffered(io.Discard, &root))
+	runtime.ReadMemStats(&after)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(384*n))
+}
+
+// within determines whether p points into buf
+func within(p unsafe.Pointer, buf []byte) bool {
+	start := uintptr(unsafe.Pointer(&buf[0]))
+	return uintptr(p) >= start && uintptr(p) < start+uintptr(len(buf))
+}
+
+func TestDecodeBytes(t *testing.T) {
+	type T struct {
+		X  int
+		Ys []string
+	}
+	src := T{X: 123, Ys: []string{"a", "bc"}}
+	for _, encode := range []func(io.Writer, interface{}) error{Encode, EncodeUnbuffered} {
+		var b bytes.Buffer
+		require.NoError(t, encode(&b, &src))
+		buf := b.Bytes()
+
+		var dest *T
+		require.NoError(t, DecodeBytes(buf, &dest))
+		assert.Equal(t, src, *dest)
+		assert.True(t, within(unsafe.Pointer(dest), buf))
+		assert.True(t, within(unsafe.Pointer(&dest.Ys[0]), buf))
+
+		// the pointers in buf have been relocated
+		assert.Error(t, DecodeBytes(buf, &dest))
+	}
+}
+
+func TestDecodeBytes_Misaligned(t *testing.T) {
+	src := []int64{1, 2, 3}
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &src))
+
+	// the data is copied rather than relocated in place
+	buf := append(make([]byte, 1, b.Len()+1), b.Bytes()...)[1:]
+	var dest *[]int64
+	require.NoError(t, DecodeBytes(buf, &dest))
+	assert.Equal(t, src, *dest)
+	assert.False(t, within(unsafe.Pointer(&(*dest)[0]), buf))
+	assert.Equal(t, b.Bytes(), buf)
+}
+
+func TestDecodeBytes_Incompatible(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &recordV1{ID: 1}))
+	var dest *recordV2
+	assert.Equal(t, ErrIncompatibleLayout, DecodeBytes(b.Bytes(), &dest))
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	type T struct {
+		X int
+		Y string
+	}
+	src := T{X: 123, Y: "abc"}
+	// written by Encode in the format used before protocol 5
+	buf := readLegacy(t, "legacy_single.memdump")
+
+	var dest *T
+	err := DecodeLegacy(bytes.NewReader(buf), &dest)
+	require.NoError(t, err)
+	assert.Equal(t, src, *dest)
+
+	// Decode should refuse data without a header
+	err = Decode(bytes.NewReader(buf), &dest)
+	assert.Error(t, err)
+}
+
+func TestEncode_NonPointer(t *testing.T) {
 	var x struct{}
 	var b bytes.Buffer
-	assert.Panics(t, func() { Encode(&b, x) })
+	err := Encode(&b, x)
+	assert.EqualError(t, err, "memdump: expected a non-nil pointer but got struct {}")
+	assert.IsType(t, &InvalidArgumentError{}, Encode(&b, nil))
+	assert.IsType(t, &InvalidArgumentError{}, Encode(&b, (*int)(nil)))
+	assert.Zero(t, b.Len())
+}
+
+func TestEncode_Unsupported(t *testing.T) {
+	type T struct {
+		Name     string
+		Callback func()
+	}
+	var b bytes.Buffer
+	err := Encode(&b, &[]T{{Name: "abc"}})
+	require.Error(t, err)
+	assert.Equal(t, &UnsupportedTypeError{Type: reflect.TypeOf(func() {}), Path: "[].Callback"}, err)
+	assert.Zero(t, b.Len())
 }
 
-func TestDecode_PanicsForNonPointerToPointer(t *testing.T) {
+func TestDecode_NonPointerToPointer(t *testing.T) {
 	var x struct{}
 	var b bytes.Buffer
-	assert.Panics(t, func() { Decode(&b, x) })
-	assert.Panics(t, func() { Decode(&b, &x) })
+	assert.IsType(t, &InvalidArgumentError{}, Decode(&b, x))
+	assert.IsType(t, &InvalidArgumentError{}, Decode(&b, &x))
+	assert.IsType(t, &InvalidArgumentError{}, Decode(&b, nil))
+	assert.IsType(t, &InvalidArgumentError{}, DecodeLegacy(&b, &x))
 }
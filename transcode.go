@@ -0,0 +1,875 @@
+package memdump
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// Transcode rewrites a stream written by Encode, Encoder, or HeterogeneousEncoder
+// so that it can be decoded on a machine with the architecture goarch, which
+// takes the same values as runtime.GOARCH. Scalars are converted to the byte
+// order of the target, and ints, uintptrs, pointers, and slice and string
+// headers are resized to its word size, which moves struct fields and objects
+// within the data. Streams written before protocol 3 cannot be transcoded.
+func Transcode(r io.Reader, w io.Writer, goarch string) error {
+	to, found := archs[goarch]
+	if !found {
+		return fmt.Errorf("unknown architecture %q", goarch)
+	}
+
+	// read the protocol and header
+	s, err := openRawStream(r)
+	if err != nil {
+		return err
+	}
+	if s.protocol < framedHomogeneousProtocol {
+		return fmt.Errorf("cannot transcode data written before protocol %d", framedHomogeneousProtocol)
+	}
+	from := s.header.Arch.resolve()
+	if from.WordSize != 4 && from.WordSize != 8 {
+		return fmt.Errorf("invalid word size %d", from.WordSize)
+	}
+
+	// the heterogeneous protocol has a descriptor for each object rather
+	// than one in the header
+	h := s.header
+	var tc *transcoder
+	if !s.heterogeneous() {
+		tc, err = newTranscoder(from, to, h.Descriptor, h.Types)
+		if err != nil {
+			return err
+		}
+		h.Descriptor, h.Types = tc.dst[0], tc.types(h.Types)
+	}
+
+	// write the magic number, protocol, and header
+	fw := newFramedWriter(w, 0)
+	fw.checksums = s.checksums
+	protocol := s.protocol
+	if s.checksums {
+		protocol |= checksumFlag
+	}
+	var zip *compressor
+	if s.compressed {
+		protocol |= compressionFlag
+		zip, err = newCompressor(flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+	}
+	err = writePreamble(fw, protocol)
+	if err != nil {
+		return fmt.Errorf("error writing protocol: %v", err)
+	}
+	h.Arch = to
+	err = writeGobSegment(fw, h)
+	if err != nil {
+		return fmt.Errorf("error writing header: %v", err)
+	}
+
+	// indexed streams get a new index, since the objects change size, and
+	// streams with a type table have a transcoder for each entry
+	var offsets []int64
+	var table []*transcoder
+	for {
+		rec, err := s.next()
+		if err == io.EOF && s.protocol == indexedProtocol {
+			return writeIndex(fw, offsets)
+		} else if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch {
+		case s.protocol == tabledHeterogeneousProtocol && !rec.newType:
+			tc = table[rec.typeID]
+		case s.heterogeneous():
+			tc, err = newTranscoder(from, to, rec.desc, rec.types)
+			if err != nil {
+				return err
+			}
+			if rec.newType {
+				table = append(table, tc)
+			}
+		}
+		out, loc, err := tc.transcode(rec.data, &rec.loc)
+		if err != nil {
+			return err
+		}
+		if zip != nil {
+			out, err = zip.compress(out)
+			if err != nil {
+				return fmt.Errorf("error compressing data segment: %v", err)
+			}
+		}
+
+		switch {
+		case s.protocol == singleProtocol:
+			err = writeLocationSegment(fw, loc)
+			if err != nil {
+				return fmt.Errorf("error writing location segment: %v", err)
+			}
+			err = fw.WriteAlignedSegment(out, dataAlign)
+		case s.protocol == streamedSingleProtocol:
+			err = fw.WriteAlignedSegment(out, dataAlign)
+			if err != nil {
+				return fmt.Errorf("error writing data segment: %v", err)
+			}
+			err = writeLocationSegment(fw, loc)
+		case s.protocol == tabledHeterogeneousProtocol:
+			err = fw.WriteSegment(out)
+			if err != nil {
+				return fmt.Errorf("error writing data segment: %v", err)
+			}
+			var entry *typeEntry
+			if rec.newType {
+				entry = &typeEntry{Name: rec.name, Descriptor: tc.dst[0], Types: tc.types(rec.types)}
+			}
+			var buf bytes.Buffer
+			err = encodeTableFooter(&buf, uint64(rec.typeID), loc, entry)
+			if err == nil {
+				err = fw.WriteSegment(buf.Bytes())
+			}
+		case s.heterogeneous():
+			err = fw.WriteSegment(out)
+			if err != nil {
+				return fmt.Errorf("error writing data segment: %v", err)
+			}
+			err = writeGobSegment(fw, heterogeneousFooter{
+				Pointers:   loc.Pointers,
+				Main:       loc.Main,
+				Descriptor: tc.dst[0],
+				Types:      tc.types(rec.types),
+			})
+		default:
+			offsets = append(offsets, fw.offset)
+			err = fw.WriteSegment(out)
+			if err != nil {
+				return fmt.Errorf("error writing data segment: %v", err)
+			}
+			err = writeLocationSegment(fw, loc)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing transcoded object: %v", err)
+		}
+	}
+}
+
+// writeGobSegment writes a segment containing the gob encoding of v
+func writeGobSegment(w *framedWriter, v interface{}) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return err
+	}
+	return w.WriteSegment(buf.Bytes())
+}
+
+// writeLocationSegment writes a segment containing the encoding of loc
+func writeLocationSegment(w *framedWriter, loc *locations) error {
+	var buf bytes.Buffer
+	err := encodeLocations(&buf, loc)
+	if err != nil {
+		return err
+	}
+	return w.WriteSegment(buf.Bytes())
+}
+
+// transcoder converts data stored with a descriptor and table of registered
+// types from one architecture to another
+type transcoder struct {
+	from, to arch
+	src      []descriptor // src contains the stored descriptors, indexed as for typeRef
+	dst      []descriptor // dst contains the same descriptors laid out for the target
+	pointers [][]bool     // pointers records whether each type contains pointers
+}
+
+// newTranscoder checks that the stored descriptors are consistent with the
+// architecture that they were written on, and lays them out for the target
+func newTranscoder(from, to arch, desc descriptor, stored []registeredType) (*transcoder, error) {
+	tc := transcoder{from: from, to: to}
+
+	descs := []descriptor{desc}
+	for _, entry := range stored {
+		descs = append(descs, entry.Descriptor)
+	}
+	for i, d := range descs {
+		what := "stored object"
+		if i > 0 {
+			what = fmt.Sprintf("%q", stored[i-1].Name)
+		}
+		err := d.check()
+		if err != nil {
+			return nil, fmt.Errorf("invalid descriptor for %s: %v", what, err)
+		}
+		if !descriptorsEqual(d.relayout(from), d) {
+			return nil, fmt.Errorf("cannot transcode %s because its layout could not be reproduced (it may contain zero-size fields that affect its layout)", what)
+		}
+		tc.src = append(tc.src, d)
+		tc.dst = append(tc.dst, d.relayout(to))
+		tc.pointers = append(tc.pointers, containsPointers(d))
+	}
+	return &tc, nil
+}
+
+// types gets the table of registered types with descriptors for the target
+func (tc *transcoder) types(stored []registeredType) []registeredType {
+	var out []registeredType
+	for i, entry := range stored {
+		out = append(out, registeredType{
+			Name:       entry.Name,
+			Descriptor: tc.dst[i+1],
+		})
+	}
+	return out
+}
+
+// containsPointers determines whether each type in a checked descriptor
+// contains pointers
+func containsPointers(d descriptor) []bool {
+	out := make([]bool, len(d))
+	done := make([]bool, len(d))
+	var visit func(id int) bool
+	visit = func(id int) bool {
+		if done[id] {
+			return out[id]
+		}
+		switch d[id].Kind {
+		case reflect.Ptr, reflect.Slice, reflect.String, reflect.Map, reflect.Interface, reflect.UnsafePointer:
+			out[id] = true
+		case reflect.Array:
+			out[id] = d[id].Size > 0 && visit(d[id].Elem)
+		case reflect.Struct:
+			for _, f := range d[id].Fields {
+				if visit(f.Type) {
+					out[id] = true
+				}
+			}
+		}
+		done[id] = true
+		return out[id]
+	}
+	for i := range d {
+		visit(i)
+	}
+	return out
+}
+
+// regionKind identifies what a region of the data contains
+type regionKind int
+
+const (
+	valueRegion   regionKind = iota // n values of a type in a descriptor
+	bytesRegion                     // n bytes of string data
+	entriesHeader                   // the slice header that a map refers to
+	entriesRegion                   // n entries of a map
+)
+
+// transcodeRegion is a run of objects that a pointer refers to
+type transcodeRegion struct {
+	kind regionKind
+	off  int64
+	ref  typeRef
+	n    int64
+}
+
+// transcodeGroup is a run of regions that overlap, such as an array and the
+// sub-slices of it, which are converted together so that they still overlap
+// in the output
+type transcodeGroup struct {
+	start int64
+	end   int64
+	cover transcodeRegion // cover spans the group, and each other region lies within it
+	dest  int64
+}
+
+// transcodeState contains the state that is local to a single object
+type transcodeState struct {
+	*transcoder
+	rawData
+	out     []byte
+	regions []transcodeRegion
+	seen    map[transcodeRegion]bool
+	queue   []transcodeRegion
+	groups  []*transcodeGroup // groups is sorted by offset
+	ptrs    []int64
+}
+
+// transcode converts one object and everything it refers to. First it finds
+// each region of the data that is referred to by a pointer, then it groups
+// the regions that overlap and lays out the groups for the target
+// architecture, then it converts their contents.
+func (tc *transcoder) transcode(buf []byte, loc *locations) ([]byte, *locations, error) {
+	data, err := newRawData(buf, loc.Pointers, tc.from)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := transcodeState{
+		transcoder: tc,
+		rawData:    data,
+		seen:       make(map[transcodeRegion]bool),
+	}
+	err = s.findGroups(loc.Main)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// lay out the groups in their original order
+	var next int64
+	for _, g := range s.groups {
+		g.dest = int64(roundUp(uintptr(next), s.align(g.cover)))
+		next = g.dest + g.cover.n*int64(s.size(g.cover, s.dst, tc.to.WordSize))
+	}
+	if tc.to.WordSize == 4 && next > math.MaxUint32 {
+		return nil, nil, fmt.Errorf("transcoded object would be too large for a 32-bit machine")
+	}
+
+	// convert the contents of each group
+	s.out = make([]byte, next)
+	for _, g := range s.groups {
+		err = s.write(g.cover, g.dest)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	main, err := s.locate(loc.Main)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.out, &locations{Main: main, Pointers: s.ptrs}, nil
+}
+
+// findGroups finds each region that is reachable from the object at main,
+// then groups the regions that overlap
+func (s *transcodeState) findGroups(main int64) error {
+	err := s.push(transcodeRegion{kind: valueRegion, off: main, n: 1})
+	if err != nil {
+		return err
+	}
+	for len(s.queue) > 0 {
+		cur := s.queue[len(s.queue)-1]
+		s.queue = s.queue[:len(s.queue)-1]
+		err = s.scanRegion(cur)
+		if err != nil {
+			return err
+		}
+	}
+	return s.group()
+}
+
+// group merges the regions that overlap into groups, and finds a region that
+// covers each group
+func (s *transcodeState) group() error {
+	end := func(r transcodeRegion) int64 {
+		return r.off + r.n*int64(s.size(r, s.src, s.from.WordSize))
+	}
+	sort.Slice(s.regions, func(i, j int) bool {
+		a, b := s.regions[i], s.regions[j]
+		if a.off != b.off {
+			return a.off < b.off
+		}
+		return end(a) > end(b)
+	})
+
+	var members [][]transcodeRegion
+	var cur *transcodeGroup
+	for _, r := range s.regions {
+		// regions of zero size are merged into any group that contains
+		// their offset, or that begins there
+		if cur == nil || (r.off >= cur.end && r.off != cur.start) {
+			cur = &transcodeGroup{start: r.off, end: end(r), cover: r}
+			s.groups = append(s.groups, cur)
+			members = append(members, nil)
+		}
+		if e := end(r); e > cur.end {
+			cur.end = e
+		}
+		members[len(members)-1] = append(members[len(members)-1], r)
+	}
+
+	for i, g := range s.groups {
+		if len(members[i]) == 1 {
+			continue
+		}
+		err := s.coverGroup(g, members[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coverGroup finds a region of the same kind and element type as the first
+// region in a group that spans the whole group, and checks that each of the
+// other regions lies within it
+func (s *transcodeState) coverGroup(g *transcodeGroup, members []transcodeRegion) error {
+	first := members[0]
+	switch first.kind {
+	case valueRegion:
+		ref, _ := s.flatten(first.ref, first.n)
+		size := int64(s.src[ref.desc][ref.id].Size)
+		if size == 0 || (g.end-g.start)%size != 0 {
+			return fmt.Errorf("objects at offset %d overlap objects of a different size", g.start)
+		}
+		g.cover = transcodeRegion{kind: valueRegion, off: g.start, ref: ref, n: (g.end - g.start) / size}
+	case bytesRegion:
+		g.cover = transcodeRegion{kind: bytesRegion, off: g.start, n: g.end - g.start}
+	default:
+		return fmt.Errorf("map entries at offset %d overlap another object", g.start)
+	}
+
+	for _, r := range members[1:] {
+		if r.kind != valueRegion && r.kind != bytesRegion {
+			return fmt.Errorf("map entries at offset %d overlap another object", r.off)
+		}
+		if r.n == 0 {
+			continue
+		}
+
+		// the objects in a region must still be consecutive in the output
+		size := int64(s.size(r, s.src, s.from.WordSize))
+		dstSize := int64(s.size(r, s.dst, s.to.WordSize))
+		first, err := s.translate(g, r.off)
+		if err != nil {
+			return err
+		}
+		last, err := s.translate(g, r.off+(r.n-1)*size)
+		if err != nil {
+			return err
+		}
+		if last-first != (r.n-1)*dstSize {
+			return fmt.Errorf("objects at offset %d overlap objects of a different type", r.off)
+		}
+	}
+	return nil
+}
+
+// flatten gets the element type and count of n objects of a type, looking
+// inside arrays
+func (s *transcodeState) flatten(ref typeRef, n int64) (typeRef, int64) {
+	d := s.src[ref.desc]
+	for d[ref.id].Kind == reflect.Array && d[d[ref.id].Elem].Size > 0 {
+		n *= int64(d[ref.id].Size / d[d[ref.id].Elem].Size)
+		ref.id = d[ref.id].Elem
+	}
+	return ref, n
+}
+
+// locate gets the offset in the output of the object at off
+func (s *transcodeState) locate(off int64) (int64, error) {
+	g := s.groupAt(off)
+	if g == nil {
+		return 0, fmt.Errorf("pointer refers to offset %d, where no object was found", off)
+	}
+	return s.translate(g, off)
+}
+
+// groupAt gets the group that contains off, or nil if there is none
+func (s *transcodeState) groupAt(off int64) *transcodeGroup {
+	i := sort.Search(len(s.groups), func(i int) bool { return s.groups[i].start > off }) - 1
+	if i < 0 || (off >= s.groups[i].end && off != s.groups[i].start) {
+		return nil
+	}
+	return s.groups[i]
+}
+
+// translate gets the offset in the output of the object at off, which lies
+// within the group g
+func (s *transcodeState) translate(g *transcodeGroup, off int64) (int64, error) {
+	rel := off - g.start
+	if g.cover.kind != valueRegion || rel == 0 {
+		return g.dest + rel, nil
+	}
+	ref := g.cover.ref
+	size := int64(s.src[ref.desc][ref.id].Size)
+	dstSize := int64(s.dst[ref.desc][ref.id].Size)
+	inner, err := s.translateWithin(ref, rel%size)
+	if err != nil {
+		return 0, fmt.Errorf("pointer refers to offset %d: %v", off, err)
+	}
+	return g.dest + rel/size*dstSize + inner, nil
+}
+
+// translateWithin gets the offset in the target layout of the part of an
+// object that lies at offset rel in the source layout
+func (s *transcodeState) translateWithin(ref typeRef, rel int64) (int64, error) {
+	if rel == 0 {
+		return 0, nil
+	}
+	d, dd := s.src[ref.desc], s.dst[ref.desc]
+	t := d[ref.id]
+	switch t.Kind {
+	case reflect.Struct:
+		for i, f := range t.Fields {
+			if rel >= int64(f.Offset) && rel < int64(f.Offset+d[f.Type].Size) {
+				inner, err := s.translateWithin(typeRef{desc: ref.desc, id: f.Type}, rel-int64(f.Offset))
+				return int64(dd[ref.id].Fields[i].Offset) + inner, err
+			}
+		}
+	case reflect.Array:
+		size := int64(d[t.Elem].Size)
+		if size > 0 {
+			inner, err := s.translateWithin(typeRef{desc: ref.desc, id: t.Elem}, rel%size)
+			return rel/size*int64(dd[t.Elem].Size) + inner, err
+		}
+	}
+	return 0, fmt.Errorf("offset %d is not the start of a field or element of %v", rel, t.Kind)
+}
+
+// size gets the size of each object in a region, using either the source or
+// target descriptors and word size
+func (s *transcodeState) size(r transcodeRegion, descs []descriptor, word uintptr) uintptr {
+	switch r.kind {
+	case bytesRegion:
+		return 1
+	case entriesHeader:
+		return 3 * word
+	case entriesRegion:
+		d := descs[r.ref.desc]
+		_, size := d.entryLayout(d[r.ref.id].Key, d[r.ref.id].Elem, word)
+		return size
+	default:
+		return descs[r.ref.desc][r.ref.id].Size
+	}
+}
+
+// align gets the alignment of a region on the target
+func (s *transcodeState) align(r transcodeRegion) uintptr {
+	d, word := s.dst[r.ref.desc], s.to.WordSize
+	switch r.kind {
+	case bytesRegion:
+		return 1
+	case entriesHeader:
+		return word
+	case entriesRegion:
+		keyAlign, elemAlign := d.align(d[r.ref.id].Key, word), d.align(d[r.ref.id].Elem, word)
+		if elemAlign > keyAlign {
+			return elemAlign
+		}
+		return keyAlign
+	default:
+		return d.align(r.ref.id, word)
+	}
+}
+
+// push checks that a region lies within the buffer, then adds it to the
+// queue if it has not been seen before
+func (s *transcodeState) push(r transcodeRegion) error {
+	if s.seen[r] {
+		return nil
+	}
+	size := int64(s.size(r, s.src, s.from.WordSize))
+	if r.off < 0 || r.off > int64(len(s.buf)) || r.n < 0 || (size > 0 && r.n > (int64(len(s.buf))-r.off)/size) {
+		return fmt.Errorf("%d objects of %d bytes at offset %d are outside buffer of length %d",
+			r.n, size, r.off, len(s.buf))
+	}
+	if r.kind == entriesRegion && size == 0 && r.n > 1 {
+		return fmt.Errorf("map at offset %d has %d entries of zero size", r.off, r.n)
+	}
+	s.seen[r] = true
+	s.regions = append(s.regions, r)
+	s.queue = append(s.queue, r)
+	return nil
+}
+
+// putUint writes an unsigned integer of the given size in target byte order
+func (s *transcodeState) putUint(off int64, size uintptr, v uint64) {
+	order := s.to.byteOrder()
+	switch size {
+	case 2:
+		order.PutUint16(s.out[off:], uint16(v))
+	case 4:
+		order.PutUint32(s.out[off:], uint32(v))
+	default:
+		order.PutUint64(s.out[off:], v)
+	}
+}
+
+// putWord writes an unsigned word of the target architecture
+func (s *transcodeState) putWord(off int64, v uint64) error {
+	if s.to.WordSize == 4 && v > math.MaxUint32 {
+		return fmt.Errorf("value %d at offset %d does not fit in 32 bits", v, off)
+	}
+	s.putUint(off, s.to.WordSize, v)
+	return nil
+}
+
+// putInt writes a signed word of the target architecture
+func (s *transcodeState) putInt(off int64, v int64) error {
+	if s.to.WordSize == 4 && (v < math.MinInt32 || v > math.MaxInt32) {
+		return fmt.Errorf("value %d at offset %d does not fit in 32 bits", v, off)
+	}
+	s.putUint(off, s.to.WordSize, uint64(v))
+	return nil
+}
+
+// putPointer writes the pointer at src to dst, relocated to the target layout
+func (s *transcodeState) putPointer(src, dst int64) error {
+	if !s.isPtr.contains(src) {
+		return nil
+	}
+	target, err := s.locate(int64(s.word(src)))
+	if err != nil {
+		return err
+	}
+	s.ptrs = append(s.ptrs, dst)
+	return s.putWord(dst, uint64(target))
+}
+
+// scanRegion pushes each region referred to by the objects in r
+func (s *transcodeState) scanRegion(r transcodeRegion) error {
+	switch r.kind {
+	case valueRegion:
+		if !s.pointers[r.ref.desc][r.ref.id] {
+			return nil
+		}
+		size := int64(s.src[r.ref.desc][r.ref.id].Size)
+		for i := int64(0); i < r.n; i++ {
+			err := s.scan(r.off+i*size, r.ref)
+			if err != nil {
+				return err
+			}
+		}
+	case entriesHeader:
+		p, ok, err := s.pointer(r.off)
+		if err != nil {
+			return err
+		}
+		n := int64(s.word(r.off + int64(s.from.WordSize)))
+		if !ok {
+			if n != 0 {
+				return fmt.Errorf("map entries at offset %d are nil but have length %d", r.off, n)
+			}
+			return nil
+		}
+		return s.push(transcodeRegion{kind: entriesRegion, off: p, ref: r.ref, n: n})
+	case entriesRegion:
+		d := s.src[r.ref.desc]
+		t := d[r.ref.id]
+		valueOffset, size := d.entryLayout(t.Key, t.Elem, s.from.WordSize)
+		for i := int64(0); i < r.n; i++ {
+			entry := r.off + i*int64(size)
+			err := s.scan(entry, typeRef{desc: r.ref.desc, id: t.Key})
+			if err != nil {
+				return err
+			}
+			err = s.scan(entry+int64(valueOffset), typeRef{desc: r.ref.desc, id: t.Elem})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scan pushes each region referred to by the object at off
+func (s *transcodeState) scan(off int64, ref typeRef) error {
+	if !s.pointers[ref.desc][ref.id] {
+		return nil
+	}
+
+	d := s.src[ref.desc]
+	t := d[ref.id]
+	word := int64(s.from.WordSize)
+	elem := typeRef{desc: ref.desc, id: t.Elem}
+
+	switch t.Kind {
+	case reflect.Struct:
+		for _, f := range t.Fields {
+			err := s.scan(off+int64(f.Offset), typeRef{desc: ref.desc, id: f.Type})
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		size := int64(d[t.Elem].Size)
+		for i := int64(0); i < int64(t.Size)/size; i++ {
+			err := s.scan(off+i*size, elem)
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr, reflect.Map:
+		p, ok, err := s.pointer(off)
+		if err != nil || !ok {
+			return err
+		}
+		if t.Kind == reflect.Map {
+			return s.push(transcodeRegion{kind: entriesHeader, off: p, ref: ref, n: 1})
+		}
+		return s.push(transcodeRegion{kind: valueRegion, off: p, ref: elem, n: 1})
+	case reflect.Slice, reflect.String:
+		p, ok, err := s.pointer(off)
+		if err != nil {
+			return err
+		}
+		n := int64(s.word(off + word))
+		if !ok {
+			if n != 0 {
+				return fmt.Errorf("slice or string at offset %d is nil but has length %d", off, n)
+			}
+			return nil
+		}
+		if t.Kind == reflect.String {
+			return s.push(transcodeRegion{kind: bytesRegion, off: p, n: n})
+		}
+		return s.push(transcodeRegion{kind: valueRegion, off: p, ref: elem, n: n})
+	case reflect.Interface:
+		id := s.word(off)
+		if id == 0 {
+			if s.word(off+word) != 0 || s.isPtr.contains(off+word) {
+				return fmt.Errorf("interface at offset %d is nil but has a data pointer", off)
+			}
+			return nil
+		}
+		if id >= uint64(len(s.src)) {
+			return fmt.Errorf("interface at offset %d has invalid type ID %d", off, id)
+		}
+		p, ok, err := s.pointer(off + word)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("interface at offset %d has a data pointer that is missing from the pointer table", off)
+		}
+		return s.push(transcodeRegion{kind: valueRegion, off: p, ref: typeRef{desc: int(id)}, n: 1})
+	default:
+		return fmt.Errorf("cannot transcode objects of kind %v", t.Kind)
+	}
+	return nil
+}
+
+// write converts the contents of a region to the target layout at dest
+func (s *transcodeState) write(r transcodeRegion, dest int64) error {
+	switch r.kind {
+	case bytesRegion:
+		copy(s.out[dest:], s.buf[r.off:r.off+r.n])
+	case entriesHeader:
+		err := s.putPointer(r.off, dest)
+		if err != nil {
+			return err
+		}
+		n := s.word(r.off + int64(s.from.WordSize))
+		word := int64(s.to.WordSize)
+		err = s.putWord(dest+word, n)
+		if err != nil {
+			return err
+		}
+		return s.putWord(dest+2*word, n)
+	case entriesRegion:
+		t := s.src[r.ref.desc][r.ref.id]
+		srcValue, srcSize := s.src[r.ref.desc].entryLayout(t.Key, t.Elem, s.from.WordSize)
+		dstValue, dstSize := s.dst[r.ref.desc].entryLayout(t.Key, t.Elem, s.to.WordSize)
+		for i := int64(0); i < r.n; i++ {
+			src, dst := r.off+i*int64(srcSize), dest+i*int64(dstSize)
+			err := s.copy(src, dst, typeRef{desc: r.ref.desc, id: t.Key})
+			if err != nil {
+				return err
+			}
+			err = s.copy(src+int64(srcValue), dst+int64(dstValue), typeRef{desc: r.ref.desc, id: t.Elem})
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return s.copyRange(r.off, dest, r.ref, r.n)
+	}
+	return nil
+}
+
+// copyRange converts n consecutive objects of the same type
+func (s *transcodeState) copyRange(src, dst int64, ref typeRef, n int64) error {
+	st, dt := s.src[ref.desc][ref.id], s.dst[ref.desc][ref.id]
+	if st.Size == 0 {
+		return nil
+	}
+	if isScalar(st.Kind) && st.Size == dt.Size && (st.Size == 1 || s.from.BigEndian == s.to.BigEndian) {
+		// the objects are unchanged, so copy them all at once
+		size := n * int64(st.Size)
+		copy(s.out[dst:dst+size], s.buf[src:src+size])
+		return nil
+	}
+	for i := int64(0); i < n; i++ {
+		err := s.copy(src+i*int64(st.Size), dst+i*int64(dt.Size), ref)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy converts a single object
+func (s *transcodeState) copy(src, dst int64, ref typeRef) error {
+	st, dt := s.src[ref.desc][ref.id], s.dst[ref.desc][ref.id]
+	fromWord, toWord := int64(s.from.WordSize), int64(s.to.WordSize)
+
+	switch st.Kind {
+	case reflect.Struct:
+		for i, f := range st.Fields {
+			err := s.copy(src+int64(f.Offset), dst+int64(dt.Fields[i].Offset), typeRef{desc: ref.desc, id: f.Type})
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		elem := s.src[ref.desc][st.Elem]
+		if elem.Size > 0 {
+			return s.copyRange(src, dst, typeRef{desc: ref.desc, id: st.Elem}, int64(st.Size/elem.Size))
+		}
+	case reflect.Bool, reflect.Int8, reflect.Uint8:
+		s.out[dst] = s.buf[src]
+	case reflect.Int16, reflect.Uint16, reflect.Int32, reflect.Uint32,
+		reflect.Int64, reflect.Uint64, reflect.Float32, reflect.Float64:
+		s.putUint(dst, st.Size, s.getUint(src, st.Size))
+	case reflect.Complex64, reflect.Complex128:
+		half := st.Size / 2
+		s.putUint(dst, half, s.getUint(src, half))
+		s.putUint(dst+int64(half), half, s.getUint(src+int64(half), half))
+	case reflect.Int:
+		v := int64(s.word(src))
+		if fromWord == 4 {
+			v = int64(int32(v))
+		}
+		return s.putInt(dst, v)
+	case reflect.Uint, reflect.Uintptr:
+		return s.putWord(dst, s.word(src))
+	case reflect.Ptr, reflect.Map:
+		return s.putPointer(src, dst)
+	case reflect.Slice:
+		err := s.putPointer(src, dst)
+		if err != nil {
+			return err
+		}
+		// the capacity is not preserved, since only len elements were encoded
+		n := s.word(src + fromWord)
+		err = s.putWord(dst+toWord, n)
+		if err != nil {
+			return err
+		}
+		return s.putWord(dst+2*toWord, n)
+	case reflect.String:
+		err := s.putPointer(src, dst)
+		if err != nil {
+			return err
+		}
+		return s.putWord(dst+toWord, s.word(src+fromWord))
+	case reflect.Interface:
+		err := s.putWord(dst, s.word(src))
+		if err != nil {
+			return err
+		}
+		return s.putPointer(src+fromWord, dst+toWord)
+	default:
+		return fmt.Errorf("cannot transcode objects of kind %v", st.Kind)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package memdump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type transcodeNode struct {
+	A     int8
+	B     int64
+	C     int
+	D     complex64
+	S     string
+	Xs    []uint16
+	Next  *transcodeNode
+	M     map[string]int32
+	Shape shape
+	Arr   [2]uintptr
+}
+
+func newTranscodeNode() *transcodeNode {
+	n := transcodeNode{
+		A:     -3,
+		B:     1 << 40,
+		C:     -12345,
+		D:     complex(1.5, -2.5),
+		S:     "hello",
+		Xs:    []uint16{1, 2, 0xabcd},
+		M:     map[string]int32{"x": 1, "y": -2},
+		Shape: &polygon{Name: "p", Points: [][2]float64{{1, 2}}},
+		Arr:   [2]uintptr{7, 8},
+	}
+	n.Next = &transcodeNode{S: "child", Next: &n}
+	return &n
+}
+
+// transcodeVia transcodes a stream to goarch and then back to this machine
+func transcodeVia(t *testing.T, r io.Reader, goarch string) *bytes.Buffer {
+	var foreign, native bytes.Buffer
+	require.NoError(t, Transcode(r, &foreign, goarch))
+	require.NoError(t, Transcode(&foreign, &native, runtime.GOARCH))
+	return &native
+}
+
+func TestTranscode_Single(t *testing.T) {
+	for _, goarch := range []string{"amd64", "386", "s390x", "mips"} {
+		var b bytes.Buffer
+		require.NoError(t, Encode(&b, newTranscodeNode()))
+
+		var dest *transcodeNode
+		require.NoError(t, Decode(transcodeVia(t, &b, goarch), &dest), goarch)
+
+		expected := newTranscodeNode()
+		assert.Equal(t, expected.S, dest.S, goarch)
+		assert.Equal(t, expected.A, dest.A, goarch)
+		assert.Equal(t, expected.B, dest.B, goarch)
+		assert.Equal(t, expected.C, dest.C, goarch)
+		assert.Equal(t, expected.D, dest.D, goarch)
+		assert.Equal(t, expected.Xs, dest.Xs, goarch)
+		assert.Equal(t, expected.M, dest.M, goarch)
+		assert.Equal(t, expected.Shape, dest.Shape, goarch)
+		assert.Equal(t, expected.Arr, dest.Arr, goarch)
+		assert.Equal(t, "child", dest.Next.S, goarch)
+		assert.Same(t, dest.Next, dest.Next.Next.Next, goarch)
+	}
+}
+
+func TestTranscode_Homogeneous(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	require.NoError(t, enc.Encode(&recordV1{ID: 1, Name: "x", Score: 1.5}))
+	require.NoError(t, enc.Encode(&recordV1{ID: 2, Name: "y", Score: -3}))
+
+	dec := NewDecoder(transcodeVia(t, &b, "mips"))
+	var dest recordV1
+	require.NoError(t, dec.Decode(&dest))
+	assert.Equal(t, recordV1{ID: 1, Name: "x", Score: 1.5}, dest)
+	require.NoError(t, dec.Decode(&dest))
+	assert.Equal(t, recordV1{ID: 2, Name: "y", Score: -3}, dest)
+	assert.Equal(t, io.EOF, dec.Decode(&dest))
+}
+
+func TestTranscode_Heterogeneous(t *testing.T) {
+	x, s := 3, "abc"
+	var b bytes.Buffer
+	enc := NewHeterogeneousEncoder(&b)
+	require.NoError(t, enc.Encode(&x))
+	require.NoError(t, enc.Encode(&s))
+
+	dec := NewHeterogeneousDecoder(transcodeVia(t, &b, "386"))
+	var x2 int
+	var s2 string
+	require.NoError(t, dec.Decode(&x2))
+	require.NoError(t, dec.Decode(&s2))
+	assert.Equal(t, x, x2)
+	assert.Equal(t, s, s2)
+	assert.Equal(t, io.EOF, dec.Decode(&x2))
+}
+
+func TestTranscode_HeterogeneousTypeTable(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewHeterogeneousEncoder(&b)
+	for i := 0; i < 3; i++ {
+		x, s := i, fmt.Sprint(i)
+		require.NoError(t, enc.Encode(&x))
+		require.NoError(t, enc.Encode(&s))
+	}
+
+	dec := NewHeterogeneousDecoder(transcodeVia(t, &b, "386"))
+	for i := 0; i < 3; i++ {
+		var x int
+		var s string
+		require.NoError(t, dec.Decode(&x))
+		require.NoError(t, dec.Decode(&s))
+		assert.Equal(t, i, x)
+		assert.Equal(t, fmt.Sprint(i), s)
+	}
+	var x int
+	assert.Equal(t, io.EOF, dec.Decode(&x))
+}
+
+func TestTranscode_FramedHeterogeneous(t *testing.T) {
+	x, s := 3, "abc"
+	var b bytes.Buffer
+	encodeFramedHeterogeneous(t, &b, &x, &s)
+
+	dec := NewHeterogeneousDecoder(transcodeVia(t, &b, "386"))
+	var x2 int
+	var s2 string
+	require.NoError(t, dec.Decode(&x2))
+	require.NoError(t, dec.Decode(&s2))
+	assert.Equal(t, x, x2)
+	assert.Equal(t, s, s2)
+}
+
+func TestTranscode_Layout(t *testing.T) {
+	type T struct {
+		A int8
+		B int64
+		C int
+		D []byte
+	}
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &T{D: []byte("abc")}))
+
+	var out bytes.Buffer
+	require.NoError(t, Transcode(&b, &out, "386"))
+
+	br := bufio.NewReader(&out)
+	_, err := readPreamble(br)
+	require.NoError(t, err)
+	seg, err := newFramedReader(br, preambleSize).Next()
+	require.NoError(t, err)
+	var h header
+	require.NoError(t, gob.NewDecoder(bytes.NewReader(seg)).Decode(&h))
+
+	assert.Equal(t, arch{WordSize: 4}, h.Arch)
+	assert.EqualValues(t, 28, h.Descriptor[0].Size)
+	var offsets []uintptr
+	for _, f := range h.Descriptor[0].Fields {
+		offsets = append(offsets, f.Offset)
+	}
+	assert.Equal(t, []uintptr{0, 4, 12, 16}, offsets)
+}
+
+func TestTranscode_ForeignArchRejected(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &recordV1{ID: 1}))
+
+	var out bytes.Buffer
+	require.NoError(t, Transcode(&b, &out, "s390x"))
+
+	var dest *recordV1
+	assert.Equal(t, ErrIncompatibleArch, Decode(&out, &dest))
+}
+
+func TestTranscode_Overflow(t *testing.T) {
+	if uintptrSize < 8 {
+		t.Skip("ints cannot overflow 32 bits on this machine")
+	}
+	big := int64(math.MaxInt32)
+	x := int(big + 1)
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &x))
+	assert.Error(t, Transcode(&b, io.Discard, "386"))
+}
+
+func TestTranscode_UnknownArch(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, &recordV1{ID: 1}))
+	assert.Error(t, Transcode(&b, io.Discard, "pdp11"))
+}
+
+func TestRelayout(t *testing.T) {
+	type T struct {
+		A int8
+		B complex64
+		C [3]int16
+		D int32
+		E string
+	}
+	d := mustDescribe(t, reflect.TypeOf(T{}))
+	require.NoError(t, d.check())
+	assert.Equal(t, d, d.relayout(nativeArch))
+
+	d32 := d.relayout(arch{WordSize: 4})
+	assert.EqualValues(t, 32, d32[0].Size)
+	assert.EqualValues(t, 8, d32[d32[0].Fields[4].Type].Size)
+}
+
+func TestTranscode_Aliasing(t *testing.T) {
+	for _, goarch := range []string{"386", "s390x"} {
+		src := newAliasing()
+		src.M = map[string]int{"a": 1}
+		var b bytes.Buffer
+		require.NoError(t, Encode(&b, src))
+
+		var dest *aliasing
+		require.NoError(t, Decode(transcodeVia(t, &b, goarch), &dest), goarch)
+		assertAliasing(t, src, dest)
+	}
+}
+
+func TestTranscode_InteriorPointers(t *testing.T) {
+	type inner struct {
+		A int8
+		B uintptr
+	}
+	type T struct {
+		Arr [3]inner
+		PB  *uintptr
+		PI  *inner
+		Sub []inner
+	}
+	src := &T{Arr: [3]inner{{1, 2}, {3, 4}, {5, 6}}}
+	src.PB = &src.Arr[1].B
+	src.PI = &src.Arr[2]
+	src.Sub = src.Arr[1:]
+
+	var b bytes.Buffer
+	require.NoError(t, Encode(&b, src))
+	var dest *T
+	require.NoError(t, Decode(transcodeVia(t, &b, "386"), &dest))
+	assert.Equal(t, src.Arr, dest.Arr)
+	assert.Same(t, &dest.Arr[1].B, dest.PB)
+	assert.Same(t, &dest.Arr[2], dest.PI)
+	assert.Same(t, &dest.Arr[1], &dest.Sub[0])
+}
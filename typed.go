@@ -0,0 +1,142 @@
+package memdump
+
+import (
+	"io"
+	"reflect"
+)
+
+// typeOf gets the type *T. T is known statically, so there is nothing to
+// check, unlike for the interface{} arguments to Encode and Decode.
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil))
+}
+
+// EncodeTo writes a memdump of the object that obj points to, as for Encode.
+func EncodeTo[T any](w io.Writer, obj *T) error {
+	if obj == nil {
+		return &InvalidArgumentError{Type: typeOf[T](), Expected: "a non-nil pointer"}
+	}
+	return encodeSingle(w, typeOf[T](), obj)
+}
+
+// DecodeFrom reads an object written by Encode or EncodeTo and returns a
+// pointer to it, as for Decode.
+func DecodeFrom[T any](r io.Reader) (*T, error) {
+	out, err := decodeSingle(r, typeOf[T]().Elem(), StrictLayout)
+	if err != nil {
+		return nil, err
+	}
+	return out.(*T), nil
+}
+
+// TypedEncoder writes a stream of objects of type T, as for Encoder
+type TypedEncoder[T any] struct {
+	enc *Encoder
+	t   reflect.Type
+}
+
+// NewTypedEncoder creates a TypedEncoder that writes memdumps to the provided
+// writer
+func NewTypedEncoder[T any](w io.Writer) *TypedEncoder[T] {
+	return &TypedEncoder[T]{
+		enc: NewEncoder(w),
+		t:   typeOf[T](),
+	}
+}
+
+// NewTypedIndexedEncoder creates a TypedEncoder that writes an index when
+// Close is called, as for NewIndexedEncoder
+func NewTypedIndexedEncoder[T any](w io.Writer) *TypedEncoder[T] {
+	return &TypedEncoder[T]{
+		enc: NewIndexedEncoder(w),
+		t:   typeOf[T](),
+	}
+}
+
+// Encode writes a memdump of the object that obj points to
+func (e *TypedEncoder[T]) Encode(obj *T) error {
+	if obj == nil {
+		return &InvalidArgumentError{Type: e.t, Expected: "a non-nil pointer"}
+	}
+	// every object has the type T, so there is no need to check it
+	err := e.enc.start(e.t)
+	if err != nil {
+		return err
+	}
+	data, loc, err := e.enc.encodeData(obj, &e.enc.buf, e.enc.zip)
+	if err != nil {
+		return err
+	}
+	return e.enc.writeRecord(data, loc)
+}
+
+// EncodeBatch writes memdumps of the provided objects in order, encoding
+// several of them at once, as for Encoder.EncodeBatch
+func (e *TypedEncoder[T]) EncodeBatch(objs ...*T) error {
+	ifaces := make([]interface{}, len(objs))
+	for i, obj := range objs {
+		ifaces[i] = obj
+	}
+	return e.enc.EncodeBatch(ifaces...)
+}
+
+// EnableChecksums causes a checksum to be written after each segment, as for
+// Encoder.EnableChecksums
+func (e *TypedEncoder[T]) EnableChecksums() error {
+	return e.enc.EnableChecksums()
+}
+
+// EnableCompression causes each data segment to be compressed, as for
+// Encoder.EnableCompression
+func (e *TypedEncoder[T]) EnableCompression(level int) error {
+	return e.enc.EnableCompression(level)
+}
+
+// Close writes the index for an indexed encoder, as for Encoder.Close
+func (e *TypedEncoder[T]) Close() error {
+	return e.enc.Close()
+}
+
+// TypedDecoder reads a stream of objects of type T, as for Decoder
+type TypedDecoder[T any] struct {
+	dec *Decoder
+	t   reflect.Type
+}
+
+// NewTypedDecoder creates a TypedDecoder that reads memdumps
+func NewTypedDecoder[T any](r io.Reader) *TypedDecoder[T] {
+	d := &TypedDecoder[T]{
+		dec: NewDecoder(r),
+		t:   typeOf[T]().Elem(),
+	}
+	d.dec.SetType(d.t)
+	return d
+}
+
+// NewTypedDecoderBytes creates a TypedDecoder that reads memdumps from a
+// stream held in memory, as for NewDecoderBytes
+func NewTypedDecoderBytes[T any](data []byte) *TypedDecoder[T] {
+	d := &TypedDecoder[T]{
+		dec: NewDecoderBytes(data),
+		t:   typeOf[T]().Elem(),
+	}
+	d.dec.SetType(d.t)
+	return d
+}
+
+// SetLayoutPolicy determines what happens when the objects in the stream were
+// written with a different layout than T. It must be called before the first
+// call to Decode.
+func (d *TypedDecoder[T]) SetLayoutPolicy(policy LayoutPolicy) {
+	d.dec.SetLayoutPolicy(policy)
+}
+
+// Decode reads the next object from the input and returns a pointer to it. It
+// returns io.EOF at the end of the stream.
+func (d *TypedDecoder[T]) Decode() (*T, error) {
+	ptr, err := d.dec.DecodePtr(d.t)
+	if err != nil {
+		return nil, err
+	}
+	return ptr.(*T), nil
+}
@@ -0,0 +1,94 @@
+package memdump
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeTo(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, EncodeTo(&b, &recordV1{ID: 1, Name: "abc"}))
+
+	dest, err := DecodeFrom[recordV1](&b)
+	require.NoError(t, err)
+	assert.Equal(t, &recordV1{ID: 1, Name: "abc"}, dest)
+}
+
+func TestDecodeFrom_Incompatible(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, EncodeTo(&b, &recordV1{ID: 1}))
+	dest, err := DecodeFrom[recordV2](&b)
+	assert.Equal(t, ErrIncompatibleLayout, err)
+	assert.Nil(t, dest)
+}
+
+func TestTypedEncoder(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewTypedEncoder[recordV1](&b)
+	require.NoError(t, enc.EnableChecksums())
+	require.NoError(t, enc.EnableCompression(flate.BestSpeed))
+	require.NoError(t, enc.Encode(&recordV1{ID: 1, Name: "abc"}))
+	require.NoError(t, enc.EncodeBatch(&recordV1{ID: 2}, &recordV1{ID: 3, Name: "def"}))
+	require.NoError(t, enc.Close())
+
+	dec := NewTypedDecoder[recordV1](&b)
+	for _, expected := range []recordV1{{ID: 1, Name: "abc"}, {ID: 2}, {ID: 3, Name: "def"}} {
+		dest, err := dec.Decode()
+		require.NoError(t, err)
+		assert.Equal(t, expected, *dest)
+	}
+	_, err := dec.Decode()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestTypedEncoder_Indexed(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewTypedIndexedEncoder[recordV1](&b)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, enc.Encode(&recordV1{ID: i}))
+	}
+	require.NoError(t, enc.Close())
+
+	r, err := OpenIndexed(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	require.NoError(t, err)
+	var dest recordV1
+	require.NoError(t, r.Get(3, &dest))
+	assert.Equal(t, 3, dest.ID)
+}
+
+func TestTypedDecoder_LayoutPolicy(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, NewTypedEncoder[recordV1](&b).Encode(&recordV1{ID: 1, Name: "x"}))
+
+	dec := NewTypedDecoderBytes[recordV2](b.Bytes())
+	dec.SetLayoutPolicy(MatchFieldsByName)
+	dest, err := dec.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, recordV2{ID: 1, Name: "x"}, *dest)
+}
+
+func TestTypedEncoder_Nil(t *testing.T) {
+	var b bytes.Buffer
+	err := NewTypedEncoder[recordV1](&b).Encode(nil)
+	assert.IsType(t, &InvalidArgumentError{}, err)
+}
+
+func TestEncodeTo_Nil(t *testing.T) {
+	var b bytes.Buffer
+	err := EncodeTo[recordV1](&b, nil)
+	assert.IsType(t, &InvalidArgumentError{}, err)
+	assert.Zero(t, b.Len())
+}
+
+func TestTypedEncoder_Closed(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewTypedEncoder[recordV1](&b)
+	require.NoError(t, enc.Encode(&recordV1{ID: 1}))
+	require.NoError(t, enc.Close())
+	assert.Equal(t, errEncoderClosed, enc.Encode(&recordV1{ID: 2}))
+}
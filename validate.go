@@ -0,0 +1,341 @@
+package memdump
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"unsafe"
+)
+
+// maxAlign is the largest alignment required by any Go type
+const maxAlign = 8
+
+// pointerSet is a bitmap with one bit for each word in a buffer, which is
+// set if that word is listed in the pointer table
+type pointerSet struct {
+	bits []uint64
+	word int64
+}
+
+// newPointerSet checks that each location in ptrs refers to a word within buf
+// that is aligned to the given word size, and that no location is listed twice.
+func newPointerSet(buf []byte, ptrs []int64, word uintptr) (pointerSet, error) {
+	s := pointerSet{
+		bits: make([]uint64, len(buf)/int(word)/64+1),
+		word: int64(word),
+	}
+	for i, loc := range ptrs {
+		if loc < 0 || loc > int64(len(buf))-s.word {
+			return pointerSet{}, fmt.Errorf("pointer %d was out of range: %d (buffer len=%d)", i, loc, len(buf))
+		}
+		if loc%s.word != 0 {
+			return pointerSet{}, fmt.Errorf("pointer %d was misaligned: %d", i, loc)
+		}
+		w := loc / s.word
+		if s.bits[w/64]&(1<<uint(w%64)) != 0 {
+			return pointerSet{}, fmt.Errorf("pointer %d was listed more than once: %d", i, loc)
+		}
+		s.bits[w/64] |= 1 << uint(w%64)
+	}
+	return s, nil
+}
+
+// add marks the word at loc, which must be within the buffer
+func (s pointerSet) add(loc int64) {
+	w := loc / s.word
+	s.bits[w/64] |= 1 << uint(w%64)
+}
+
+// contains determines whether the word at loc is listed in the pointer table
+func (s pointerSet) contains(loc int64) bool {
+	w := loc / s.word
+	return loc >= 0 && loc%s.word == 0 && w/64 < int64(len(s.bits)) && s.bits[w/64]&(1<<uint(w%64)) != 0
+}
+
+// region is a run of n consecutive objects of type typ at offset off
+type region struct {
+	off int64
+	typ reflect.Type
+	n   int64
+}
+
+// seenKey identifies the objects of one type whose offsets are the same
+// modulo the size of the type
+type seenKey struct {
+	typ   reflect.Type
+	phase int64
+}
+
+// span is the range of bytes [start, end)
+type span struct {
+	start, end int64
+}
+
+// spanSet is a sorted list of disjoint spans
+type spanSet []span
+
+// add adds [start, end) to the set and returns the parts of it that were not
+// already in the set
+func (s *spanSet) add(start, end int64) []span {
+	spans := *s
+	// find the first span that overlaps or touches [start, end)
+	i := sort.Search(len(spans), func(i int) bool { return spans[i].end >= start })
+	j := i
+	var gaps []span
+	cur := start
+	merged := span{start: start, end: end}
+	for ; j < len(spans) && spans[j].start <= end; j++ {
+		if spans[j].start > cur {
+			gaps = append(gaps, span{cur, spans[j].start})
+		}
+		if spans[j].end > cur {
+			cur = spans[j].end
+		}
+		if spans[j].start < merged.start {
+			merged.start = spans[j].start
+		}
+		if spans[j].end > merged.end {
+			merged.end = spans[j].end
+		}
+	}
+	if cur < end {
+		gaps = append(gaps, span{cur, end})
+	}
+
+	// replace spans i to j with the merged span
+	if i == j {
+		spans = append(spans, span{})
+		copy(spans[i+1:], spans[i:])
+	} else {
+		spans = append(spans[:i+1], spans[j:]...)
+	}
+	spans[i] = merged
+	*s = spans
+	return gaps
+}
+
+// validator checks that the pointers in a buffer produced by memEncoder
+// are consistent with the type that the buffer is about to be reinterpreted
+// as. It works on offsets, so it must run before the pointers are relocated.
+type validator struct {
+	buf   []byte
+	isPtr pointerSet
+	used  pointerSet           // used contains the listed words that are pointers of the object
+	words pointerSet           // words contains the lengths, capacities, and type IDs of the object
+	seen  map[seenKey]*spanSet // seen contains the byte ranges that have been queued for each type
+	queue []region
+	types typeTable
+}
+
+// newValidator creates a validator for the pointers at ptrs in buf
+func newValidator(buf []byte, ptrs []int64, types typeTable) (*validator, error) {
+	isPtr, err := newPointerSet(buf, ptrs, uintptrSize)
+	if err != nil {
+		return nil, err
+	}
+	return &validator{
+		buf:   buf,
+		isPtr: isPtr,
+		used:  pointerSet{bits: make([]uint64, len(isPtr.bits)), word: isPtr.word},
+		words: pointerSet{bits: make([]uint64, len(isPtr.bits)), word: isPtr.word},
+		seen:  make(map[seenKey]*spanSet),
+		types: types,
+	}, nil
+}
+
+// validate checks that every pointer, slice header, and string header that
+// is reachable from the object of type t at offset main refers to memory that
+// lies within buf and is correctly aligned for its type. Slots that are not
+// listed in ptrs must be nil. Slice capacities are clamped to their length
+// so that appending to a decoded slice cannot write past the end of its data.
+// Every location in ptrs must be one of the slots that are checked, and none
+// may be a word that is read as a length, capacity, or type ID, since relocate
+// adds the base address to each of them. The type IDs in interface
+// values are looked up in types.
+func validate(buf []byte, ptrs []int64, main int64, t reflect.Type, types typeTable) error {
+	v, err := newValidator(buf, ptrs, types)
+	if err != nil {
+		return err
+	}
+
+	if main < 0 || main >= int64(len(buf)) {
+		return fmt.Errorf("main offset was out of range: %d (buffer len=%d)", main, len(buf))
+	}
+	if err := v.push(region{off: main, typ: t, n: 1}, "main object"); err != nil {
+		return err
+	}
+
+	for len(v.queue) > 0 {
+		cur := v.queue[len(v.queue)-1]
+		v.queue = v.queue[:len(v.queue)-1]
+		if err := v.visit(cur); err != nil {
+			return err
+		}
+	}
+
+	for i, loc := range ptrs {
+		if !v.used.contains(loc) {
+			return fmt.Errorf("pointer %d at offset %d is not a pointer, slice, string, map, or interface of the object", i, loc)
+		}
+		if v.words.contains(loc) {
+			return fmt.Errorf("pointer %d at offset %d is the length, capacity, or type ID of a value in the object", i, loc)
+		}
+	}
+	return nil
+}
+
+// push checks that r lies within the buffer and is aligned, then adds the
+// parts of it that contain pointers that have not yet been checked to the
+// queue. Overlapping regions, such as sub-slices of one array, are therefore
+// only checked once.
+func (v *validator) push(r region, what string) error {
+	size := int64(r.typ.Size())
+	if r.n < 0 || (size > 0 && r.n > int64(len(v.buf))/size) {
+		return fmt.Errorf("%s has invalid length %d for %v", what, r.n, r.typ)
+	}
+	if r.off < 0 || r.off > int64(len(v.buf))-size*r.n {
+		return fmt.Errorf("%s refers to %d bytes at offset %d, outside buffer of length %d",
+			what, size*r.n, r.off, len(v.buf))
+	}
+	if r.off%int64(r.typ.Align()) != 0 {
+		return fmt.Errorf("%s at offset %d is not aligned to %d bytes as required by %v",
+			what, r.off, r.typ.Align(), r.typ)
+	}
+
+	if len(lookupType(r.typ).pointers) == 0 || r.n == 0 {
+		return nil
+	}
+
+	// objects of the same type only overlap exactly if they are a whole
+	// number of objects apart
+	key := seenKey{typ: r.typ, phase: r.off % size}
+	set := v.seen[key]
+	if set == nil {
+		set = new(spanSet)
+		v.seen[key] = set
+	}
+	for _, gap := range set.add(r.off, r.off+size*r.n) {
+		v.queue = append(v.queue, region{off: gap.start, typ: r.typ, n: (gap.end - gap.start) / size})
+	}
+	return nil
+}
+
+// word reads the machine word at the provided offset
+func (v *validator) word(off int64) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&v.buf[off]))
+}
+
+// relocated determines whether the word at the provided offset is in the pointer table
+func (v *validator) relocated(loc int64) bool {
+	return v.isPtr.contains(loc)
+}
+
+// visit checks each pointer contained in the objects in r
+func (v *validator) visit(r region) error {
+	size := int64(r.typ.Size())
+	info := lookupType(r.typ)
+	for i := int64(0); i < r.n; i++ {
+		for _, ptr := range info.pointers {
+			loc := r.off + i*size + int64(ptr.offset)
+			// the data pointer of an interface follows its type word
+			data := loc
+			if ptr.typ.Kind() == reflect.Interface {
+				data += int64(uintptrSize)
+			}
+			if v.relocated(data) {
+				v.used.add(data)
+			}
+
+			// the words that follow the data pointer of a string or slice, and
+			// the type word of an interface, are read as plain integers
+			w := int64(uintptrSize)
+			switch ptr.typ.Kind() {
+			case reflect.String:
+				v.words.add(loc + w)
+			case reflect.Slice:
+				v.words.add(loc + w)
+				v.words.add(loc + 2*w)
+			case reflect.Interface:
+				v.words.add(loc)
+			}
+
+			var err error
+			if ptr.typ.Kind() == reflect.Interface {
+				err = v.checkInterface(loc, ptr.typ)
+			} else {
+				err = v.check(loc, ptr.typ, v.relocated(loc))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// check validates the pointer, slice header, or string header at loc
+func (v *validator) check(loc int64, t reflect.Type, relocated bool) error {
+	what := fmt.Sprintf("%v at offset %d", t, loc)
+
+	var target reflect.Type
+	var n int64 = 1
+	switch t.Kind() {
+	case reflect.Ptr:
+		target = t.Elem()
+	case reflect.Slice:
+		hdr := (*reflect.SliceHeader)(unsafe.Pointer(&v.buf[loc]))
+		if hdr.Len < 0 || hdr.Cap < hdr.Len {
+			return fmt.Errorf("%s has invalid length %d and capacity %d", what, hdr.Len, hdr.Cap)
+		}
+		hdr.Cap = hdr.Len
+		target, n = t.Elem(), int64(hdr.Len)
+	case reflect.String:
+		hdr := (*reflect.StringHeader)(unsafe.Pointer(&v.buf[loc]))
+		if hdr.Len < 0 {
+			return fmt.Errorf("%s has invalid length %d", what, hdr.Len)
+		}
+		target, n = byteType, int64(hdr.Len)
+	case reflect.Map:
+		// maps are encoded as a pointer to a slice of entries
+		target = reflect.SliceOf(mapEntryType(t))
+	}
+
+	if !relocated {
+		if v.word(loc) != 0 {
+			return fmt.Errorf("%s is not nil but is missing from the pointer table", what)
+		}
+		if (t.Kind() == reflect.Slice || t.Kind() == reflect.String) && n != 0 {
+			return fmt.Errorf("%s is nil but has length %d", what, n)
+		}
+		return nil
+	}
+	return v.push(region{off: int64(v.word(loc)), typ: target, n: n}, what)
+}
+
+// checkInterface validates the type ID and data pointer of the interface at loc
+func (v *validator) checkInterface(loc int64, t reflect.Type) error {
+	what := fmt.Sprintf("%v at offset %d", t, loc)
+
+	id := v.word(loc)
+	if id == 0 {
+		if v.word(loc+int64(uintptrSize)) != 0 || v.relocated(loc+int64(uintptrSize)) {
+			return fmt.Errorf("%s is nil but has a data pointer", what)
+		}
+		return nil
+	}
+	if id > uintptr(len(v.types)) {
+		return fmt.Errorf("%s has invalid type ID %d", what, id)
+	}
+
+	concrete := v.types[id-1]
+	if concrete.err != nil {
+		return concrete.err
+	}
+	if !concrete.typ.Implements(t) {
+		return fmt.Errorf("%s holds %v, which does not implement it", what, concrete.typ)
+	}
+	if !v.relocated(loc + int64(uintptrSize)) {
+		return fmt.Errorf("%s has a data pointer that is missing from the pointer table", what)
+	}
+	return v.push(region{off: int64(v.word(loc + int64(uintptrSize))), typ: concrete.typ, n: 1}, what)
+}
@@ -0,0 +1,223 @@
+package memdump
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeForTest encodes obj and returns the raw buffer and pointer locations
+func encodeForTest(t *testing.T, obj interface{}) ([]byte, []int64) {
+	var b bytes.Buffer
+	loc, err := newMemEncoder(&b).Encode(obj)
+	require.NoError(t, err)
+	require.Zero(t, loc.Main)
+	return b.Bytes(), loc.Pointers
+}
+
+// putWord overwrites the machine word at off in the native byte order
+func putWord(buf []byte, off uintptr, v uint64) {
+	if uintptrSize == 8 {
+		nativeArch.byteOrder().PutUint64(buf[off:], v)
+	} else {
+		nativeArch.byteOrder().PutUint32(buf[off:], uint32(v))
+	}
+}
+
+// offsets of the words in an encoded validateNode
+var (
+	nodeSLen = unsafe.Offsetof(validateNode{}.S) + uintptrSize
+	nodeBLen = unsafe.Offsetof(validateNode{}.B) + uintptrSize
+	nodeBCap = unsafe.Offsetof(validateNode{}.B) + 2*uintptrSize
+	nodeNext = unsafe.Offsetof(validateNode{}.Next)
+)
+
+type validateNode struct {
+	X    int
+	S    string
+	B    []byte
+	Next *validateNode
+}
+
+func TestValidate_Cycle(t *testing.T) {
+	src := validateNode{X: 1, S: "abc", B: []byte("xyz")}
+	src.Next = &src
+	buf, ptrs := encodeForTest(t, &src)
+
+	out, err := relocate(buf, ptrs, 0, reflect.TypeOf(src), nil)
+	require.NoError(t, err)
+	dest := out.(*validateNode)
+	assert.Equal(t, "abc", dest.S)
+	assert.Equal(t, dest, dest.Next)
+}
+
+func TestValidate_PointerTargetOutOfBounds(t *testing.T) {
+	src := validateNode{Next: &validateNode{}}
+	buf, ptrs := encodeForTest(t, &src)
+
+	putWord(buf, nodeNext, uint64(len(buf)))
+	_, err := relocate(buf, ptrs, 0, reflect.TypeOf(src), nil)
+	assert.Error(t, err)
+}
+
+func TestValidate_PointerTargetMisaligned(t *testing.T) {
+	src := validateNode{Next: &validateNode{}}
+	buf, ptrs := encodeForTest(t, &src)
+
+	putWord(buf, nodeNext, 3)
+	_, err := relocate(buf, ptrs, 0, reflect.TypeOf(src), nil)
+	assert.Error(t, err)
+}
+
+func TestValidate_StringTooLong(t *testing.T) {
+	src := validateNode{S: "abc"}
+	buf, ptrs := encodeForTest(t, &src)
+
+	putWord(buf, nodeSLen, 1000)
+	_, err := relocate(buf, ptrs, 0, reflect.TypeOf(src), nil)
+	assert.Error(t, err)
+}
+
+func TestValidate_SliceTooLong(t *testing.T) {
+	src := validateNode{B: []byte("abc")}
+	buf, ptrs := encodeForTest(t, &src)
+
+	putWord(buf, nodeBLen, 1000)
+	putWord(buf, nodeBCap, 1000)
+	_, err := relocate(buf, ptrs, 0, reflect.TypeOf(src), nil)
+	assert.Error(t, err)
+}
+
+func TestValidate_SliceLengthExceedsCapacity(t *testing.T) {
+	src := validateNode{B: []byte("abc")}
+	buf, ptrs := encodeForTest(t, &src)
+
+	putWord(buf, nodeBCap, 1)
+	_, err := relocate(buf, ptrs, 0, reflect.TypeOf(src), nil)
+	assert.Error(t, err)
+}
+
+func TestValidate_CapacityClamped(t *testing.T) {
+	src := validateNode{B: make([]byte, 3, 100)}
+	buf, ptrs := encodeForTest(t, &src)
+
+	out, err := relocate(buf, ptrs, 0, reflect.TypeOf(src), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, cap(out.(*validateNode).B))
+}
+
+func TestValidate_PointerMissingFromTable(t *testing.T) {
+	src := validateNode{}
+	buf, ptrs := encodeForTest(t, &src)
+
+	putWord(buf, nodeNext, 0xdeadbeef)
+	_, err := relocate(buf, ptrs, 0, reflect.TypeOf(src), nil)
+	assert.Error(t, err)
+}
+
+func TestValidate_NilStringWithLength(t *testing.T) {
+	src := validateNode{}
+	buf, ptrs := encodeForTest(t, &src)
+
+	putWord(buf, nodeSLen, 5)
+	_, err := relocate(buf, ptrs, 0, reflect.TypeOf(src), nil)
+	assert.Error(t, err)
+}
+
+func TestValidate_DuplicatePointer(t *testing.T) {
+	src := validateNode{S: "abc"}
+	buf, ptrs := encodeForTest(t, &src)
+
+	_, err := relocate(buf, append(ptrs, ptrs[0]), 0, reflect.TypeOf(src), nil)
+	assert.Error(t, err)
+}
+
+func TestValidate_PointerNotASlot(t *testing.T) {
+	src := validateNode{S: "abc", B: []byte("xyz")}
+	buf, ptrs := encodeForTest(t, &src)
+
+	// the length of S, the capacity of B, and X are all words that relocate
+	// would otherwise add the base address to
+	for _, off := range []uintptr{nodeSLen, nodeBCap, unsafe.Offsetof(src.X)} {
+		_, err := relocate(append([]byte(nil), buf...), append(ptrs, int64(off)), 0, reflect.TypeOf(src), nil)
+		assert.Error(t, err, "offset %d", off)
+	}
+}
+
+type validateAliasedLength struct {
+	S *string
+	Q **int
+}
+
+func TestValidate_PointerIsLengthOfString(t *testing.T) {
+	var q *int
+	str := "abc"
+	src := validateAliasedLength{S: &str, Q: &q}
+	buf, ptrs := encodeForTest(t, &src)
+
+	// point Q at the length word of the string that S points to, and list
+	// that word in the pointer table as if it were the *int that Q points to
+	strLen := uintptr(*(*uintptr)(unsafe.Pointer(&buf[0]))) + uintptrSize
+	putWord(buf, strLen, 0)
+	putWord(buf, unsafe.Offsetof(src.Q), uint64(strLen))
+	_, err := relocate(buf, append(ptrs, int64(strLen)), 0, reflect.TypeOf(src), nil)
+	assert.Error(t, err)
+}
+
+func TestValidate_MainTooLarge(t *testing.T) {
+	src := validateNode{}
+	buf, ptrs := encodeForTest(t, &src)
+
+	_, err := relocate(buf, ptrs, int64(uintptrSize), reflect.TypeOf(src), nil)
+	assert.Error(t, err)
+}
+
+func TestSpanSet(t *testing.T) {
+	var s spanSet
+	assert.Equal(t, []span{{10, 20}}, s.add(10, 20))
+	assert.Equal(t, []span{{30, 40}}, s.add(30, 40))
+	assert.Empty(t, s.add(12, 18))
+	assert.Equal(t, []span{{0, 10}, {20, 30}, {40, 50}}, s.add(0, 50))
+	assert.Equal(t, spanSet{{0, 50}}, s)
+	assert.Equal(t, []span{{50, 60}}, s.add(45, 60))
+	assert.Equal(t, []span{{70, 80}}, s.add(70, 80))
+	assert.Equal(t, spanSet{{0, 60}, {70, 80}}, s)
+}
+
+func TestValidate_SubSlices(t *testing.T) {
+	// each sub-slice overlaps all of the ones before it, so checking each
+	// of them in full would take quadratic time
+	backing := make([]*int, 2000)
+	for i := range backing {
+		backing[i] = new(int)
+		*backing[i] = i
+	}
+	src := make([][]*int, len(backing))
+	for i := range src {
+		src[i] = backing[i:]
+	}
+	buf, ptrs := encodeForTest(t, &src)
+
+	// count the objects that are checked
+	v, err := newValidator(buf, ptrs, nil)
+	require.NoError(t, err)
+	var queued int64
+	require.NoError(t, v.push(region{off: 0, typ: reflect.TypeOf(src), n: 1}, "main object"))
+	for len(v.queue) > 0 {
+		cur := v.queue[len(v.queue)-1]
+		v.queue = v.queue[:len(v.queue)-1]
+		queued += cur.n
+		require.NoError(t, v.visit(cur))
+	}
+	assert.LessOrEqual(t, queued, int64(2*len(backing)+1))
+
+	out, err := relocate(buf, ptrs, 0, reflect.TypeOf(src), nil)
+	require.NoError(t, err)
+	dest := *out.(*[][]*int)
+	assert.Equal(t, 1999, *dest[1999][0])
+	assert.Equal(t, &dest[0][5], &dest[5][0])
+}